@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+var roleRanks = map[string]int{
+	database.RoleViewer: 1,
+	database.RoleEditor: 2,
+	database.RoleOwner:  3,
+}
+
+// orgVideoRoles maps an organization member's role to their role on the
+// organization's videos.
+var orgVideoRoles = map[string]string{
+	database.OrgRoleAdmin:  database.RoleOwner,
+	database.OrgRoleEditor: database.RoleEditor,
+	database.OrgRoleViewer: database.RoleViewer,
+}
+
+// videoRole returns the caller's role on a video, or "" if they have none.
+// The video's creator is always an owner; everyone else gets the higher of
+// their grant and their role in the video's organization.
+func (cfg *apiConfig) videoRole(video database.Video, userID uuid.UUID) (string, error) {
+	if userID == uuid.Nil {
+		return "", nil
+	}
+	if video.UserID == userID {
+		return database.RoleOwner, nil
+	}
+	grant, err := cfg.db.GetVideoGrant(video.ID, userID)
+	if err != nil {
+		return "", err
+	}
+	role := grant.Role
+
+	if video.OrgID != nil {
+		member, err := cfg.db.GetOrgMember(*video.OrgID, userID)
+		if err != nil {
+			return "", err
+		}
+		if orgRole := orgVideoRoles[member.Role]; roleRanks[orgRole] > roleRanks[role] {
+			role = orgRole
+		}
+	}
+	return role, nil
+}
+
+// hasVideoRole reports whether the caller has at least role on the video.
+// Every handler checks video permissions through here.
+func (cfg *apiConfig) hasVideoRole(video database.Video, userID uuid.UUID, role string) (bool, error) {
+	userRole, err := cfg.videoRole(video, userID)
+	if err != nil {
+		return false, err
+	}
+	return roleRanks[userRole] >= roleRanks[role], nil
+}
+
+// getVideoForRole loads a video and checks the caller has at least role on
+// it, writing the error response itself when they don't.
+func (cfg *apiConfig) getVideoForRole(w http.ResponseWriter, r *http.Request, role string) (database.Video, uuid.UUID, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.Video{}, uuid.Nil, false
+	}
+
+	userID := requestUserID(r)
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving video", err)
+		return database.Video{}, uuid.Nil, false
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return database.Video{}, uuid.Nil, false
+	}
+	allowed, err := cfg.hasVideoRole(video, userID, role)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check permissions", err)
+		return database.Video{}, uuid.Nil, false
+	}
+	if !allowed {
+		respondWithError(w, http.StatusForbidden, "You don't have access to this video", nil)
+		return database.Video{}, uuid.Nil, false
+	}
+	return video, userID, true
+}
+
+func (cfg *apiConfig) handlerVideoGrantsList(w http.ResponseWriter, r *http.Request) {
+	video, _, ok := cfg.getVideoForRole(w, r, database.RoleOwner)
+	if !ok {
+		return
+	}
+
+	grants, err := cfg.db.GetVideoGrants(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve grants", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, grants)
+}
+
+// handlerVideoGrantsPut gives another user a role on a video, replacing any
+// role they already had.
+func (cfg *apiConfig) handlerVideoGrantsPut(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+
+	video, _, ok := cfg.getVideoForRole(w, r, database.RoleOwner)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if !database.ValidRole(params.Role) {
+		respondWithError(w, http.StatusBadRequest, "role must be viewer, editor or owner", nil)
+		return
+	}
+
+	grantee, err := cfg.db.GetUserByEmail(params.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if grantee.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "User not found", nil)
+		return
+	}
+	if grantee.ID == video.UserID {
+		respondWithError(w, http.StatusBadRequest, "The video's creator is always an owner", nil)
+		return
+	}
+
+	grant, err := cfg.db.UpsertVideoGrant(video.ID, grantee.ID, params.Role)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save grant", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, grant)
+}
+
+func (cfg *apiConfig) handlerVideoGrantsDelete(w http.ResponseWriter, r *http.Request) {
+	video, _, ok := cfg.getVideoForRole(w, r, database.RoleOwner)
+	if !ok {
+		return
+	}
+
+	granteeID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID", err)
+		return
+	}
+
+	err = cfg.db.DeleteVideoGrant(video.ID, granteeID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete grant", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,4 +1,22 @@
 document.addEventListener('DOMContentLoaded', async () => {
+  // SSO logins come back with their tokens in the URL fragment.
+  const fragment = new URLSearchParams(window.location.hash.slice(1));
+  if (fragment.get('token')) {
+    localStorage.setItem('token', fragment.get('token'));
+    localStorage.setItem('refreshToken', fragment.get('refresh_token'));
+    history.replaceState(null, '', window.location.pathname);
+  }
+  // Links mailed for email verification and password resets carry their
+  // token the same way.
+  if (fragment.get('verify_email')) {
+    history.replaceState(null, '', window.location.pathname);
+    await confirmEmail(fragment.get('verify_email'));
+  }
+  if (fragment.get('reset_password')) {
+    history.replaceState(null, '', window.location.pathname);
+    await confirmPasswordReset(fragment.get('reset_password'));
+  }
+
   const token = localStorage.getItem('token');
 
   if (token) {
@@ -9,8 +27,84 @@ document.addEventListener('DOMContentLoaded', async () => {
     document.getElementById('auth-section').style.display = 'block';
     document.getElementById('video-section').style.display = 'none';
   }
+
+  const sso = await fetch('/api/oidc').catch(() => null);
+  if (sso?.ok) {
+    document.getElementById('sso-login').style.display = 'inline-block';
+  }
 });
 
+async function confirmEmail(token) {
+  try {
+    const res = await fetch('/api/email_verifications/confirm', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ token }),
+    });
+    if (!res.ok) {
+      const data = await res.json();
+      throw new Error(`Failed to verify email: ${data.error}`);
+    }
+    alert('Your email address is verified.');
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+async function requestPasswordReset() {
+  const email = document.getElementById('email').value || prompt('Email address:');
+  if (!email) return;
+
+  try {
+    const res = await fetch('/api/password_resets', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ email }),
+    });
+    if (!res.ok) {
+      const data = await res.json();
+      throw new Error(`Failed to request password reset: ${data.error}`);
+    }
+    alert(`If ${email} has an account, we've sent it a link to reset the password.`);
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+async function confirmPasswordReset(token) {
+  const password = prompt('Choose a new password:');
+  if (!password) return;
+
+  try {
+    const res = await fetch('/api/password_resets/confirm', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ token, password }),
+    });
+    if (!res.ok) {
+      const data = await res.json();
+      throw new Error(`Failed to reset password: ${data.error}`);
+    }
+    localStorage.removeItem('token');
+    localStorage.removeItem('refreshToken');
+    document.getElementById('auth-section').style.display = 'block';
+    document.getElementById('video-section').style.display = 'none';
+    alert('Your password has been reset. Log in with your new password.');
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+function ssoLogin() {
+  window.location.href = '/api/oidc/login';
+}
+
 document.getElementById('video-draft-form').addEventListener('submit', async (event) => {
   event.preventDefault();
   await createVideoDraft();
@@ -21,16 +115,65 @@ document.getElementById('login-form').addEventListener('submit', async (event) =
   await login();
 });
 
+let refreshing = null;
+
+// refreshTokens trades the refresh token for a new pair. Concurrent callers
+// share one request, since each refresh token can only be used once.
+function refreshTokens() {
+  if (!refreshing) {
+    refreshing = (async () => {
+      const refreshToken = localStorage.getItem('refreshToken');
+      if (!refreshToken) return false;
+      const res = await fetch('/api/refresh', {
+        method: 'POST',
+        headers: {
+          Authorization: `Bearer ${refreshToken}`,
+        },
+      });
+      if (!res.ok) return false;
+      const data = await res.json();
+      localStorage.setItem('token', data.token);
+      localStorage.setItem('refreshToken', data.refresh_token);
+      return true;
+    })().finally(() => {
+      refreshing = null;
+    });
+  }
+  return refreshing;
+}
+
+// authFetch is fetch with the access token attached. When the access token
+// has expired it refreshes it and retries once; if that fails too the user
+// is logged out.
+async function authFetch(url, options = {}) {
+  const send = () =>
+    fetch(url, {
+      ...options,
+      headers: {
+        ...options.headers,
+        Authorization: `Bearer ${localStorage.getItem('token')}`,
+      },
+    });
+
+  let res = await send();
+  if (res.status !== 401) return res;
+  if (await refreshTokens()) {
+    res = await send();
+    if (res.status !== 401) return res;
+  }
+  await logout();
+  return res;
+}
+
 async function createVideoDraft() {
   const title = document.getElementById('video-title').value;
   const description = document.getElementById('video-description').value;
 
   try {
-    const res = await fetch('/api/videos', {
+    const res = await authFetch('/api/videos', {
       method: 'POST',
       headers: {
         'Content-Type': 'application/json',
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
       },
       body: JSON.stringify({ title, description }),
     });
@@ -68,6 +211,7 @@ async function login() {
 
     if (data.token) {
       localStorage.setItem('token', data.token);
+      localStorage.setItem('refreshToken', data.refresh_token);
       document.getElementById('auth-section').style.display = 'none';
       document.getElementById('video-section').style.display = 'block';
       await getVideos();
@@ -102,8 +246,18 @@ async function signup() {
   }
 }
 
-function logout() {
+async function logout() {
+  const refreshToken = localStorage.getItem('refreshToken');
+  if (refreshToken) {
+    await fetch('/api/revoke', {
+      method: 'POST',
+      headers: {
+        Authorization: `Bearer ${refreshToken}`,
+      },
+    }).catch(() => {});
+  }
   localStorage.removeItem('token');
+  localStorage.removeItem('refreshToken');
   document.getElementById('auth-section').style.display = 'block';
   document.getElementById('video-section').style.display = 'none';
 }
@@ -130,11 +284,8 @@ async function uploadThumbnail(videoID) {
   setUploadButtonState(true, uploadBtnSelector);
 
   try {
-    const res = await fetch(`/api/thumbnail_upload/${videoID}`, {
+    const res = await authFetch(`/api/thumbnail_upload/${videoID}`, {
       method: 'POST',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
       body: formData,
     });
     if (!res.ok) {
@@ -163,11 +314,8 @@ async function uploadVideoFile(videoID) {
   setUploadButtonState(true, uploadBtnSelector);
 
   try {
-    const res = await fetch(`/api/video_upload/${videoID}`, {
+    const res = await authFetch(`/api/video_upload/${videoID}`, {
       method: 'POST',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
       body: formData,
     });
     if (!res.ok) {
@@ -188,11 +336,8 @@ const videoStateHandler = createVideoStateHandler();
 
 async function getVideos() {
   try {
-    const res = await fetch('/api/videos', {
+    const res = await authFetch('/api/videos', {
       method: 'GET',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
     });
     if (!res.ok) {
       const data = await res.json();
@@ -231,11 +376,8 @@ function createVideoStateHandler() {
 
 async function getVideo(videoID) {
   try {
-    const res = await fetch(`/api/videos/${videoID}`, {
+    const res = await authFetch(`/api/videos/${videoID}`, {
       method: 'GET',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
     });
     if (!res.ok) {
       throw new Error('Failed to get video.');
@@ -262,6 +404,7 @@ function viewVideo(video) {
   } else {
     thumbnailImg.style.display = 'block';
     thumbnailImg.src = video.thumbnail_url;
+    thumbnailImg.srcset = video.thumbnails?.srcsets?.['image/webp'] ?? '';
   }
 
   const videoPlayer = document.getElementById('video-player');
@@ -283,11 +426,8 @@ async function deleteVideo() {
   }
 
   try {
-    const res = await fetch(`/api/videos/${currentVideo.id}`, {
+    const res = await authFetch(`/api/videos/${currentVideo.id}`, {
       method: 'DELETE',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
     });
     if (!res.ok) {
       throw new Error('Failed to delete video.');
@@ -6,20 +6,33 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
+// assetKeyPrefix is where thumbnails, sprite sheets and their tracks are
+// kept in storage. Everything under it is public and served from
+// assetsBaseURL.
+const assetKeyPrefix = "assets/"
+
+// ensureAssetsDir creates the legacy assets directory. Assets used to be
+// written there before they moved to storage, and it is still served so
+// their URLs keep working.
 func (cfg apiConfig) ensureAssetsDir() error {
+	if cfg.assetsRoot == "" {
+		return nil
+	}
 	if _, err := os.Stat(cfg.assetsRoot); os.IsNotExist(err) {
 		return os.Mkdir(cfg.assetsRoot, 0755)
 	}
@@ -38,12 +51,70 @@ func getAssetPath(videoID uuid.UUID, mediaType string) string {
 	return fmt.Sprintf("%s%s", encodedVideoID, ext)
 }
 
+// makeObjectKey returns a random storage key under prefix.
+func makeObjectKey(prefix string) (string, error) {
+	newIDdata := make([]byte, 32)
+	_, err := rand.Read(newIDdata)
+	if err != nil {
+		return "", err
+	}
+	return prefix + "/" + base64.URLEncoding.EncodeToString(newIDdata), nil
+}
+
+// saveAsset puts body in storage under a new asset key and returns the
+// public URL it is served from.
+func (cfg apiConfig) saveAsset(ctx context.Context, videoID uuid.UUID, body io.Reader, mediaType string) (string, error) {
+	assetPath := getAssetPath(videoID, mediaType)
+	err := cfg.store.Put(ctx, assetKeyPrefix+assetPath, body, mediaType)
+	if err != nil {
+		return "", err
+	}
+	return cfg.getAssetURL(assetPath), nil
+}
+
 func (cfg apiConfig) getAssetDiskPath(assetPath string) string {
 	return filepath.Join(cfg.assetsRoot, assetPath)
 }
 
 func (cfg apiConfig) getAssetURL(assetPath string) string {
-	return fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, assetPath)
+	return cfg.assetsBaseURL + "/" + assetKeyPrefix + assetPath
+}
+
+// assetPathFromURL returns the file name behind an asset URL, or "" for
+// URLs that don't point at an asset. It only looks at the end of the URL so
+// assets keep being found after the base URL changes.
+func assetPathFromURL(assetURL string) string {
+	i := strings.LastIndex(assetURL, "/"+assetKeyPrefix)
+	if i < 0 {
+		return ""
+	}
+	assetPath := assetURL[i+len(assetKeyPrefix)+1:]
+	if strings.Contains(assetPath, "/") {
+		return ""
+	}
+	return assetPath
+}
+
+// removeAsset deletes the asset behind a URL, whether it is in storage or
+// in the legacy assets directory. URLs that don't point at an asset are
+// ignored.
+func (cfg apiConfig) removeAsset(ctx context.Context, assetURL string) error {
+	assetPath := assetPathFromURL(assetURL)
+	if assetPath == "" {
+		return nil
+	}
+	err := cfg.store.Delete(ctx, assetKeyPrefix+assetPath)
+	if err != nil {
+		return err
+	}
+	if cfg.assetsRoot == "" {
+		return nil
+	}
+	err = os.Remove(cfg.getAssetDiskPath(assetPath))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 
 func mediaTypeToExt(mediaType string) string {
@@ -54,61 +125,132 @@ func mediaTypeToExt(mediaType string) string {
 	return "." + parts[1]
 }
 
-func getVideoAspectRatio(filepath string) (string, error) {
-	type videoJsonData struct {
+// probeVideo runs ffprobe and collects the stream and container details we
+// keep for each video. It fails if the file has no video stream.
+func probeVideo(filepath string) (database.VideoMetadata, error) {
+	type probeJsonData struct {
 		Streams []struct {
-			Index     int    `json:"index"`
-			CodecType string `json:"codec_type"`
-			Width     int    `json:"width,omitempty"`
-			Height    int    `json:"height,omitempty"`
+			Index        int    `json:"index"`
+			CodecType    string `json:"codec_type"`
+			CodecName    string `json:"codec_name"`
+			Width        int    `json:"width,omitempty"`
+			Height       int    `json:"height,omitempty"`
+			AvgFrameRate string `json:"avg_frame_rate"`
+			Channels     int    `json:"channels,omitempty"`
+			Tags         struct {
+				Rotate string `json:"rotate"`
+			} `json:"tags"`
+			SideDataList []struct {
+				Rotation float64 `json:"rotation"`
+			} `json:"side_data_list"`
 		} `json:"streams"`
+		Format struct {
+			FormatName string `json:"format_name"`
+			Duration   string `json:"duration"`
+			Size       string `json:"size"`
+			BitRate    string `json:"bit_rate"`
+		} `json:"format"`
 	}
 
-	ffprobe := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filepath)
+	ffprobe := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", "-show_format", filepath)
 	videoData := &bytes.Buffer{}
 	ffprobe.Stdout = videoData
 	err := ffprobe.Run()
 	if err != nil {
-		return "", err
+		return database.VideoMetadata{}, err
 	}
-	var videoJson videoJsonData
+	var videoJson probeJsonData
 	err = json.Unmarshal(videoData.Bytes(), &videoJson)
 	if err != nil {
-		return "", err
+		return database.VideoMetadata{}, err
 	}
 
-	var videoWidth int
-	var videoHeight int
+	meta := database.VideoMetadata{
+		Container: videoJson.Format.FormatName,
+	}
+	meta.DurationSeconds, _ = strconv.ParseFloat(videoJson.Format.Duration, 64)
+	meta.SizeBytes, _ = strconv.ParseInt(videoJson.Format.Size, 10, 64)
+	meta.BitRate, _ = strconv.ParseInt(videoJson.Format.BitRate, 10, 64)
+
+	foundVideo, foundAudio := false, false
 	for _, stream := range videoJson.Streams {
-		if stream.CodecType == "video" {
-			videoWidth = stream.Width
-			videoHeight = stream.Height
-			break
+		switch {
+		case stream.CodecType == "video" && !foundVideo:
+			foundVideo = true
+			meta.VideoCodec = stream.CodecName
+			meta.Width = stream.Width
+			meta.Height = stream.Height
+			meta.FrameRate = parseFrameRate(stream.AvgFrameRate)
+			if rotate, err := strconv.Atoi(stream.Tags.Rotate); err == nil {
+				meta.Rotation = rotate
+			}
+			for _, sideData := range stream.SideDataList {
+				if sideData.Rotation != 0 {
+					meta.Rotation = int(-sideData.Rotation)
+				}
+			}
+			meta.Rotation = ((meta.Rotation % 360) + 360) % 360
+		case stream.CodecType == "audio" && !foundAudio:
+			foundAudio = true
+			meta.AudioCodec = stream.CodecName
+			meta.AudioChannels = stream.Channels
 		}
 	}
+	if !foundVideo || meta.Height == 0 {
+		return database.VideoMetadata{}, errors.New("no video stream found")
+	}
+	return meta, nil
+}
+
+// parseFrameRate turns ffprobe's "30000/1001" style rates into a number.
+func parseFrameRate(rate string) float64 {
+	num, den, found := strings.Cut(rate, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !found {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// displayDimensions returns the width and height the video is shown at,
+// accounting for rotation metadata from phones.
+func displayDimensions(meta database.VideoMetadata) (int, int) {
+	if meta.Rotation == 90 || meta.Rotation == 270 {
+		return meta.Height, meta.Width
+	}
+	return meta.Width, meta.Height
+}
+
+func aspectRatioFromMetadata(meta database.VideoMetadata) string {
+	videoWidth, videoHeight := displayDimensions(meta)
 
 	ratio := int((videoWidth * 100) / videoHeight)
 	ratioCloseToLandscape := ratio >= 175 && ratio <= 177
 	rationCloseToPortrait := ratio >= 55 && ratio <= 57
 
 	if ratioCloseToLandscape {
-		return "16:9", nil
+		return "16:9"
 
 	} else if rationCloseToPortrait {
-		return "9:16", nil
+		return "9:16"
 
 	} else {
-		return "other", nil
+		return "other"
 	}
 }
 
 func processVideoForFasterStart(filePath string) (string, error) {
-	fmt.Println("FILEPATH:", filePath)
 	ext := filepath.Ext(filePath)
 	base := strings.TrimSuffix(filePath, ext)
 	newFilepath := base + "-processing" + ext
-	fmt.Println("NEW FILE PATH:", newFilepath)
-	ffmpeg := exec.Command("ffmpeg", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", newFilepath)
+	ffmpeg := exec.Command("ffmpeg", "-y", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", newFilepath)
 	err := ffmpeg.Run()
 	if err != nil {
 		return "", err
@@ -116,58 +258,43 @@ func processVideoForFasterStart(filePath string) (string, error) {
 	return newFilepath, nil
 }
 
-func generatePresignedURL(s3Client *s3.Client, bucket, key string, expireTime time.Duration) (string, error) {
-	s3PresignedClient := s3.NewPresignClient(s3Client)
-	fmt.Println("S3PRESIGNEDCLIENT IS NIL??:", s3PresignedClient == nil) // -- DELETE
-
-	params := s3.GetObjectInput{
-		Bucket: &bucket,
-		Key:    &key,
-	}
-	fmt.Println("PARAMS:", params) // -- DELETE
-
-	presignedReq, err := s3PresignedClient.PresignGetObject(context.Background(), &params, s3.WithPresignExpires(expireTime))
-	if err != nil {
-		return "", err
+// videoURLToKey extracts the object key from a stored video_url. Older rows
+// store "bucket,key"; newer rows store the bare key.
+func videoURLToKey(videoURL string) (string, error) {
+	parts := strings.Split(videoURL, ",")
+	switch len(parts) {
+	case 1:
+		if parts[0] == "" {
+			return "", fmt.Errorf("incorrect url format")
+		}
+		return parts[0], nil
+	case 2:
+		return parts[1], nil
+	default:
+		return "", fmt.Errorf("incorrect url format")
 	}
-
-	fmt.Println("PRESIGNEDREQ.URL:", presignedReq.URL) // -- DELETE
-	return presignedReq.URL, nil
 }
 
 func (cfg *apiConfig) dbVideoToSignedVideo(video database.Video) (database.Video, error) {
 	if video.VideoURL == nil {
 		return video, fmt.Errorf("incorrect url format")
 	}
-	partsPreURL := strings.Split(*video.VideoURL, ",")
-	if len(partsPreURL) != 2 {
-		return video, fmt.Errorf("incorrect url format")
+	key, err := videoURLToKey(*video.VideoURL)
+	if err != nil {
+		return video, err
 	}
-	bucket := partsPreURL[0]
-	key := partsPreURL[1]
 
 	const expireTime = 3600 * time.Second
 
-	presignedURL, err := generatePresignedURL(cfg.s3Client, bucket, key, expireTime)
+	presignedURL, err := cfg.store.PresignGet(context.Background(), key, expireTime)
 	if err != nil {
 		return video, err
 	}
 
 	video.VideoURL = &presignedURL
-	return video, nil
-}
-
-func (cfg *apiConfig) getVideoUrlHelper(getVideo func(uuid.UUID) (database.Video, error), videoID uuid.UUID) (database.Video, error) {
-	unsignedUrlVideo, err := getVideo(videoID)
-	if err != nil {
-		return database.Video{}, err
+	if video.HLSURL != nil {
+		playlistURL := cfg.signedHLSPlaylistURL(video.ID)
+		video.HLSURL = &playlistURL
 	}
-
-	signedUrlVideo, err := cfg.dbVideoToSignedVideo(unsignedUrlVideo)
-	if err != nil {
-		fmt.Println("ERROR IN getVideoUrlHelper func!!") // -- DELETE
-		return unsignedUrlVideo, err
-	}
-
-	return signedUrlVideo, nil
+	return video, nil
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// Requests authenticate with either a JWT from logging in
+// ("Authorization: Bearer ...") or an API key ("Authorization: ApiKey ...").
+// API keys only work on routes that name a scope, and only if the key was
+// granted it; jwtOnly routes don't accept them at all.
+
+type userIDContextKey struct{}
+
+// jwtOnly is the scope of routes API keys can't use, such as managing the
+// keys themselves.
+const jwtOnly = ""
+
+// apiKeyTouchInterval limits how often a key's last_used_at is written.
+const apiKeyTouchInterval = time.Minute
+
+var (
+	errAPIKeyNotAllowed   = errors.New("API keys can't be used here")
+	errAPIKeyMissingScope = errors.New("API key doesn't have the scope")
+)
+
+// requireAuth rejects requests that aren't authenticated for scope.
+func (cfg *apiConfig) requireAuth(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return cfg.authMiddleware(scope, false, next)
+}
+
+// optionalAuth lets anonymous requests through, but still rejects invalid
+// credentials.
+func (cfg *apiConfig) optionalAuth(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return cfg.authMiddleware(scope, true, next)
+}
+
+func (cfg *apiConfig) authMiddleware(scope string, optional bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if optional && r.Header.Get("Authorization") == "" {
+			next(w, r)
+			return
+		}
+
+		userID, err := cfg.authenticate(r, scope)
+		if errors.Is(err, errAPIKeyNotAllowed) || errors.Is(err, errAPIKeyMissingScope) {
+			respondWithError(w, http.StatusForbidden, err.Error(), nil)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't authenticate request", err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userIDContextKey{}, userID)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// authenticate returns the user a request's credentials belong to.
+func (cfg *apiConfig) authenticate(r *http.Request, scope string) (uuid.UUID, error) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "ApiKey ") {
+		token, err := auth.GetBearerToken(r.Header)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		return auth.ValidateJWT(token, cfg.jwtSecret)
+	}
+
+	if scope == jwtOnly {
+		return uuid.Nil, errAPIKeyNotAllowed
+	}
+	apiKey, err := auth.GetAPIKey(r.Header)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	key, err := cfg.db.GetAPIKeyByHash(auth.HashToken(apiKey))
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if key.ID == uuid.Nil {
+		return uuid.Nil, errors.New("unknown API key")
+	}
+	if key.Expired() {
+		return uuid.Nil, errors.New("API key has expired")
+	}
+	if !key.HasScope(scope) {
+		return uuid.Nil, fmt.Errorf("%w %s", errAPIKeyMissingScope, scope)
+	}
+
+	if key.LastUsedAt == nil || time.Since(*key.LastUsedAt) > apiKeyTouchInterval {
+		err = cfg.db.TouchAPIKey(key.ID)
+		if err != nil {
+			log.Printf("Couldn't record use of API key %s: %v", key.ID, err)
+		}
+	}
+	return key.UserID, nil
+}
+
+// requestUserID returns the user authenticated by requireAuth or
+// optionalAuth, or uuid.Nil for anonymous requests.
+func requestUserID(r *http.Request) uuid.UUID {
+	userID, _ := r.Context().Value(userIDContextKey{}).(uuid.UUID)
+	return userID
+}
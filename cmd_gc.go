@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+)
+
+// runGCCommand deletes unreferenced objects and assets once without
+// starting the server.
+func runGCCommand(cfg *apiConfig, args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	grace := flags.Duration("grace", defaultGCGracePeriod, "only delete files older than this")
+	dryRun := flags.Bool("dry-run", false, "list orphans without deleting them")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() > 0 || *grace < 0 {
+		return fmt.Errorf("usage: tubely gc [-grace 24h] [-dry-run]")
+	}
+
+	result, err := cfg.collectGarbage(context.Background(), *grace, *dryRun)
+	for _, key := range result.Objects {
+		fmt.Println("object", key)
+	}
+	for _, assetPath := range result.Assets {
+		fmt.Println("asset", assetPath)
+	}
+	verb := "Deleted"
+	if *dryRun {
+		verb = "Would delete"
+	}
+	fmt.Printf("%s %d object(s) and %d asset(s)\n", verb, len(result.Objects), len(result.Assets))
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const migrateUsage = "usage: tubely migrate [up | down [steps] | status]"
+
+// runMigrateCommand applies or rolls back schema migrations without
+// starting the server. The server itself applies pending migrations on
+// start.
+func runMigrateCommand(dbURL string, args []string) error {
+	db, err := database.Open(dbURL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		if len(args) > 1 {
+			return errors.New(migrateUsage)
+		}
+		count, err := db.Migrate()
+		fmt.Printf("Applied %d migration(s)\n", count)
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 2 {
+			return errors.New(migrateUsage)
+		}
+		if len(args) == 2 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("steps must be a positive number")
+			}
+		}
+		count, err := db.Rollback(steps)
+		fmt.Printf("Rolled back %d migration(s)\n", count)
+		return err
+	case "status":
+		statuses, err := db.MigrationStatuses()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied"
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, state)
+		}
+		return nil
+	default:
+		return errors.New(migrateUsage)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+const (
+	defaultGCGracePeriod  = 24 * time.Hour
+	defaultTrashRetention = 30 * 24 * time.Hour
+)
+
+func videoFilesOf(video database.Video) database.VideoFiles {
+	return database.VideoFiles{
+		VideoID:      video.ID,
+		VideoURL:     video.VideoURL,
+		HLSURL:       video.HLSURL,
+		ThumbnailURL: video.ThumbnailURL,
+		Thumbnails:   video.Thumbnails,
+		SpriteURL:    video.SpriteURL,
+		SpriteVTTURL: video.SpriteVTTURL,
+	}
+}
+
+// deleteVideoFiles removes a video's object, its HLS files and its assets.
+// It keeps going past failures so one missing file doesn't leave the rest
+// behind; anything it misses is picked up by garbage collection.
+func (cfg *apiConfig) deleteVideoFiles(ctx context.Context, files database.VideoFiles) error {
+	var errs []error
+	if files.VideoURL != nil {
+		key, err := videoURLToKey(*files.VideoURL)
+		if err == nil {
+			errs = append(errs, cfg.store.Delete(ctx, key))
+		}
+	}
+	if files.HLSURL != nil {
+		errs = append(errs, cfg.deleteObjects(ctx, path.Dir(*files.HLSURL)+"/"))
+	}
+	errs = append(errs, cfg.removeThumbnails(ctx, files.ThumbnailURL, files.Thumbnails))
+	for _, assetURL := range []*string{files.SpriteURL, files.SpriteVTTURL} {
+		if assetURL != nil {
+			errs = append(errs, cfg.removeAsset(ctx, *assetURL))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deleteObjects deletes every object under prefix.
+func (cfg *apiConfig) deleteObjects(ctx context.Context, prefix string) error {
+	keys := []string{}
+	err := cfg.store.List(ctx, prefix, func(object storage.ObjectInfo) error {
+		keys = append(keys, object.Key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = cfg.store.Delete(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeVideo permanently deletes a video and then its files. The video is
+// already gone for clients by the time its files are deleted, so a failure
+// there only leaves files for garbage collection to remove.
+func (cfg *apiConfig) purgeVideo(ctx context.Context, video database.Video) error {
+	err := cfg.db.DeleteVideo(video.ID)
+	if err != nil {
+		return err
+	}
+	err = cfg.deleteVideoFiles(ctx, videoFilesOf(video))
+	if err != nil {
+		log.Printf("Couldn't delete files of video %s: %v", video.ID, err)
+	}
+	return nil
+}
+
+// purgeExpiredTrash permanently deletes videos that have been in the trash
+// longer than retention.
+func (cfg *apiConfig) purgeExpiredTrash(ctx context.Context, retention time.Duration) (int, error) {
+	videos, err := cfg.db.GetExpiredTrashedVideos(time.Now().Add(-retention))
+	if err != nil {
+		return 0, err
+	}
+	for i, video := range videos {
+		err = cfg.purgeVideo(ctx, video)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(videos), nil
+}
+
+// startTrashPurger runs purgeExpiredTrash every hour until ctx is
+// cancelled.
+func (cfg *apiConfig) startTrashPurger(ctx context.Context, retention time.Duration) {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for {
+			count, err := cfg.purgeExpiredTrash(ctx, retention)
+			if err != nil {
+				log.Printf("Error purging trash: %v", err)
+			}
+			if count > 0 {
+				log.Printf("Purged %d video(s) from the trash", count)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+type gcResult struct {
+	Objects []string
+	Assets  []string
+}
+
+// collectGarbage deletes objects in storage and files in the legacy assets
+// directory that no video or pending upload references. Only files older
+// than grace are touched, so uploads that haven't been recorded in the
+// database yet survive. With dryRun it only reports what it would delete.
+func (cfg *apiConfig) collectGarbage(ctx context.Context, grace time.Duration, dryRun bool) (gcResult, error) {
+	refs, err := cfg.db.GetReferencedFiles()
+	if err != nil {
+		return gcResult{}, err
+	}
+
+	keys := map[string]bool{}
+	hlsPrefixes := map[string]bool{}
+	assets := map[string]bool{}
+	for _, key := range refs.UploadKeys {
+		keys[key] = true
+	}
+	for _, files := range refs.Videos {
+		if files.VideoURL != nil {
+			if key, err := videoURLToKey(*files.VideoURL); err == nil {
+				keys[key] = true
+			}
+		}
+		if files.HLSURL != nil {
+			hlsPrefixes[path.Dir(*files.HLSURL)] = true
+		}
+		for _, assetURL := range []*string{files.ThumbnailURL, files.SpriteURL, files.SpriteVTTURL} {
+			if assetURL != nil {
+				assets[assetPathFromURL(*assetURL)] = true
+			}
+		}
+		if files.Thumbnails != nil {
+			for _, variant := range files.Thumbnails.Variants {
+				assets[assetPathFromURL(variant.URL)] = true
+			}
+		}
+	}
+
+	cutoff := time.Now().Add(-grace)
+	result := gcResult{
+		Objects: []string{},
+		Assets:  []string{},
+	}
+
+	err = cfg.store.List(ctx, "", func(object storage.ObjectInfo) error {
+		if object.LastModified.After(cutoff) || keys[object.Key] {
+			return nil
+		}
+		if i := strings.Index(object.Key, "_hls/"); i >= 0 && hlsPrefixes[object.Key[:i+len("_hls")]] {
+			return nil
+		}
+		if assetPath, found := strings.CutPrefix(object.Key, assetKeyPrefix); found && assets[assetPath] {
+			return nil
+		}
+		result.Objects = append(result.Objects, object.Key)
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	entries := []os.DirEntry{}
+	if cfg.assetsRoot != "" {
+		entries, err = os.ReadDir(cfg.assetsRoot)
+		if err != nil {
+			return result, err
+		}
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || assets[entry.Name()] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return result, err
+		}
+		if info.ModTime().After(cutoff) {
+			continue
+		}
+		result.Assets = append(result.Assets, entry.Name())
+	}
+
+	if dryRun {
+		return result, nil
+	}
+	for _, key := range result.Objects {
+		err = cfg.store.Delete(ctx, key)
+		if err != nil {
+			return result, err
+		}
+	}
+	for _, assetPath := range result.Assets {
+		err = os.Remove(cfg.getAssetDiskPath(assetPath))
+		if err != nil && !os.IsNotExist(err) {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// purgeExpiredUploadSessions deletes upload sessions that haven't received
+// a chunk in uploadSessionTTL, along with their partial files. Partial
+// files whose session is already gone are removed once they're as old.
+func (cfg *apiConfig) purgeExpiredUploadSessions() (int, error) {
+	cutoff := time.Now().Add(-uploadSessionTTL)
+	sessions, err := cfg.db.GetExpiredUploadSessions(cutoff)
+	if err != nil {
+		return 0, err
+	}
+	for i, session := range sessions {
+		err = os.Remove(cfg.uploadSessionPartPath(session.ID))
+		if err != nil && !os.IsNotExist(err) {
+			return i, err
+		}
+		err = cfg.db.DeleteUploadSession(session.ID)
+		if err != nil {
+			return i, err
+		}
+	}
+
+	parts, err := filepath.Glob(filepath.Join(cfg.uploadsRoot, "*.part"))
+	if err != nil {
+		return len(sessions), err
+	}
+	for _, part := range parts {
+		info, err := os.Stat(part)
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		err = os.Remove(part)
+		if err != nil && !os.IsNotExist(err) {
+			return len(sessions), err
+		}
+	}
+	return len(sessions), nil
+}
+
+// startUploadSessionPurger runs purgeExpiredUploadSessions every hour until
+// ctx is cancelled.
+func (cfg *apiConfig) startUploadSessionPurger(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for {
+			count, err := cfg.purgeExpiredUploadSessions()
+			if err != nil {
+				log.Printf("Error purging upload sessions: %v", err)
+			}
+			if count > 0 {
+				log.Printf("Purged %d expired upload session(s)", count)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// startGarbageCollector runs collectGarbage every interval until ctx is
+// cancelled.
+func (cfg *apiConfig) startGarbageCollector(ctx context.Context, interval, grace time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			result, err := cfg.collectGarbage(ctx, grace, false)
+			if err != nil {
+				log.Printf("Error collecting garbage: %v", err)
+			}
+			if len(result.Objects) > 0 || len(result.Assets) > 0 {
+				log.Printf("Garbage collection removed %d object(s) and %d asset(s)", len(result.Objects), len(result.Assets))
+			}
+		}
+	}()
+}
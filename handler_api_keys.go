@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// apiKeyDisplayLength is how much of a key is kept in the clear so users
+// can recognise it.
+const apiKeyDisplayLength = len(auth.APIKeyPrefix) + 8
+
+func (cfg *apiConfig) handlerAPIKeysCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	type response struct {
+		database.APIKey
+		Key string `json:"key"`
+	}
+
+	userID := requestUserID(r)
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" {
+		respondWithError(w, http.StatusBadRequest, "name is required", nil)
+		return
+	}
+	if len(params.Scopes) == 0 {
+		respondWithError(w, http.StatusBadRequest, "scopes is required", nil)
+		return
+	}
+	for _, scope := range params.Scopes {
+		if !slices.Contains(database.APIKeyScopes, scope) {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("scope must be one of %s", strings.Join(database.APIKeyScopes, ", ")), nil)
+			return
+		}
+	}
+	slices.Sort(params.Scopes)
+	params.Scopes = slices.Compact(params.Scopes)
+	if params.ExpiresAt != nil && !params.ExpiresAt.After(time.Now()) {
+		respondWithError(w, http.StatusBadRequest, "expires_at must be in the future", nil)
+		return
+	}
+
+	key, err := auth.MakeAPIKey()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create API key", err)
+		return
+	}
+
+	apiKey, err := cfg.db.CreateAPIKey(database.CreateAPIKeyParams{
+		UserID:    userID,
+		Name:      params.Name,
+		Prefix:    key[:apiKeyDisplayLength],
+		KeyHash:   auth.HashToken(key),
+		Scopes:    params.Scopes,
+		ExpiresAt: params.ExpiresAt,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save API key", err)
+		return
+	}
+
+	// The key itself is only ever shown here.
+	respondWithJSON(w, http.StatusCreated, response{
+		APIKey: apiKey,
+		Key:    key,
+	})
+}
+
+func (cfg *apiConfig) handlerAPIKeysList(w http.ResponseWriter, r *http.Request) {
+	keys, err := cfg.db.GetAPIKeys(requestUserID(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve API keys", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, keys)
+}
+
+func (cfg *apiConfig) handlerAPIKeysDelete(w http.ResponseWriter, r *http.Request) {
+	keyID, err := uuid.Parse(r.PathValue("keyID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	key, err := cfg.db.GetAPIKey(keyID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get API key", err)
+		return
+	}
+	if key.ID == uuid.Nil || key.UserID != requestUserID(r) {
+		respondWithError(w, http.StatusNotFound, "API key not found", nil)
+		return
+	}
+
+	err = cfg.db.DeleteAPIKey(key.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete API key", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+type testAPIKey struct {
+	database.APIKey
+	Key string `json:"key"`
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	api := newTestAPI(t)
+	_, tokens := api.signUp(t, "user@example.com", "password")
+	var readOnly testAPIKey
+	expect(t, api.do(t, "POST", "/api/api_keys", tokens.Token, map[string]any{
+		"name":   "backup script",
+		"scopes": []string{database.ScopeVideosRead},
+	}), http.StatusCreated, &readOnly)
+	authorization := "ApiKey " + readOnly.Key
+
+	expect(t, api.doAuthorized(t, "GET", "/api/videos", authorization, nil), http.StatusOK, nil)
+	expect(t, api.doAuthorized(t, "POST", "/api/videos", authorization, map[string]string{"title": "video"}), http.StatusForbidden, nil)
+
+	// Keys can't manage keys or sessions, even their own.
+	expect(t, api.doAuthorized(t, "GET", "/api/api_keys", authorization, nil), http.StatusForbidden, nil)
+	expect(t, api.doAuthorized(t, "POST", "/api/api_keys", authorization, map[string]any{
+		"name":   "escalated",
+		"scopes": database.APIKeyScopes,
+	}), http.StatusForbidden, nil)
+	expect(t, api.doAuthorized(t, "DELETE", "/api/sessions", authorization, nil), http.StatusForbidden, nil)
+
+	// The key is only shown once; listing shows its prefix and last use.
+	var keys []database.APIKey
+	expect(t, api.do(t, "GET", "/api/api_keys", tokens.Token, nil), http.StatusOK, &keys)
+	if len(keys) != 1 || keys[0].Prefix == "" || keys[0].LastUsedAt == nil {
+		t.Errorf("listed keys = %+v, want the one key with its prefix and last use", keys)
+	}
+
+	expect(t, api.do(t, "DELETE", "/api/api_keys/"+readOnly.ID.String(), tokens.Token, nil), http.StatusNoContent, nil)
+	expect(t, api.doAuthorized(t, "GET", "/api/videos", authorization, nil), http.StatusUnauthorized, nil)
+}
+
+func TestAPIKeyExpiry(t *testing.T) {
+	api := newTestAPI(t)
+	_, tokens := api.signUp(t, "user@example.com", "password")
+	expect(t, api.do(t, "POST", "/api/api_keys", tokens.Token, map[string]any{
+		"name":       "expired",
+		"scopes":     []string{database.ScopeVideosRead},
+		"expires_at": time.Now().Add(-time.Hour),
+	}), http.StatusBadRequest, nil)
+
+	var key testAPIKey
+	expect(t, api.do(t, "POST", "/api/api_keys", tokens.Token, map[string]any{
+		"name":       "short-lived",
+		"scopes":     []string{database.ScopeVideosRead},
+		"expires_at": time.Now().Add(time.Second),
+	}), http.StatusCreated, &key)
+	expect(t, api.doAuthorized(t, "GET", "/api/videos", "ApiKey "+key.Key, nil), http.StatusOK, nil)
+	time.Sleep(time.Until(*key.ExpiresAt) + 10*time.Millisecond)
+	expect(t, api.doAuthorized(t, "GET", "/api/videos", "ApiKey "+key.Key, nil), http.StatusUnauthorized, nil)
+}
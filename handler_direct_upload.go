@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	maxDirectUploadSize       = 50 << 30
+	directUploadPartSize      = 64 << 20
+	directUploadMultipartSize = 100 << 20
+	directUploadURLExpiry     = 6 * time.Hour
+)
+
+type directUploadPart struct {
+	PartNumber int32  `json:"part_number"`
+	URL        string `json:"url"`
+}
+
+type directUploadResponse struct {
+	database.DirectUpload
+	UploadURL string             `json:"upload_url,omitempty"`
+	PartSize  int64              `json:"part_size,omitempty"`
+	Parts     []directUploadPart `json:"parts,omitempty"`
+	ExpiresAt time.Time          `json:"expires_at"`
+}
+
+// handlerDirectUploadCreate issues presigned URLs so the client can upload a
+// video straight to storage. Files over directUploadMultipartSize get one
+// URL per part of a multipart upload.
+func (cfg *apiConfig) handlerDirectUploadCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Size        int64  `json:"size"`
+		ContentType string `json:"content_type"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	userID := requestUserID(r)
+
+	uploader, ok := cfg.store.(storage.DirectUploader)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Storage backend doesn't support direct uploads", nil)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.ContentType != "video/mp4" {
+		respondWithError(w, http.StatusBadRequest, "Video must be mp4 filetype", nil)
+		return
+	}
+	if params.Size <= 0 || params.Size > maxDirectUploadSize {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("size must be between 1 and %d bytes", int64(maxDirectUploadSize)), nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	allowed, err := cfg.hasVideoRole(video, userID, database.RoleEditor)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check permissions", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusForbidden, "You can't upload to this video", nil)
+		return
+	}
+
+	key, err := makeObjectKey("uploads")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error generating bucket key", err)
+		return
+	}
+
+	resp := directUploadResponse{
+		ExpiresAt: time.Now().UTC().Add(directUploadURLExpiry),
+	}
+	var multipartUploadID *string
+
+	if params.Size > directUploadMultipartSize {
+		uploadID, err := uploader.CreateMultipartUpload(r.Context(), key, params.ContentType)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't start multipart upload", err)
+			return
+		}
+		multipartUploadID = &uploadID
+
+		partCount := (params.Size + directUploadPartSize - 1) / directUploadPartSize
+		resp.PartSize = directUploadPartSize
+		for i := int32(1); i <= int32(partCount); i++ {
+			partSize := min(int64(directUploadPartSize), params.Size-int64(i-1)*directUploadPartSize)
+			url, err := uploader.PresignUploadPart(r.Context(), key, uploadID, i, partSize, directUploadURLExpiry)
+			if err != nil {
+				uploader.AbortMultipartUpload(r.Context(), key, uploadID)
+				respondWithError(w, http.StatusInternalServerError, "Couldn't sign upload part", err)
+				return
+			}
+			resp.Parts = append(resp.Parts, directUploadPart{PartNumber: i, URL: url})
+		}
+	} else {
+		resp.UploadURL, err = uploader.PresignPut(r.Context(), key, params.ContentType, params.Size, directUploadURLExpiry)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't sign upload URL", err)
+			return
+		}
+	}
+
+	resp.DirectUpload, err = cfg.db.CreateDirectUpload(database.CreateDirectUploadParams{
+		VideoID:           videoID,
+		UserID:            userID,
+		ObjectKey:         key,
+		MultipartUploadID: multipartUploadID,
+		ContentType:       params.ContentType,
+		Size:              params.Size,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record upload", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, resp)
+}
+
+// handlerDirectUploadComplete finishes a direct upload, checks with ffprobe
+// that the object is a real video and queues it for processing.
+func (cfg *apiConfig) handlerDirectUploadComplete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Parts []storage.CompletedPart `json:"parts"`
+	}
+
+	uploadID, err := uuid.Parse(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid upload ID", err)
+		return
+	}
+
+	userID := requestUserID(r)
+
+	uploader, ok := cfg.store.(storage.DirectUploader)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Storage backend doesn't support direct uploads", nil)
+		return
+	}
+
+	upload, err := cfg.db.GetDirectUpload(uploadID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return
+	}
+	if upload.ID == uuid.Nil || upload.UserID != userID {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return
+	}
+	if upload.CompletedAt != nil {
+		respondWithError(w, http.StatusConflict, "Upload is already complete", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(upload.VideoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving video", err)
+		return
+	}
+	allowed, err := cfg.hasVideoRole(video, userID, database.RoleEditor)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check permissions", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusForbidden, "You can't upload to this video", nil)
+		return
+	}
+
+	if upload.MultipartUploadID != nil {
+		params := parameters{}
+		err = json.NewDecoder(r.Body).Decode(&params)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+			return
+		}
+		err = uploader.CompleteMultipartUpload(r.Context(), upload.ObjectKey, *upload.MultipartUploadID, params.Parts)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Couldn't complete multipart upload", err)
+			return
+		}
+	}
+
+	// Presigned URLs bind the declared size, but check the stored object
+	// too so nothing bigger can slip through another path.
+	info, err := cfg.store.Head(r.Context(), upload.ObjectKey)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusBadRequest, "Video hasn't been uploaded yet", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check uploaded video", err)
+		return
+	}
+	if info.Size != upload.Size {
+		cfg.store.Delete(r.Context(), upload.ObjectKey)
+		cfg.db.DeleteDirectUpload(upload.ID)
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Uploaded %d bytes but declared %d", info.Size, upload.Size), nil)
+		return
+	}
+
+	object, _, err := cfg.store.Get(r.Context(), upload.ObjectKey)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check uploaded video", err)
+		return
+	}
+	header, err := readHeader(object)
+	object.Close()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check uploaded video", err)
+		return
+	}
+	err = sniffMP4(header)
+	if err != nil {
+		cfg.store.Delete(r.Context(), upload.ObjectKey)
+		cfg.db.DeleteDirectUpload(upload.ID)
+		respondWithValidationError(w, "Error validating video", err)
+		return
+	}
+
+	// ffprobe reads the object over HTTP so the API never downloads it.
+	probeURL, err := cfg.store.PresignGet(r.Context(), upload.ObjectKey, 15*time.Minute)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URL", err)
+		return
+	}
+	_, err = probeVideoContent(probeURL)
+	if err != nil {
+		cfg.store.Delete(r.Context(), upload.ObjectKey)
+		cfg.db.DeleteDirectUpload(upload.ID)
+		respondWithValidationError(w, "Error validating video", err)
+		return
+	}
+
+	// The object is processed like any other upload and becomes the job's
+	// source, which the worker deletes once it's done.
+	completed, err := cfg.db.CompleteDirectUpload(upload.ID, database.CreateProcessingJobParams{
+		VideoID:     video.ID,
+		SourceKey:   upload.ObjectKey,
+		ContentType: upload.ContentType,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't complete upload", err)
+		return
+	}
+	if !completed {
+		respondWithError(w, http.StatusConflict, "Upload is already complete", nil)
+		return
+	}
+	cfg.wakeVideoWorkers()
+
+	video, err = cfg.db.GetVideo(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving video", err)
+		return
+	}
+	video, _ = cfg.dbVideoToSignedVideo(video)
+	respondWithJSON(w, http.StatusAccepted, video)
+}
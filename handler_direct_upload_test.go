@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestDirectUploadComplete(t *testing.T) {
+	fakeFFprobe(t)
+	api := newTestAPI(t)
+	_, tokens := api.signUp(t, "owner@example.com", "password")
+	var video database.Video
+	expect(t, api.do(t, "POST", "/api/videos", tokens.Token, map[string]string{"title": "video"}), http.StatusCreated, &video)
+
+	var upload directUploadResponse
+	expect(t, api.do(t, "POST", "/api/video_upload/"+video.ID.String()+"/direct", tokens.Token, map[string]any{
+		"size":         len(testMP4),
+		"content_type": "video/mp4",
+	}), http.StatusCreated, &upload)
+	req, err := http.NewRequest("PUT", upload.UploadURL, strings.NewReader(testMP4))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	resp, err := api.server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("uploading: %v", err)
+	}
+	defer resp.Body.Close()
+	expect(t, resp, http.StatusOK, nil)
+
+	// The stored object is queued like any other upload rather than
+	// becoming the video as is.
+	complete := "/api/direct_uploads/" + upload.ID.String() + "/complete"
+	expect(t, api.do(t, "POST", complete, tokens.Token, nil), http.StatusAccepted, &video)
+	if video.ProcessingStatus != database.VideoStatusPending || video.VideoURL != nil {
+		t.Errorf("completed video = %+v, want it pending without a video URL", video)
+	}
+	job := claimTestJob(t, api)
+	if job.VideoID != video.ID || job.SourceKey != upload.ObjectKey {
+		t.Errorf("queued job = %+v, want the upload's object for video %v", job, video.ID)
+	}
+
+	expect(t, api.do(t, "POST", complete, tokens.Token, nil), http.StatusConflict, nil)
+	next, err := api.cfg.db.ClaimProcessingJob("test-worker")
+	if err != nil || next.ID != uuid.Nil {
+		t.Errorf("ClaimProcessingJob = %+v, %v; want no second job", next, err)
+	}
+}
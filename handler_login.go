@@ -2,11 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
-	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
 )
 
 func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
@@ -40,35 +41,50 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	accessToken, err := auth.MakeJWT(
-		user.ID,
-		cfg.jwtSecret,
-		time.Hour*24*30,
-	)
+	accessToken, refreshToken, err := cfg.startSession(r, user.ID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create access JWT", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't start session", err)
 		return
 	}
 
-	refreshToken, err := auth.MakeRefreshToken()
+	respondWithJSON(w, http.StatusOK, response{
+		User:         user,
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+	})
+}
+
+// startSession logs userID in, returning an access token and the refresh
+// token of a new session. Every login is its own session, which is its
+// refresh token family.
+func (cfg *apiConfig) startSession(r *http.Request, userID uuid.UUID) (string, string, error) {
+	accessToken, err := auth.MakeJWT(
+		userID,
+		cfg.jwtSecret,
+		cfg.accessTokenTTL,
+	)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token", err)
-		return
+		return "", "", fmt.Errorf("couldn't create access JWT: %w", err)
 	}
 
-	_, err = cfg.db.CreateRefreshToken(database.CreateRefreshTokenParams{
-		UserID:    user.ID,
-		Token:     refreshToken,
-		ExpiresAt: time.Now().UTC().Add(time.Hour * 24 * 60),
+	sessionID := uuid.New()
+	err = cfg.db.CreateSession(database.CreateSessionParams{
+		ID:        sessionID,
+		UserID:    userID,
+		UserAgent: r.UserAgent(),
+		IPAddress: clientIP(r),
 	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't save refresh token", err)
-		return
+		return "", "", fmt.Errorf("couldn't create session: %w", err)
 	}
 
-	respondWithJSON(w, http.StatusOK, response{
-		User:         user,
-		Token:        accessToken,
-		RefreshToken: refreshToken,
-	})
+	refreshToken, params, err := cfg.newRefreshToken(userID, sessionID)
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't create refresh token: %w", err)
+	}
+	_, err = cfg.db.CreateRefreshToken(params)
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't save refresh token: %w", err)
+	}
+	return accessToken, refreshToken, nil
 }
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/google/uuid"
+	"golang.org/x/oauth2"
+)
+
+// Single sign-on uses the authorization code flow with PKCE. The login
+// handler sends the browser to the provider with a random state, nonce and
+// code challenge, remembering them in a short-lived cookie; the callback
+// checks them, exchanges the code for an ID token, and signs the user in
+// with normal Tubely tokens.
+
+const (
+	oidcCookieName = "tubely_oidc"
+	oidcCookiePath = "/api/oidc/"
+	oidcLoginTTL   = 10 * time.Minute
+)
+
+type oidcLoginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+func (cfg *apiConfig) handlerOIDCInfo(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Issuer   string `json:"issuer"`
+		LoginURL string `json:"login_url"`
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Issuer:   cfg.oidc.issuer,
+		LoginURL: "/api/oidc/login",
+	})
+}
+
+func (cfg *apiConfig) handlerOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	state, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't start login", err)
+		return
+	}
+	nonce, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't start login", err)
+		return
+	}
+	login := oidcLoginState{
+		State:    state,
+		Nonce:    nonce,
+		Verifier: oauth2.GenerateVerifier(),
+	}
+
+	data, err := json.Marshal(login)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't start login", err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    base64.RawURLEncoding.EncodeToString(data),
+		Path:     oidcCookiePath,
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   cfg.oidc.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	authURL := cfg.oidc.oauth2.AuthCodeURL(login.State, oidc.Nonce(login.Nonce), oauth2.S256ChallengeOption(login.Verifier))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// handlerOIDCCallback finishes a login and sends the browser back to the
+// app with its tokens in the URL fragment, which never reaches a server.
+func (cfg *apiConfig) handlerOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	login, err := readOIDCLoginState(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Login expired, please try again", err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Path:     oidcCookiePath,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   cfg.oidc.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	query := r.URL.Query()
+	if query.Get("state") != login.State {
+		respondWithError(w, http.StatusBadRequest, "Login state doesn't match", nil)
+		return
+	}
+	if providerErr := query.Get("error"); providerErr != "" {
+		respondWithError(w, http.StatusUnauthorized, "Identity provider refused login", fmt.Errorf("%s: %s", providerErr, query.Get("error_description")))
+		return
+	}
+
+	token, err := cfg.oidc.oauth2.Exchange(r.Context(), query.Get("code"), oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't exchange authorization code", err)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Identity provider didn't return an ID token", nil)
+		return
+	}
+	idToken, err := cfg.oidc.verifier.Verify(r.Context(), rawIDToken)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't verify ID token", err)
+		return
+	}
+	if idToken.Nonce != login.Nonce {
+		respondWithError(w, http.StatusUnauthorized, "ID token nonce doesn't match", nil)
+		return
+	}
+
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	err = idToken.Claims(&claims)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't read ID token claims", err)
+		return
+	}
+
+	user, err := cfg.oidcUser(idToken.Issuer, idToken.Subject, claims.Email, claims.EmailVerified)
+	if errors.Is(err, errOIDCUnverifiedAccount) {
+		respondWithError(w, http.StatusConflict, "An account with this email already exists. Verify its email or reset its password, then sign in again", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "Couldn't sign in with this account", err)
+		return
+	}
+
+	accessToken, refreshToken, err := cfg.startSession(r, user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't start session", err)
+		return
+	}
+
+	fragment := url.Values{}
+	fragment.Set("token", accessToken)
+	fragment.Set("refresh_token", refreshToken)
+	http.Redirect(w, r, "/app/#"+fragment.Encode(), http.StatusFound)
+}
+
+// errOIDCUnverifiedAccount means a local account already uses the identity's
+// email but hasn't verified it. Whoever created it may not own the address,
+// so linking it would hand them the SSO user's sign-ins.
+var errOIDCUnverifiedAccount = errors.New("an unverified account already uses this email")
+
+// oidcUser returns the user an identity provider account belongs to. The
+// first sign-in links the account to the user with the same email, creating
+// one if there isn't any, which only happens for verified emails. An
+// existing user is only linked once they've verified their email too.
+func (cfg *apiConfig) oidcUser(issuer, subject, email string, emailVerified bool) (database.User, error) {
+	identity, err := cfg.db.GetUserIdentity(issuer, subject)
+	if err != nil {
+		return database.User{}, err
+	}
+	if identity.UserID != uuid.Nil {
+		user, err := cfg.db.GetUser(identity.UserID)
+		if err != nil {
+			return database.User{}, err
+		}
+		if user == nil {
+			return database.User{}, errors.New("linked user no longer exists")
+		}
+		return *user, nil
+	}
+
+	if email == "" || !emailVerified {
+		return database.User{}, errors.New("identity provider didn't return a verified email")
+	}
+	user, err := cfg.db.GetUserByEmail(email)
+	if err != nil {
+		return database.User{}, err
+	}
+	if user.ID != uuid.Nil && user.EmailVerifiedAt == nil {
+		return database.User{}, errOIDCUnverifiedAccount
+	}
+	if user.ID == uuid.Nil {
+		// Provisioned users have no usable password until they set one.
+		password, err := auth.MakeRefreshToken()
+		if err != nil {
+			return database.User{}, err
+		}
+		hashedPassword, err := auth.HashPassword(password)
+		if err != nil {
+			return database.User{}, err
+		}
+		created, err := cfg.db.CreateUser(database.CreateUserParams{
+			Email:    email,
+			Password: hashedPassword,
+		})
+		if err != nil {
+			return database.User{}, err
+		}
+		err = cfg.db.MarkEmailVerified(created.ID)
+		if err != nil {
+			return database.User{}, err
+		}
+		user = *created
+	}
+
+	err = cfg.db.CreateUserIdentity(issuer, subject, user.ID)
+	if err != nil {
+		return database.User{}, err
+	}
+	return user, nil
+}
+
+func readOIDCLoginState(r *http.Request) (oidcLoginState, error) {
+	cookie, err := r.Cookie(oidcCookieName)
+	if err != nil {
+		return oidcLoginState{}, err
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return oidcLoginState{}, err
+	}
+	var login oidcLoginState
+	err = json.Unmarshal(data, &login)
+	if err != nil {
+		return oidcLoginState{}, err
+	}
+	if login.State == "" || login.Nonce == "" || login.Verifier == "" {
+		return oidcLoginState{}, errors.New("incomplete login state")
+	}
+	return login, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// testIdP is a stand-in OpenID provider. Every authorization code it's told
+// about is exchanged for an ID token with the given claims.
+type testIdP struct {
+	server *httptest.Server
+
+	mu    sync.Mutex
+	codes map[string]jwt.MapClaims
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	idp := &testIdP{codes: map[string]jwt.MapClaims{}}
+
+	mux := http.NewServeMux()
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, http.StatusOK, map[string]any{
+			"issuer":                                idp.server.URL,
+			"authorization_endpoint":                idp.server.URL + "/authorize",
+			"token_endpoint":                        idp.server.URL + "/token",
+			"jwks_uri":                              idp.server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, http.StatusOK, map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		claims, ok := idp.codes[r.FormValue("code")]
+		delete(idp.codes, r.FormValue("code"))
+		idp.mu.Unlock()
+		if !ok {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "test"
+		idToken, err := token.SignedString(key)
+		if err != nil {
+			respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+	return idp
+}
+
+// newOIDCTestAPI starts the API with single sign-on through idp.
+func newOIDCTestAPI(t *testing.T, idp *testIdP) *testAPI {
+	t.Helper()
+	return newTestAPI(t, func(cfg *apiConfig) {
+		oidc, err := newOIDCConfig(context.Background(), idp.server.URL, "tubely", "secret", cfg.appBaseURL+"/api/oidc/callback")
+		if err != nil {
+			t.Fatalf("newOIDCConfig: %v", err)
+		}
+		cfg.oidc = oidc
+	})
+}
+
+// signIn goes through the login flow as the provider account subject with
+// email, returning the callback's response.
+func (idp *testIdP) signIn(t *testing.T, api *testAPI, subject, email string, emailVerified bool) *http.Response {
+	t.Helper()
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(api.server.URL + "/api/oidc/login")
+	if err != nil {
+		t.Fatalf("starting login: %v", err)
+	}
+	resp.Body.Close()
+	authURL, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("login responded %d to %q, want a redirect to the provider", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	code := uuid.NewString()
+	idp.mu.Lock()
+	idp.codes[code] = jwt.MapClaims{
+		"iss":            idp.server.URL,
+		"sub":            subject,
+		"aud":            "tubely",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          authURL.Query().Get("nonce"),
+		"email":          email,
+		"email_verified": emailVerified,
+	}
+	idp.mu.Unlock()
+
+	callback := api.server.URL + "/api/oidc/callback?" + url.Values{
+		"code":  {code},
+		"state": {authURL.Query().Get("state")},
+	}.Encode()
+	req, err := http.NewRequest("GET", callback, nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	for _, cookie := range resp.Cookies() {
+		req.AddCookie(cookie)
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("callback: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// signedInUser returns who the tokens in a successful callback's redirect
+// belong to.
+func signedInUser(t *testing.T, api *testAPI, resp *http.Response) uuid.UUID {
+	t.Helper()
+	location := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusFound || !strings.HasPrefix(location, "/app/#") {
+		var body map[string]string
+		json.NewDecoder(resp.Body).Decode(&body)
+		t.Fatalf("callback responded %d %v, want a redirect into the app", resp.StatusCode, body)
+	}
+	fragment, err := url.ParseQuery(strings.TrimPrefix(location, "/app/#"))
+	if err != nil {
+		t.Fatalf("parsing %q: %v", location, err)
+	}
+	expect(t, api.do(t, "POST", "/api/refresh", fragment.Get("refresh_token"), nil), http.StatusOK, nil)
+	userID, err := auth.ValidateJWT(fragment.Get("token"), api.cfg.jwtSecret)
+	if err != nil {
+		t.Fatalf("access token: %v", err)
+	}
+	return userID
+}
+
+func TestOIDCProvisionsNewUsers(t *testing.T) {
+	idp := newTestIdP(t)
+	api := newOIDCTestAPI(t, idp)
+
+	userID := signedInUser(t, api, idp.signIn(t, api, "alice", "alice@example.com", true))
+	user, err := api.cfg.db.GetUser(userID)
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if user == nil || user.Email != "alice@example.com" || user.EmailVerifiedAt == nil {
+		t.Errorf("provisioned user = %+v, want alice with a verified email", user)
+	}
+
+	// Later sign-ins go by the linked subject, even if the email changed.
+	again := signedInUser(t, api, idp.signIn(t, api, "alice", "alice@example.org", true))
+	if again != userID {
+		t.Errorf("second sign-in was user %v, want %v", again, userID)
+	}
+
+	resp := idp.signIn(t, api, "bob", "bob@example.com", false)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("sign-in with an unverified provider email responded %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestOIDCLinksOnlyVerifiedAccounts(t *testing.T) {
+	idp := newTestIdP(t)
+	api := newOIDCTestAPI(t, idp)
+
+	// Someone signs up with the address before its owner ever uses SSO.
+	account, _ := api.signUp(t, "Victim@Example.com", "password")
+	resp := idp.signIn(t, api, "victim", "victim@example.com", true)
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("sign-in onto an unverified account responded %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+	identity, err := api.cfg.db.GetUserIdentity(idp.server.URL, "victim")
+	if err != nil {
+		t.Fatalf("GetUserIdentity: %v", err)
+	}
+	if identity.UserID != uuid.Nil {
+		t.Error("the identity was linked to an unverified account")
+	}
+	user, err := api.cfg.db.GetUser(account.ID)
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if user.EmailVerifiedAt != nil {
+		t.Error("the unverified account's email was marked verified")
+	}
+
+	// Once the account proves it owns the address, it gets linked.
+	err = api.cfg.db.MarkEmailVerified(account.ID)
+	if err != nil {
+		t.Fatalf("MarkEmailVerified: %v", err)
+	}
+	userID := signedInUser(t, api, idp.signIn(t, api, "victim", "victim@example.com", true))
+	if userID != account.ID {
+		t.Errorf("sign-in was user %v, want the verified account %v", userID, account.ID)
+	}
+}
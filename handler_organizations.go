@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const orgInvitationExpiry = 7 * 24 * time.Hour
+
+var orgRoleRanks = map[string]int{
+	database.OrgRoleViewer: 1,
+	database.OrgRoleEditor: 2,
+	database.OrgRoleAdmin:  3,
+}
+
+// hasOrgRole reports whether the user is a member of the organization with
+// at least role.
+func (cfg *apiConfig) hasOrgRole(orgID, userID uuid.UUID, role string) (bool, error) {
+	member, err := cfg.db.GetOrgMember(orgID, userID)
+	if err != nil {
+		return false, err
+	}
+	return member.Role != "" && orgRoleRanks[member.Role] >= orgRoleRanks[role], nil
+}
+
+// getOrgForRole loads the organization in the path and checks the caller
+// has at least role in it, writing the error response itself when they
+// don't.
+func (cfg *apiConfig) getOrgForRole(w http.ResponseWriter, r *http.Request, role string) (database.Organization, uuid.UUID, bool) {
+	orgID, err := uuid.Parse(r.PathValue("orgID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid org ID", err)
+		return database.Organization{}, uuid.Nil, false
+	}
+
+	userID := requestUserID(r)
+
+	member, err := cfg.db.GetOrgMember(orgID, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check membership", err)
+		return database.Organization{}, uuid.Nil, false
+	}
+	// Non-members can't tell whether the organization exists.
+	if member.Role == "" {
+		respondWithError(w, http.StatusNotFound, "Organization not found", nil)
+		return database.Organization{}, uuid.Nil, false
+	}
+	if orgRoleRanks[member.Role] < orgRoleRanks[role] {
+		respondWithError(w, http.StatusForbidden, "Your role doesn't allow this", nil)
+		return database.Organization{}, uuid.Nil, false
+	}
+
+	org, err := cfg.db.GetOrganization(orgID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get organization", err)
+		return database.Organization{}, uuid.Nil, false
+	}
+	org.Role = member.Role
+	return org, userID, true
+}
+
+func (cfg *apiConfig) handlerOrgsCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name string `json:"name"`
+	}
+
+	userID := requestUserID(r)
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" {
+		respondWithError(w, http.StatusBadRequest, "name is required", nil)
+		return
+	}
+
+	org, err := cfg.db.CreateOrganization(params.Name, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create organization", err)
+		return
+	}
+	org.Role = database.OrgRoleAdmin
+
+	respondWithJSON(w, http.StatusCreated, org)
+}
+
+func (cfg *apiConfig) handlerOrgsList(w http.ResponseWriter, r *http.Request) {
+	userID := requestUserID(r)
+
+	orgs, err := cfg.db.GetUserOrganizations(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve organizations", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, orgs)
+}
+
+func (cfg *apiConfig) handlerOrgMembersList(w http.ResponseWriter, r *http.Request) {
+	org, _, ok := cfg.getOrgForRole(w, r, database.OrgRoleViewer)
+	if !ok {
+		return
+	}
+
+	members, err := cfg.db.GetOrgMembers(org.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve members", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, members)
+}
+
+func (cfg *apiConfig) handlerOrgMembersUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Role string `json:"role"`
+	}
+
+	org, _, ok := cfg.getOrgForRole(w, r, database.OrgRoleAdmin)
+	if !ok {
+		return
+	}
+
+	memberID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID", err)
+		return
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if !database.ValidOrgRole(params.Role) {
+		respondWithError(w, http.StatusBadRequest, "role must be admin, editor or viewer", nil)
+		return
+	}
+
+	member, err := cfg.db.GetOrgMember(org.ID, memberID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get member", err)
+		return
+	}
+	if member.Role == "" {
+		respondWithError(w, http.StatusNotFound, "Member not found", nil)
+		return
+	}
+	if member.Role == database.OrgRoleAdmin && params.Role != database.OrgRoleAdmin {
+		if !cfg.keepsAnAdmin(w, org.ID) {
+			return
+		}
+	}
+
+	member, err = cfg.db.UpsertOrgMember(org.ID, memberID, params.Role)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update member", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, member)
+}
+
+// handlerOrgMembersDelete removes a member. Admins can remove anyone and
+// every member can remove themselves.
+func (cfg *apiConfig) handlerOrgMembersDelete(w http.ResponseWriter, r *http.Request) {
+	org, userID, ok := cfg.getOrgForRole(w, r, database.OrgRoleViewer)
+	if !ok {
+		return
+	}
+
+	memberID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID", err)
+		return
+	}
+	if memberID != userID && org.Role != database.OrgRoleAdmin {
+		respondWithError(w, http.StatusForbidden, "Only admins can remove other members", nil)
+		return
+	}
+
+	member, err := cfg.db.GetOrgMember(org.ID, memberID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get member", err)
+		return
+	}
+	if member.Role == "" {
+		respondWithError(w, http.StatusNotFound, "Member not found", nil)
+		return
+	}
+	if member.Role == database.OrgRoleAdmin {
+		if !cfg.keepsAnAdmin(w, org.ID) {
+			return
+		}
+	}
+
+	err = cfg.db.DeleteOrgMember(org.ID, memberID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't remove member", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// keepsAnAdmin checks an admin can be demoted or removed without leaving
+// the organization with nobody to manage it.
+func (cfg *apiConfig) keepsAnAdmin(w http.ResponseWriter, orgID uuid.UUID) bool {
+	admins, err := cfg.db.CountOrgAdmins(orgID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't count admins", err)
+		return false
+	}
+	if admins <= 1 {
+		respondWithError(w, http.StatusConflict, "An organization needs at least one admin", nil)
+		return false
+	}
+	return true
+}
+
+func (cfg *apiConfig) handlerOrgInvitationsCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+
+	org, userID, ok := cfg.getOrgForRole(w, r, database.OrgRoleAdmin)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	params.Email = strings.TrimSpace(params.Email)
+	if params.Email == "" {
+		respondWithError(w, http.StatusBadRequest, "email is required", nil)
+		return
+	}
+	if !database.ValidOrgRole(params.Role) {
+		respondWithError(w, http.StatusBadRequest, "role must be admin, editor or viewer", nil)
+		return
+	}
+
+	invitation, err := cfg.db.CreateOrgInvitation(database.CreateOrgInvitationParams{
+		OrgID:     org.ID,
+		Email:     params.Email,
+		Role:      params.Role,
+		InvitedBy: userID,
+	}, time.Now().UTC().Add(orgInvitationExpiry))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create invitation", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, invitation)
+}
+
+func (cfg *apiConfig) handlerOrgInvitationsList(w http.ResponseWriter, r *http.Request) {
+	org, _, ok := cfg.getOrgForRole(w, r, database.OrgRoleAdmin)
+	if !ok {
+		return
+	}
+
+	invitations, err := cfg.db.GetPendingOrgInvitations(org.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve invitations", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, invitations)
+}
+
+func (cfg *apiConfig) handlerOrgInvitationsDelete(w http.ResponseWriter, r *http.Request) {
+	org, _, ok := cfg.getOrgForRole(w, r, database.OrgRoleAdmin)
+	if !ok {
+		return
+	}
+
+	invitationID, err := uuid.Parse(r.PathValue("invitationID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid invitation ID", err)
+		return
+	}
+	invitation, err := cfg.db.GetOrgInvitation(invitationID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get invitation", err)
+		return
+	}
+	if invitation.ID == uuid.Nil || invitation.OrgID != org.ID {
+		respondWithError(w, http.StatusNotFound, "Invitation not found", nil)
+		return
+	}
+
+	err = cfg.db.DeleteOrgInvitation(invitation.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete invitation", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerInvitationsList returns the pending invitations sent to the
+// caller's email address, once they've shown it's theirs.
+func (cfg *apiConfig) handlerInvitationsList(w http.ResponseWriter, r *http.Request) {
+	user, ok := cfg.getVerifiedUser(w, r)
+	if !ok {
+		return
+	}
+
+	invitations, err := cfg.db.GetPendingInvitationsForEmail(user.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve invitations", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, invitations)
+}
+
+// handlerInvitationsAccept joins the caller to the inviting organization.
+// Only the user the invitation was sent to can accept it, after verifying
+// their email.
+func (cfg *apiConfig) handlerInvitationsAccept(w http.ResponseWriter, r *http.Request) {
+	invitationID, err := uuid.Parse(r.PathValue("invitationID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid invitation ID", err)
+		return
+	}
+
+	user, ok := cfg.getVerifiedUser(w, r)
+	if !ok {
+		return
+	}
+
+	invitation, err := cfg.db.GetOrgInvitation(invitationID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get invitation", err)
+		return
+	}
+	if invitation.ID == uuid.Nil || !strings.EqualFold(invitation.Email, user.Email) {
+		respondWithError(w, http.StatusNotFound, "Invitation not found", nil)
+		return
+	}
+	if invitation.AcceptedAt != nil {
+		respondWithError(w, http.StatusConflict, "Invitation has already been accepted", nil)
+		return
+	}
+	if time.Now().After(invitation.ExpiresAt) {
+		respondWithError(w, http.StatusGone, "Invitation has expired", nil)
+		return
+	}
+
+	member, err := cfg.db.AcceptOrgInvitation(invitation, user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't accept invitation", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, member)
+}
+
+func (cfg *apiConfig) getCurrentUser(w http.ResponseWriter, r *http.Request) (database.User, bool) {
+	userID := requestUserID(r)
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return database.User{}, false
+	}
+	if user == nil {
+		respondWithError(w, http.StatusUnauthorized, "User no longer exists", nil)
+		return database.User{}, false
+	}
+	return *user, true
+}
+
+// getVerifiedUser is getCurrentUser for endpoints that trust the user's
+// email address, which anyone could have signed up with until it's verified.
+func (cfg *apiConfig) getVerifiedUser(w http.ResponseWriter, r *http.Request) (database.User, bool) {
+	user, ok := cfg.getCurrentUser(w, r)
+	if !ok {
+		return database.User{}, false
+	}
+	if user.EmailVerifiedAt == nil {
+		respondWithError(w, http.StatusForbidden, "Verify your email address first", nil)
+		return database.User{}, false
+	}
+	return user, true
+}
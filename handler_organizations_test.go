@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestInvitationsNeedVerifiedEmail(t *testing.T) {
+	api := newTestAPI(t)
+	_, admin := api.signUp(t, "admin@example.com", "password")
+	var org database.Organization
+	expect(t, api.do(t, "POST", "/api/orgs", admin.Token, map[string]string{"name": "Acme"}), http.StatusCreated, &org)
+	var invitation database.OrgInvitation
+	expect(t, api.do(t, "POST", "/api/orgs/"+org.ID.String()+"/invitations", admin.Token, map[string]string{
+		"email": "invitee@example.com",
+		"role":  database.OrgRoleEditor,
+	}), http.StatusCreated, &invitation)
+
+	// Anyone could sign up with the invited address.
+	_, invitee := api.signUp(t, "invitee@example.com", "password")
+	expect(t, api.do(t, "GET", "/api/invitations", invitee.Token, nil), http.StatusForbidden, nil)
+	expect(t, api.do(t, "POST", "/api/invitations/"+invitation.ID.String()+"/accept", invitee.Token, nil), http.StatusForbidden, nil)
+
+	msg := api.mail.waitFor(t, "invitee@example.com", "Verify")
+	token := mailedToken(t, msg, database.TokenPurposeVerifyEmail)
+	expect(t, api.do(t, "POST", "/api/email_verifications/confirm", "", map[string]string{"token": token}), http.StatusNoContent, nil)
+	// The link only works once.
+	expect(t, api.do(t, "POST", "/api/email_verifications/confirm", "", map[string]string{"token": token}), http.StatusBadRequest, nil)
+
+	var invitations []database.OrgInvitation
+	expect(t, api.do(t, "GET", "/api/invitations", invitee.Token, nil), http.StatusOK, &invitations)
+	if len(invitations) != 1 || invitations[0].ID != invitation.ID {
+		t.Fatalf("invitations = %+v, want the one sent", invitations)
+	}
+	var member database.OrgMember
+	expect(t, api.do(t, "POST", "/api/invitations/"+invitation.ID.String()+"/accept", invitee.Token, nil), http.StatusOK, &member)
+	if member.OrgID != org.ID || member.Role != database.OrgRoleEditor {
+		t.Errorf("member = %+v, want an editor of %v", member, org.ID)
+	}
+}
@@ -1,15 +1,43 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
 )
 
+const (
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 60 * 24 * time.Hour
+)
+
+// newRefreshToken creates a new refresh token in family, valid for
+// refreshTokenTTL from now. It returns the token for the client along with
+// the params to store, which only hold its hash.
+func (cfg *apiConfig) newRefreshToken(userID, familyID uuid.UUID) (string, database.CreateRefreshTokenParams, error) {
+	token, err := auth.MakeRefreshToken()
+	if err != nil {
+		return "", database.CreateRefreshTokenParams{}, err
+	}
+	return token, database.CreateRefreshTokenParams{
+		TokenHash: auth.HashToken(token),
+		FamilyID:  familyID,
+		UserID:    userID,
+		ExpiresAt: time.Now().UTC().Add(cfg.refreshTokenTTL),
+	}, nil
+}
+
+// handlerRefresh exchanges a refresh token for a new access token and a new
+// refresh token. Each refresh token works once; reusing one revokes every
+// token descended from the same login.
 func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 	type response struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}
 
 	refreshToken, err := auth.GetBearerToken(r.Header)
@@ -18,24 +46,58 @@ func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := cfg.db.GetUserByRefreshToken(refreshToken)
+	current, err := cfg.db.GetRefreshToken(auth.HashToken(refreshToken))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get refresh token", err)
+		return
+	}
+	if current.TokenHash == "" || current.RevokedAt != nil || !time.Now().Before(current.ExpiresAt) {
+		respondWithError(w, http.StatusUnauthorized, "Refresh token is invalid or expired", nil)
+		return
+	}
+
+	nextToken, next, err := cfg.newRefreshToken(current.UserID, current.FamilyID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token", err)
+		return
+	}
+	rotated := false
+	if current.RotatedAt == nil {
+		rotated, err = cfg.db.RotateRefreshToken(current.TokenHash, next)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't rotate refresh token", err)
+			return
+		}
+	}
+	if !rotated {
+		err = cfg.db.RevokeRefreshTokenFamily(current.FamilyID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't revoke session", err)
+			return
+		}
+		respondWithError(w, http.StatusUnauthorized, "Refresh token was already used", errors.New("refresh token reuse detected, session revoked"))
+		return
+	}
+
+	err = cfg.db.TouchSession(current.FamilyID, r.UserAgent(), clientIP(r))
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't get user for refresh token", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update session", err)
 		return
 	}
 
 	accessToken, err := auth.MakeJWT(
-		user.ID,
+		current.UserID,
 		cfg.jwtSecret,
-		time.Hour,
+		cfg.accessTokenTTL,
 	)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate token", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create access JWT", err)
 		return
 	}
 
 	respondWithJSON(w, http.StatusOK, response{
-		Token: accessToken,
+		Token:        accessToken,
+		RefreshToken: nextToken,
 	})
 }
 
@@ -46,7 +108,7 @@ func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = cfg.db.RevokeRefreshToken(refreshToken)
+	err = cfg.db.RevokeRefreshToken(auth.HashToken(refreshToken))
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke session", err)
 		return
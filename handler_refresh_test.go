@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+func TestRefreshTokenRotation(t *testing.T) {
+	api := newTestAPI(t)
+	_, first := api.signUp(t, "user@example.com", "password")
+
+	// Only a hash of the token is stored.
+	stored, err := api.cfg.db.GetRefreshToken(first.RefreshToken)
+	if err != nil || stored.TokenHash != "" {
+		t.Errorf("GetRefreshToken(raw token) = %+v, %v; want nothing stored under it", stored, err)
+	}
+	stored, err = api.cfg.db.GetRefreshToken(auth.HashToken(first.RefreshToken))
+	if err != nil || stored.TokenHash == "" {
+		t.Fatalf("GetRefreshToken(hash) = %+v, %v; want the token", stored, err)
+	}
+
+	var second, third testTokens
+	expect(t, api.do(t, "POST", "/api/refresh", first.RefreshToken, nil), http.StatusOK, &second)
+	if second.RefreshToken == first.RefreshToken || second.Token == "" {
+		t.Errorf("refresh returned %+v, want a new pair", second)
+	}
+	expect(t, api.do(t, "POST", "/api/refresh", second.RefreshToken, nil), http.StatusOK, &third)
+
+	// Replaying a used token revokes every token from that login.
+	expect(t, api.do(t, "POST", "/api/refresh", first.RefreshToken, nil), http.StatusUnauthorized, nil)
+	expect(t, api.do(t, "POST", "/api/refresh", third.RefreshToken, nil), http.StatusUnauthorized, nil)
+}
+
+func TestRevokeRefreshToken(t *testing.T) {
+	api := newTestAPI(t)
+	_, tokens := api.signUp(t, "user@example.com", "password")
+	var next testTokens
+	expect(t, api.do(t, "POST", "/api/refresh", tokens.RefreshToken, nil), http.StatusOK, &next)
+
+	expect(t, api.do(t, "POST", "/api/revoke", next.RefreshToken, nil), http.StatusNoContent, nil)
+	expect(t, api.do(t, "POST", "/api/refresh", next.RefreshToken, nil), http.StatusUnauthorized, nil)
+
+	// Other logins are unaffected.
+	var other testTokens
+	expect(t, api.do(t, "POST", "/api/login", "", map[string]string{"email": "user@example.com", "password": "password"}), http.StatusOK, &other)
+	expect(t, api.do(t, "POST", "/api/refresh", other.RefreshToken, nil), http.StatusOK, nil)
+}
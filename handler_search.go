@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 100
+)
+
+func (cfg *apiConfig) handlerSearch(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		respondWithError(w, http.StatusBadRequest, "q is required", nil)
+		return
+	}
+
+	limit := defaultSearchPageSize
+	if limitString := r.URL.Query().Get("limit"); limitString != "" {
+		var err error
+		limit, err = strconv.Atoi(limitString)
+		if err != nil || limit < 1 || limit > maxSearchPageSize {
+			respondWithError(w, http.StatusBadRequest, "limit must be between 1 and 100", err)
+			return
+		}
+	}
+	offset := 0
+	if offsetString := r.URL.Query().Get("offset"); offsetString != "" {
+		var err error
+		offset, err = strconv.Atoi(offsetString)
+		if err != nil || offset < 0 {
+			respondWithError(w, http.StatusBadRequest, "offset must be a non-negative integer", err)
+			return
+		}
+	}
+
+	// Anonymous callers only search public videos.
+	userID := requestUserID(r)
+
+	results, err := cfg.db.SearchVideos(query, userID, limit, offset)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't search videos", err)
+		return
+	}
+
+	for i := range results {
+		if results[i].Video.VideoURL == nil {
+			continue
+		}
+		results[i].Video, err = cfg.dbVideoToSignedVideo(results[i].Video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error generating signed video URL", err)
+			return
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, results)
+}
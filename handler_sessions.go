@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// A session is one login, kept alive by rotating its refresh token.
+// Revoking a session stops it from being refreshed; access tokens already
+// issued to it stay valid until they expire (ACCESS_TOKEN_TTL).
+
+// clientIP returns the address the request came from. Forwarding headers
+// aren't trusted since clients can set them to anything.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (cfg *apiConfig) handlerSessionsList(w http.ResponseWriter, r *http.Request) {
+	userID := requestUserID(r)
+
+	sessions, err := cfg.db.GetActiveSessions(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve sessions", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, sessions)
+}
+
+func (cfg *apiConfig) handlerSessionsDelete(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := uuid.Parse(r.PathValue("sessionID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	userID := requestUserID(r)
+
+	session, err := cfg.db.GetSession(sessionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get session", err)
+		return
+	}
+	if session.ID == uuid.Nil || session.UserID != userID {
+		respondWithError(w, http.StatusNotFound, "Session not found", nil)
+		return
+	}
+
+	err = cfg.db.RevokeRefreshTokenFamily(session.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke session", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerSessionsDeleteAll logs the user out everywhere, including the
+// session making the request.
+func (cfg *apiConfig) handlerSessionsDeleteAll(w http.ResponseWriter, r *http.Request) {
+	userID := requestUserID(r)
+
+	err := cfg.db.RevokeUserRefreshTokens(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
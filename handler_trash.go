@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Deleting a video moves it to the trash, where its owners can restore it
+// until it is purged after the retention period. Trashed videos are hidden
+// from every other endpoint.
+
+func (cfg *apiConfig) handlerTrashList(w http.ResponseWriter, r *http.Request) {
+	userID := requestUserID(r)
+
+	videos, err := cfg.db.GetTrashedVideos(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve trash", err)
+		return
+	}
+	for i := range videos {
+		if videos[i].VideoURL == nil {
+			continue
+		}
+		videos[i], err = cfg.dbVideoToSignedVideo(videos[i])
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error generating signed video URL", err)
+			return
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, videos)
+}
+
+// getTrashedVideoForOwner loads a trashed video and checks the caller is
+// one of its owners, writing the error response itself when they aren't.
+func (cfg *apiConfig) getTrashedVideoForOwner(w http.ResponseWriter, r *http.Request) (database.Video, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.Video{}, false
+	}
+
+	userID := requestUserID(r)
+
+	video, err := cfg.db.GetTrashedVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving video", err)
+		return database.Video{}, false
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video isn't in the trash", nil)
+		return database.Video{}, false
+	}
+	allowed, err := cfg.hasVideoRole(video, userID, database.RoleOwner)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check permissions", err)
+		return database.Video{}, false
+	}
+	if !allowed {
+		respondWithError(w, http.StatusNotFound, "Video isn't in the trash", nil)
+		return database.Video{}, false
+	}
+	return video, true
+}
+
+func (cfg *apiConfig) handlerVideoRestore(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getTrashedVideoForOwner(w, r)
+	if !ok {
+		return
+	}
+
+	err := cfg.db.RestoreVideo(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't restore video", err)
+		return
+	}
+
+	video, err = cfg.db.GetVideo(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	video, _ = cfg.dbVideoToSignedVideo(video)
+
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+// handlerTrashDelete purges a video from the trash right away instead of
+// waiting for the retention period.
+func (cfg *apiConfig) handlerTrashDelete(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getTrashedVideoForOwner(w, r)
+	if !ok {
+		return
+	}
+
+	err := cfg.purgeVideo(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	maxUploadChunkSize = 64 << 20
+	// uploadSessionTTL is how long a session can go without receiving a
+	// chunk before it expires and its partial file is deleted.
+	uploadSessionTTL = 24 * time.Hour
+)
+
+type byteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+type uploadSessionResponse struct {
+	database.UploadSession
+	ReceivedRanges []byteRange `json:"received_ranges"`
+	ReceivedBytes  int64       `json:"received_bytes"`
+	ExpiresAt      time.Time   `json:"expires_at"`
+}
+
+func (cfg *apiConfig) uploadSessionPartPath(sessionID uuid.UUID) string {
+	return filepath.Join(cfg.uploadsRoot, sessionID.String()+".part")
+}
+
+func (cfg *apiConfig) handlerUploadSessionCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		TotalSize   int64  `json:"total_size"`
+		ContentType string `json:"content_type"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	userID := requestUserID(r)
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.ContentType != "video/mp4" {
+		respondWithError(w, http.StatusBadRequest, "Video must be mp4 filetype", nil)
+		return
+	}
+	if params.TotalSize <= 0 || params.TotalSize > maxVideoUploadSize {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("total_size must be between 1 and %d bytes", maxVideoUploadSize), nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	allowed, err := cfg.hasVideoRole(video, userID, database.RoleEditor)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check permissions", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusForbidden, "You can't upload to this video", nil)
+		return
+	}
+
+	session, err := cfg.db.CreateUploadSession(database.CreateUploadSessionParams{
+		VideoID:     videoID,
+		UserID:      userID,
+		TotalSize:   params.TotalSize,
+		ContentType: params.ContentType,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload session", err)
+		return
+	}
+
+	part, err := os.Create(cfg.uploadSessionPartPath(session.ID))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload file", err)
+		return
+	}
+	defer part.Close()
+	err = part.Truncate(session.TotalSize)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload file", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, uploadSessionResponse{
+		UploadSession:  session,
+		ReceivedRanges: []byteRange{},
+		ExpiresAt:      uploadSessionExpiry(session),
+	})
+}
+
+func (cfg *apiConfig) handlerUploadSessionChunk(w http.ResponseWriter, r *http.Request) {
+	session, ok := cfg.getOwnUploadSession(w, r)
+	if !ok {
+		return
+	}
+	if session.CompletedAt != nil {
+		respondWithError(w, http.StatusConflict, "Upload session is already complete", nil)
+		return
+	}
+	if time.Now().After(uploadSessionExpiry(session)) {
+		respondWithError(w, http.StatusGone, "Upload session has expired", nil)
+		return
+	}
+
+	chunkNumber, err := strconv.Atoi(r.PathValue("chunkNumber"))
+	if err != nil || chunkNumber < 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid chunk number", err)
+		return
+	}
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 || offset >= session.TotalSize {
+		respondWithError(w, http.StatusBadRequest, "Invalid chunk offset", err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadChunkSize)
+	defer r.Body.Close()
+
+	part, err := os.OpenFile(cfg.uploadSessionPartPath(session.ID), os.O_WRONLY, 0)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open upload file", err)
+		return
+	}
+	defer part.Close()
+
+	// Read one byte past the remaining size so an oversized chunk is detected
+	// instead of silently truncated.
+	remaining := session.TotalSize - offset
+	n, err := io.Copy(io.NewOffsetWriter(part, offset), io.LimitReader(r.Body, remaining+1))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Chunk is too large", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Error saving chunk", err)
+		return
+	}
+	if n > remaining {
+		respondWithError(w, http.StatusBadRequest, "Chunk extends past total_size", nil)
+		return
+	}
+	if n == 0 {
+		respondWithError(w, http.StatusBadRequest, "Chunk is empty", nil)
+		return
+	}
+
+	err = cfg.db.RecordUploadChunk(database.UploadChunk{
+		SessionID: session.ID,
+		Number:    chunkNumber,
+		Offset:    offset,
+		Size:      n,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record chunk", err)
+		return
+	}
+
+	cfg.respondWithUploadSession(w, session)
+}
+
+func (cfg *apiConfig) handlerUploadSessionGet(w http.ResponseWriter, r *http.Request) {
+	session, ok := cfg.getOwnUploadSession(w, r)
+	if !ok {
+		return
+	}
+	cfg.respondWithUploadSession(w, session)
+}
+
+func (cfg *apiConfig) handlerUploadSessionComplete(w http.ResponseWriter, r *http.Request) {
+	session, ok := cfg.getOwnUploadSession(w, r)
+	if !ok {
+		return
+	}
+	if session.CompletedAt != nil {
+		respondWithError(w, http.StatusConflict, "Upload session is already complete", nil)
+		return
+	}
+	if time.Now().After(uploadSessionExpiry(session)) {
+		respondWithError(w, http.StatusGone, "Upload session has expired", nil)
+		return
+	}
+
+	chunks, err := cfg.db.GetUploadChunks(session.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve chunks", err)
+		return
+	}
+	ranges := mergeChunkRanges(chunks)
+	if len(ranges) != 1 || ranges[0].Start != 0 || ranges[0].End != session.TotalSize {
+		respondWithError(w, http.StatusConflict, "Upload is missing chunks", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(session.VideoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving video", err)
+		return
+	}
+	allowed, err := cfg.hasVideoRole(video, requestUserID(r), database.RoleEditor)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check permissions", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusForbidden, "You can't upload to this video", nil)
+		return
+	}
+
+	partPath := cfg.uploadSessionPartPath(session.ID)
+	_, err = validateVideoFile(partPath)
+	if err != nil {
+		respondWithValidationError(w, "Error validating video", err)
+		return
+	}
+
+	sourceKey, err := cfg.stageUpload(r.Context(), partPath, session.ContentType)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error storing video for processing", err)
+		return
+	}
+	completed, err := cfg.db.CompleteUploadSession(session.ID, database.CreateProcessingJobParams{
+		VideoID:     video.ID,
+		SourceKey:   sourceKey,
+		ContentType: session.ContentType,
+	})
+	if err != nil {
+		cfg.store.Delete(r.Context(), sourceKey)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't complete upload session", err)
+		return
+	}
+	if !completed {
+		// Another request completed it first and queued its own copy.
+		cfg.store.Delete(r.Context(), sourceKey)
+		respondWithError(w, http.StatusConflict, "Upload session is already complete", nil)
+		return
+	}
+	cfg.wakeVideoWorkers()
+	os.Remove(partPath)
+
+	video, err = cfg.db.GetVideo(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving video", err)
+		return
+	}
+	video, _ = cfg.dbVideoToSignedVideo(video)
+	respondWithJSON(w, http.StatusAccepted, video)
+}
+
+// uploadSessionExpiry is when the session expires unless another chunk
+// arrives first.
+func uploadSessionExpiry(session database.UploadSession) time.Time {
+	return session.UpdatedAt.Add(uploadSessionTTL)
+}
+
+// getOwnUploadSession loads the session named in the path and checks that
+// it belongs to the caller, responding with an error if not.
+func (cfg *apiConfig) getOwnUploadSession(w http.ResponseWriter, r *http.Request) (database.UploadSession, bool) {
+	sessionID, err := uuid.Parse(r.PathValue("sessionID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid session ID", err)
+		return database.UploadSession{}, false
+	}
+
+	userID := requestUserID(r)
+
+	session, err := cfg.db.GetUploadSession(sessionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload session", err)
+		return database.UploadSession{}, false
+	}
+	if session.ID == uuid.Nil || session.UserID != userID {
+		respondWithError(w, http.StatusNotFound, "Upload session not found", nil)
+		return database.UploadSession{}, false
+	}
+	return session, true
+}
+
+func (cfg *apiConfig) respondWithUploadSession(w http.ResponseWriter, session database.UploadSession) {
+	chunks, err := cfg.db.GetUploadChunks(session.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve chunks", err)
+		return
+	}
+
+	ranges := mergeChunkRanges(chunks)
+	var received int64
+	for _, rng := range ranges {
+		received += rng.End - rng.Start
+	}
+
+	respondWithJSON(w, http.StatusOK, uploadSessionResponse{
+		UploadSession:  session,
+		ReceivedRanges: ranges,
+		ReceivedBytes:  received,
+		ExpiresAt:      uploadSessionExpiry(session),
+	})
+}
+
+// mergeChunkRanges collapses chunks sorted by offset into the list of
+// contiguous byte ranges received so far. End is exclusive.
+func mergeChunkRanges(chunks []database.UploadChunk) []byteRange {
+	ranges := []byteRange{}
+	for _, chunk := range chunks {
+		start, end := chunk.Offset, chunk.Offset+chunk.Size
+		if len(ranges) > 0 && start <= ranges[len(ranges)-1].End {
+			if end > ranges[len(ranges)-1].End {
+				ranges[len(ranges)-1].End = end
+			}
+			continue
+		}
+		ranges = append(ranges, byteRange{Start: start, End: end})
+	}
+	return ranges
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestUploadSessionComplete(t *testing.T) {
+	fakeFFprobe(t)
+	api := newTestAPI(t)
+	_, tokens := api.signUp(t, "owner@example.com", "password")
+	var video database.Video
+	expect(t, api.do(t, "POST", "/api/videos", tokens.Token, map[string]string{"title": "video"}), http.StatusCreated, &video)
+
+	var session uploadSessionResponse
+	expect(t, api.do(t, "POST", "/api/video_upload/"+video.ID.String()+"/sessions", tokens.Token, map[string]any{
+		"total_size":   len(testMP4),
+		"content_type": "video/mp4",
+	}), http.StatusCreated, &session)
+	if !session.ExpiresAt.After(time.Now()) {
+		t.Errorf("new session expires at %v", session.ExpiresAt)
+	}
+	req, err := http.NewRequest("PUT", api.server.URL+"/api/upload_sessions/"+session.ID.String()+"/chunks/0?offset=0", strings.NewReader(testMP4))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+tokens.Token)
+	resp, err := api.server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("uploading chunk: %v", err)
+	}
+	defer resp.Body.Close()
+	expect(t, resp, http.StatusOK, nil)
+
+	complete := "/api/upload_sessions/" + session.ID.String() + "/complete"
+	expect(t, api.do(t, "POST", complete, tokens.Token, nil), http.StatusAccepted, &video)
+	if video.ProcessingStatus != database.VideoStatusPending {
+		t.Errorf("completed video status = %q, want %q", video.ProcessingStatus, database.VideoStatusPending)
+	}
+	job := claimTestJob(t, api)
+	if job.VideoID != video.ID {
+		t.Errorf("queued job is for video %v, want %v", job.VideoID, video.ID)
+	}
+	if _, err := os.Stat(api.cfg.uploadSessionPartPath(session.ID)); !os.IsNotExist(err) {
+		t.Errorf("partial file still there after completing: %v", err)
+	}
+
+	expect(t, api.do(t, "POST", complete, tokens.Token, nil), http.StatusConflict, nil)
+	next, err := api.cfg.db.ClaimProcessingJob("test-worker")
+	if err != nil || next.ID != uuid.Nil {
+		t.Errorf("ClaimProcessingJob = %+v, %v; want no second job", next, err)
+	}
+}
+
+func TestPurgeExpiredUploadSessions(t *testing.T) {
+	api := newTestAPI(t)
+	_, tokens := api.signUp(t, "owner@example.com", "password")
+	var video database.Video
+	expect(t, api.do(t, "POST", "/api/videos", tokens.Token, map[string]string{"title": "video"}), http.StatusCreated, &video)
+	var session uploadSessionResponse
+	expect(t, api.do(t, "POST", "/api/video_upload/"+video.ID.String()+"/sessions", tokens.Token, map[string]any{
+		"total_size":   len(testMP4),
+		"content_type": "video/mp4",
+	}), http.StatusCreated, &session)
+
+	// A partial file whose session was deleted along with its video.
+	orphan := filepath.Join(api.cfg.uploadsRoot, uuid.NewString()+".part")
+	err := os.WriteFile(orphan, []byte(testMP4), 0o644)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	stale := time.Now().Add(-uploadSessionTTL - time.Hour)
+	err = os.Chtimes(orphan, stale, stale)
+	if err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	_, err = api.cfg.purgeExpiredUploadSessions()
+	if err != nil {
+		t.Fatalf("purgeExpiredUploadSessions: %v", err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("stale partial file still there: %v", err)
+	}
+	if _, err := os.Stat(api.cfg.uploadSessionPartPath(session.ID)); err != nil {
+		t.Errorf("the active session's partial file is gone: %v", err)
+	}
+	expect(t, api.do(t, "GET", "/api/upload_sessions/"+session.ID.String(), tokens.Token, nil), http.StatusOK, nil)
+}
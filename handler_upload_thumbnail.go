@@ -1,15 +1,10 @@
 package main
 
 import (
-	"errors"
-	"fmt"
 	"io"
-	"mime"
 	"net/http"
-	"os"
-	"strings"
 
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
@@ -21,21 +16,8 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
-		return
-	}
-
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
-		return
-	}
+	userID := requestUserID(r)
 
-	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
-
-	// TODO: implement the upload here
 	const maxMemory = 10 << 20
 	err = r.ParseMultipartForm(maxMemory)
 	if err != nil {
@@ -43,17 +25,27 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	tn, header, err := r.FormFile("thumbnail")
+	tn, _, err := r.FormFile("thumbnail")
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Unable to form thumbnail", err)
+		return
 	}
 	defer tn.Close()
 
-	mediaType, _, _ := mime.ParseMediaType(header.Header.Get("Content-Type"))
-	isJPEG := mediaType == "image/jpeg"
-	isPNG := mediaType == "image/png"
-	if !isJPEG && !isPNG {
-		respondWithError(w, http.StatusBadRequest, "Thumbnail must be jpeg or png filetype", errors.New("wrong tn filetype"))
+	tnData, err := io.ReadAll(io.LimitReader(tn, maxThumbnailSize+1))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Error reading thumbnail", err)
+		return
+	}
+	if len(tnData) > maxThumbnailSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Thumbnail is too large", nil)
+		return
+	}
+
+	// The part's Content-Type header is client controlled, so check the bytes.
+	_, err = validateThumbnail(tnData)
+	if err != nil {
+		respondWithValidationError(w, "Error validating thumbnail", err)
 		return
 	}
 
@@ -62,31 +54,29 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusInternalServerError, "Error retrieving video", err)
 		return
 	}
-
-	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "401 Unauthorized", errors.New("401 unauthorized"))
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
 		return
 	}
-
-	assetPath := getAssetPath(video.ID, mediaType)
-	assetDiskPath := cfg.getAssetDiskPath(assetPath)
-
-	var oldAssetPath string
-	if video.ThumbnailURL != nil {
-		oldPath := strings.Split(*(video.ThumbnailURL), "/")[4]
-		oldAssetPath = cfg.getAssetDiskPath(oldPath)
+	allowed, err := cfg.hasVideoRole(video, userID, database.RoleEditor)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check permissions", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusForbidden, "You can't change this video's thumbnail", nil)
+		return
 	}
 
-	dst, err := os.Create(assetDiskPath)
+	oldThumbnailURL, oldThumbnails := video.ThumbnailURL, video.Thumbnails
+
+	thumbnails, thumbnailURL, err := cfg.saveThumbnail(r.Context(), video.ID, tnData, thumbnailAspect(video.Metadata))
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error creating thumbnail file", err)
 		return
 	}
-
-	defer dst.Close()
-	io.Copy(dst, tn)
-	thumbnailURL := cfg.getAssetURL(assetPath)
 	video.ThumbnailURL = &thumbnailURL
+	video.Thumbnails = &thumbnails
 
 	err = cfg.db.UpdateVideo(video)
 	if err != nil {
@@ -94,13 +84,10 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	if _, err := os.Stat(oldAssetPath); err == nil {
-		err = os.Remove(oldAssetPath)
-		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, "Error removing old thumbnail", err)
-			return
-		}
-
+	err = cfg.removeThumbnails(r.Context(), oldThumbnailURL, oldThumbnails)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error removing old thumbnail", err)
+		return
 	}
 	respondWithJSON(w, http.StatusOK, video)
 }
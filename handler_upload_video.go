@@ -1,21 +1,16 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
-	"errors"
-	"fmt"
 	"io"
-	"log"
-	"mime"
 	"net/http"
 	"os"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
+const maxVideoUploadSize = 1 << 30
+
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -24,63 +19,44 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
-		return
-	}
-
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
-		return
-	}
-
-	fmt.Println("uploading video", videoID, "by user", userID)
+	userID := requestUserID(r)
 
-	const maxMemory = 1 << 30
-	r.Body = http.MaxBytesReader(w, r.Body, maxMemory) // 1GB
+	r.Body = http.MaxBytesReader(w, r.Body, maxVideoUploadSize) // 1GB
 	defer r.Body.Close()
 
-	err = r.ParseMultipartForm(maxMemory)
+	err = r.ParseMultipartForm(maxVideoUploadSize)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Error parsing video", err)
 		return
 	}
 
-	videoMultiPart, header, err := r.FormFile("video")
+	videoMultiPart, _, err := r.FormFile("video")
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Unable to form video", err)
+		return
 	}
 	defer videoMultiPart.Close()
 
-	mediaType, _, _ := mime.ParseMediaType(header.Header.Get("Content-Type"))
-	if mediaType != "video/mp4" {
-		respondWithError(w, http.StatusBadRequest, "Video must be mp4 filetype", errors.New("wrong tn filetype"))
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving video", err)
 		return
 	}
-
-	//video, err := cfg.db.GetVideo(videoID)
-	video, err := cfg.getVideoUrlHelper(cfg.db.GetVideo, videoID)
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	allowed, err := cfg.hasVideoRole(video, userID, database.RoleEditor)
 	if err != nil {
-		if err.Error() == "incorrect url format" {
-			fmt.Println(err.Error(), "...proceeding with upload")
-		} else {
-			respondWithError(w, http.StatusInternalServerError, "Error retrieving video", err)
-			return
-		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check permissions", err)
+		return
 	}
-
-	fmt.Println("VIDEO.USERID:", video.UserID)
-	fmt.Println("USERID:", userID)
-	fmt.Println("VIDEO.TITLE", video.Title)
-	fmt.Println("VIDEO.VIDEOURL", video.VideoURL)
-	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "401 Unauthorized", errors.New("401 unauthorized"))
+	if !allowed {
+		respondWithError(w, http.StatusForbidden, "You can't upload to this video", nil)
 		return
 	}
 
-	dstNonProcessed, err := os.CreateTemp("", "tubely-upload*.mp4")
+	dstNonProcessed, err := os.CreateTemp(cfg.uploadsRoot, "tubely-upload*.mp4")
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error creating temp file", err)
 		return
@@ -92,73 +68,33 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusInternalServerError, "Error saving video to disk", err)
 		return
 	}
-	dstNonProcessed.Seek(0, io.SeekStart)
+	dstNonProcessed.Close()
 
-	processedFilepath, err := processVideoForFasterStart(dstNonProcessed.Name())
+	// The part's Content-Type header is client controlled, so check the bytes.
+	_, err = validateVideoFile(dstNonProcessed.Name())
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error processing video", err)
+		respondWithValidationError(w, "Error validating video", err)
 		return
 	}
 
-	dst, err := os.Open(processedFilepath)
+	sourceKey, err := cfg.stageUpload(r.Context(), dstNonProcessed.Name(), "video/mp4")
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error opening processed video", err)
+		respondWithError(w, http.StatusInternalServerError, "Error storing video for processing", err)
 		return
 	}
-	defer os.Remove(dst.Name())
-	defer dst.Close()
-
-	dstPath := dst.Name()
-	aspectRatio, err := getVideoAspectRatio(dstPath)
+	err = cfg.enqueueVideoProcessing(video.ID, sourceKey, "video/mp4")
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error determining aspect ratio", err)
+		cfg.store.Delete(r.Context(), sourceKey)
+		respondWithError(w, http.StatusInternalServerError, "Error queueing video for processing", err)
 		return
 	}
 
-	var keyPrefix string
-	switch aspectRatio {
-	case "16:9":
-		keyPrefix = "landscape"
-
-	case "9:16":
-		keyPrefix = "portrait"
-
-	default:
-		keyPrefix = "other"
-	}
-
-	newIDdata := make([]byte, 32)
-	_, err = rand.Read(newIDdata)
+	video, err = cfg.db.GetVideo(video.ID)
 	if err != nil {
-		log.Printf("error generating asset path")
-		respondWithError(w, http.StatusInternalServerError, "Error generating bucket key", err)
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving video", err)
 		return
 	}
+	video, _ = cfg.dbVideoToSignedVideo(video)
 
-	bucketKey := keyPrefix + "/" + base64.URLEncoding.EncodeToString(newIDdata)
-	params := s3.PutObjectInput{
-		Bucket:      &cfg.s3Bucket,
-		Key:         &bucketKey,
-		Body:        dst,
-		ContentType: &mediaType,
-	}
-	log.Printf("Uploading video to S3: %s", bucketKey)
-	_, err = cfg.s3Client.PutObject(r.Context(), &params)
-	if err != nil {
-		log.Printf("Upload error: %v", err)
-		respondWithError(w, http.StatusInternalServerError, "Error uploading video", err)
-		return
-	}
-
-	//videoURL := "https://" + cfg.s3Bucket + ".s3." + cfg.s3Region + ".amazonaws.com/" + bucketKey
-	//video.VideoURL = &videoURL
-
-	videoURL := cfg.s3Bucket + "," + bucketKey
-	video.VideoURL = &videoURL
-
-	err = cfg.db.UpdateVideo(video)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error updating video", err)
-		return
-	}
+	respondWithJSON(w, http.StatusAccepted, video)
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerEmailVerificationRequest mails the caller a new verification link.
+func (cfg *apiConfig) handlerEmailVerificationRequest(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.db.GetUser(requestUserID(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user == nil {
+		respondWithError(w, http.StatusNotFound, "User not found", nil)
+		return
+	}
+	if user.EmailVerifiedAt != nil {
+		respondWithError(w, http.StatusConflict, "Email is already verified", nil)
+		return
+	}
+
+	err = cfg.sendUserToken(r.Context(), *user, database.TokenPurposeVerifyEmail)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't send verification email", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (cfg *apiConfig) handlerEmailVerificationConfirm(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	userID, ok := cfg.useUserToken(w, params.Token, database.TokenPurposeVerifyEmail)
+	if !ok {
+		return
+	}
+
+	err = cfg.db.MarkEmailVerified(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't verify email", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerPasswordResetRequest mails a reset link if the email belongs to a
+// user. It responds the same either way, so it can't be used to find out
+// who has an account.
+func (cfg *apiConfig) handlerPasswordResetRequest(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Email == "" {
+		respondWithError(w, http.StatusBadRequest, "email is required", nil)
+		return
+	}
+
+	user, err := cfg.db.GetUserByEmail(params.Email)
+	if err == nil && user.ID != uuid.Nil {
+		err = cfg.sendUserToken(r.Context(), user, database.TokenPurposeResetPassword)
+	}
+	if err != nil {
+		log.Printf("Couldn't send password reset email: %v", err)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handlerPasswordResetConfirm sets a new password, signs the user out of
+// every session and deletes their API keys, in case someone else had their
+// old password.
+func (cfg *apiConfig) handlerPasswordResetConfirm(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Password == "" {
+		respondWithError(w, http.StatusBadRequest, "password is required", nil)
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(params.Password)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't hash password", err)
+		return
+	}
+
+	userID, ok := cfg.useUserToken(w, params.Token, database.TokenPurposeResetPassword)
+	if !ok {
+		return
+	}
+
+	err = cfg.db.UpdateUserPassword(userID, hashedPassword)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update password", err)
+		return
+	}
+	// The reset link proved the user can read mail sent to their address.
+	err = cfg.db.MarkEmailVerified(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't verify email", err)
+		return
+	}
+	err = cfg.db.RevokeUserRefreshTokens(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions", err)
+		return
+	}
+	err = cfg.db.DeleteUserAPIKeys(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke API keys", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
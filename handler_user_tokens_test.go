@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestPasswordReset(t *testing.T) {
+	api := newTestAPI(t)
+	_, old := api.signUp(t, "user@example.com", "old password")
+	expect(t, api.do(t, "POST", "/api/api_keys", old.Token, map[string]any{"name": "ci", "scopes": []string{database.ScopeVideosRead}}), http.StatusCreated, nil)
+
+	// Unknown addresses get the same answer, and emails match in any case.
+	expect(t, api.do(t, "POST", "/api/password_resets", "", map[string]string{"email": "nobody@example.com"}), http.StatusAccepted, nil)
+	expect(t, api.do(t, "POST", "/api/password_resets", "", map[string]string{"email": "USER@example.com"}), http.StatusAccepted, nil)
+	msg := api.mail.waitFor(t, "user@example.com", "Reset")
+	token := mailedToken(t, msg, database.TokenPurposeResetPassword)
+
+	expect(t, api.do(t, "POST", "/api/password_resets/confirm", "", map[string]string{"token": token, "password": "new password"}), http.StatusNoContent, nil)
+	expect(t, api.do(t, "POST", "/api/password_resets/confirm", "", map[string]string{"token": token, "password": "another"}), http.StatusBadRequest, nil)
+
+	expect(t, api.do(t, "POST", "/api/login", "", map[string]string{"email": "user@example.com", "password": "old password"}), http.StatusUnauthorized, nil)
+	var tokens testTokens
+	expect(t, api.do(t, "POST", "/api/login", "", map[string]string{"email": "user@example.com", "password": "new password"}), http.StatusOK, &tokens)
+	expect(t, api.do(t, "POST", "/api/refresh", old.RefreshToken, nil), http.StatusUnauthorized, nil)
+	var keys []database.APIKey
+	expect(t, api.do(t, "GET", "/api/api_keys", tokens.Token, nil), http.StatusOK, &keys)
+	if len(keys) != 0 {
+		t.Errorf("%d API keys survived the reset, want none", len(keys))
+	}
+
+	// Following the reset link proved the address is theirs.
+	var invitations []database.OrgInvitation
+	expect(t, api.do(t, "GET", "/api/invitations", tokens.Token, nil), http.StatusOK, &invitations)
+}
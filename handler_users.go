@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
@@ -42,5 +43,10 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	err = cfg.sendUserToken(r.Context(), *user, database.TokenPurposeVerifyEmail)
+	if err != nil {
+		log.Printf("Couldn't send verification email to user %s: %v", user.ID, err)
+	}
+
 	respondWithJSON(w, http.StatusCreated, user)
 }
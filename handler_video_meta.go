@@ -2,9 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
@@ -14,25 +20,40 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		database.CreateVideoParams
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
-		return
-	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
-		return
-	}
+	userID := requestUserID(r)
 
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	err = decoder.Decode(&params)
+	err := decoder.Decode(&params)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
 		return
 	}
 	params.UserID = userID
+	params.Title = strings.TrimSpace(params.Title)
+	err = validateVideoFields(params.Title, params.Description)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	if params.Visibility == "" {
+		params.Visibility = database.VisibilityPrivate
+	}
+	if !database.ValidVisibility(params.Visibility) {
+		respondWithError(w, http.StatusBadRequest, "visibility must be private, unlisted or public", nil)
+		return
+	}
+	if params.OrgID != nil {
+		allowed, err := cfg.hasOrgRole(*params.OrgID, userID, database.OrgRoleEditor)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check permissions", err)
+			return
+		}
+		if !allowed {
+			respondWithError(w, http.StatusForbidden, "You can't add videos to this organization", nil)
+			return
+		}
+	}
 
 	video, err := cfg.db.CreateVideo(params.CreateVideoParams)
 	if err != nil {
@@ -51,28 +72,25 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
-		return
-	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
-		return
-	}
+	userID := requestUserID(r)
 
 	video, err := cfg.db.GetVideo(videoID)
-	if err != nil {
+	if err != nil || video.ID == uuid.Nil {
 		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
 		return
 	}
-	if video.UserID != userID {
-		respondWithError(w, http.StatusForbidden, "You can't delete this video", err)
+	allowed, err := cfg.hasVideoRole(video, userID, database.RoleOwner)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check permissions", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusForbidden, "You can't delete this video", nil)
 		return
 	}
 
-	err = cfg.db.DeleteVideo(videoID)
+	// Deleted videos go to the trash first; see handler_trash.go.
+	err = cfg.db.TrashVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
@@ -89,41 +107,256 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//video, err := cfg.db.GetVideo(videoID)
-	video, err := cfg.getVideoUrlHelper(cfg.db.GetVideo, videoID)
-	if err != nil {
+	userID := requestUserID(r)
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil || video.ID == uuid.Nil {
 		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
 		return
 	}
+	// Private videos look missing to anyone without access.
+	allowed, err := cfg.canViewVideo(video, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check permissions", err)
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	// Videos still processing have no URL to sign yet.
 	video, _ = cfg.dbVideoToSignedVideo(video)
 
+	w.Header().Set("ETag", videoETag(video))
 	respondWithJSON(w, http.StatusOK, video)
 }
 
-func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.GetBearerToken(r.Header)
+const (
+	maxVideoTitleLength       = 200
+	maxVideoDescriptionLength = 5000
+)
+
+func validateVideoFields(title, description string) error {
+	if title == "" {
+		return errors.New("title is required")
+	}
+	if utf8.RuneCountInString(title) > maxVideoTitleLength {
+		return fmt.Errorf("title must be at most %d characters", maxVideoTitleLength)
+	}
+	if utf8.RuneCountInString(description) > maxVideoDescriptionLength {
+		return fmt.Errorf("description must be at most %d characters", maxVideoDescriptionLength)
+	}
+	return nil
+}
+
+// videoETag identifies a version of a video by when it was last updated.
+func videoETag(video database.Video) string {
+	return `"` + strconv.FormatInt(video.UpdatedAt.UnixNano(), 36) + `"`
+}
+
+// etagMatches reports whether an If-Match header allows writing to the
+// version of the video identified by etag.
+func etagMatches(ifMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *apiConfig) handlerVideoMetaUpdate(w http.ResponseWriter, r *http.Request) {
+	// Omitted fields are left unchanged.
+	type parameters struct {
+		Title       *string `json:"title"`
+		Description *string `json:"description"`
+	}
+
+	video, _, ok := cfg.getVideoForRole(w, r, database.RoleEditor)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+
+	// Clients send back the ETag they read so they don't overwrite someone
+	// else's edit.
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" && !etagMatches(ifMatch, videoETag(video)) {
+		respondWithError(w, http.StatusPreconditionFailed, "Video was changed since you last fetched it", nil)
+		return
+	}
+
+	if params.Title != nil {
+		video.Title = strings.TrimSpace(*params.Title)
+	}
+	if params.Description != nil {
+		video.Description = *params.Description
+	}
+	err = validateVideoFields(video.Title, video.Description)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
 		return
 	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	updated, err := cfg.db.UpdateVideoIfUnmodified(video, video.UpdatedAt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	if !updated {
+		// Without If-Match the client didn't ask for a precondition, but the
+		// video still changed between reading and writing it.
+		status := http.StatusConflict
+		if ifMatch != "" {
+			status = http.StatusPreconditionFailed
+		}
+		respondWithError(w, status, "Video was changed since you last fetched it", nil)
+		return
+	}
+
+	video, err = cfg.db.GetVideo(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	video, _ = cfg.dbVideoToSignedVideo(video)
+
+	w.Header().Set("ETag", videoETag(video))
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+const (
+	defaultVideoPageSize = 50
+	maxVideoPageSize     = 100
+)
+
+func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
+	userID := requestUserID(r)
+
+	opts, err := parseVideoListOptions(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	opts.UserID = userID
+
+	// With org_id the caller sees that organization's library, otherwise
+	// their personal videos.
+	if opts.OrgID != nil {
+		allowed, err := cfg.hasOrgRole(*opts.OrgID, userID, database.OrgRoleViewer)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check permissions", err)
+			return
+		}
+		if !allowed {
+			respondWithError(w, http.StatusForbidden, "You aren't a member of this organization", nil)
+			return
+		}
+	}
+
+	videos, nextCursor, err := cfg.db.ListVideos(opts)
+	if errors.Is(err, database.ErrInvalidCursor) {
+		respondWithError(w, http.StatusBadRequest, "cursor doesn't match sort", err)
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
 
 	for i := range videos {
+		if videos[i].VideoURL == nil {
+			continue
+		}
 		videos[i], err = cfg.dbVideoToSignedVideo(videos[i])
 		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, "Error generatingn signed video URL", err)
+			respondWithError(w, http.StatusInternalServerError, "Error generating signed video URL", err)
+			return
 		}
 	}
 
+	// The body stays a plain array for existing clients; the next page is
+	// requested by passing this back as ?cursor=.
+	if nextCursor != "" {
+		w.Header().Set("X-Next-Cursor", nextCursor)
+	}
 	respondWithJSON(w, http.StatusOK, videos)
 }
+
+// parseVideoListOptions reads the GET /api/videos query parameters.
+func parseVideoListOptions(query url.Values) (database.VideoListOptions, error) {
+	opts := database.VideoListOptions{
+		Limit:       defaultVideoPageSize,
+		Sort:        database.DefaultVideoSort,
+		AspectRatio: query.Get("aspect_ratio"),
+		TitleSearch: query.Get("title"),
+	}
+
+	if orgIDString := query.Get("org_id"); orgIDString != "" {
+		orgID, err := uuid.Parse(orgIDString)
+		if err != nil {
+			return opts, errors.New("invalid org_id")
+		}
+		opts.OrgID = &orgID
+	}
+	if cursorString := query.Get("cursor"); cursorString != "" {
+		cursor, err := database.ParseVideoCursor(cursorString)
+		if err != nil {
+			return opts, err
+		}
+		opts.Cursor = &cursor
+	}
+	if limitString := query.Get("limit"); limitString != "" {
+		limit, err := strconv.Atoi(limitString)
+		if err != nil || limit < 1 || limit > maxVideoPageSize {
+			return opts, fmt.Errorf("limit must be between 1 and %d", maxVideoPageSize)
+		}
+		opts.Limit = limit
+	}
+	if sort := query.Get("sort"); sort != "" {
+		if !database.ValidVideoSort(sort) {
+			return opts, errors.New("sort must be created_at, updated_at or title, optionally prefixed with -")
+		}
+		opts.Sort = sort
+	}
+	switch opts.AspectRatio {
+	case "", "landscape", "portrait", "other":
+	default:
+		return opts, errors.New("aspect_ratio must be landscape, portrait or other")
+	}
+
+	for name, dst := range map[string]**bool{
+		"has_video":     &opts.HasVideo,
+		"has_thumbnail": &opts.HasThumbnail,
+	} {
+		if value := query.Get(name); value != "" {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s must be true or false", name)
+			}
+			*dst = &b
+		}
+	}
+	for name, dst := range map[string]**time.Time{
+		"created_after":  &opts.CreatedAfter,
+		"created_before": &opts.CreatedBefore,
+	} {
+		if value := query.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return opts, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+			}
+			*dst = &t
+		}
+	}
+
+	return opts, nil
+}
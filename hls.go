@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const hlsMasterPlaylist = "master.m3u8"
+
+type hlsRendition struct {
+	Name         string
+	Size         int // height for landscape sources, width for portrait
+	VideoBitrate string
+	AudioBitrate string
+	Bandwidth    int
+}
+
+var hlsLadder = []hlsRendition{
+	{Name: "1080p", Size: 1080, VideoBitrate: "5000k", AudioBitrate: "192k", Bandwidth: 5_400_000},
+	{Name: "720p", Size: 720, VideoBitrate: "2800k", AudioBitrate: "128k", Bandwidth: 3_100_000},
+	{Name: "480p", Size: 480, VideoBitrate: "1400k", AudioBitrate: "128k", Bandwidth: 1_600_000},
+}
+
+// hlsPrefixForVideoKey returns where a video's HLS files are stored. The
+// prefix can't be the video key itself because on the local backend that
+// key is already a file.
+func hlsPrefixForVideoKey(videoKey string) string {
+	return videoKey + "_hls"
+}
+
+// packageHLS transcodes the video at srcPath into the HLS ladder, uploads
+// the segments and playlists under the video's key prefix and returns the
+// key of the master playlist.
+func (cfg *apiConfig) packageHLS(ctx context.Context, srcPath, videoKey string, meta database.VideoMetadata) (string, error) {
+	width, height := displayDimensions(meta)
+	portrait := height > width
+	shortSide := min(width, height)
+
+	renditions := []hlsRendition{}
+	for _, rendition := range hlsLadder {
+		if rendition.Size <= shortSide {
+			renditions = append(renditions, rendition)
+		}
+	}
+	if len(renditions) == 0 {
+		// Smaller than the bottom of the ladder, so keep the source size.
+		lowest := hlsLadder[len(hlsLadder)-1]
+		lowest.Name = "source"
+		lowest.Size = shortSide &^ 1
+		renditions = append(renditions, lowest)
+	}
+
+	outDir, err := os.MkdirTemp("", "tubely-hls")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(outDir)
+
+	master := &strings.Builder{}
+	master.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, rendition := range renditions {
+		renditionDir := filepath.Join(outDir, rendition.Name)
+		err = os.Mkdir(renditionDir, 0755)
+		if err != nil {
+			return "", err
+		}
+
+		scale := fmt.Sprintf("scale=-2:%d", rendition.Size)
+		outWidth, outHeight := evenScale(width, height, rendition.Size), rendition.Size
+		if portrait {
+			scale = fmt.Sprintf("scale=%d:-2", rendition.Size)
+			outWidth, outHeight = rendition.Size, evenScale(height, width, rendition.Size)
+		}
+
+		ffmpeg := exec.CommandContext(ctx, "ffmpeg", "-y",
+			"-i", srcPath,
+			"-vf", scale,
+			"-c:v", "libx264", "-preset", "veryfast", "-b:v", rendition.VideoBitrate,
+			"-c:a", "aac", "-b:a", rendition.AudioBitrate,
+			"-hls_time", "6",
+			"-hls_playlist_type", "vod",
+			"-hls_segment_filename", filepath.Join(renditionDir, "segment_%04d.ts"),
+			filepath.Join(renditionDir, "index.m3u8"),
+		)
+		output, err := ffmpeg.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("ffmpeg %s rendition: %w: %s", rendition.Name, err, lastLine(output))
+		}
+
+		fmt.Fprintf(master, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d\n%s/index.m3u8\n",
+			rendition.Bandwidth, outWidth, outHeight, rendition.Name)
+	}
+
+	err = os.WriteFile(filepath.Join(outDir, hlsMasterPlaylist), []byte(master.String()), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	prefix := hlsPrefixForVideoKey(videoKey)
+	err = filepath.WalkDir(outDir, func(diskPath string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(outDir, diskPath)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(diskPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return cfg.store.Put(ctx, prefix+"/"+filepath.ToSlash(rel), f, hlsContentType(diskPath))
+	})
+	if err != nil {
+		return "", fmt.Errorf("couldn't upload HLS files: %w", err)
+	}
+
+	return prefix + "/" + hlsMasterPlaylist, nil
+}
+
+// evenScale scales other by target/side and rounds down to an even number,
+// matching ffmpeg's -2 scale behaviour.
+func evenScale(other, side, target int) int {
+	return (other * target / side) &^ 1
+}
+
+func hlsContentType(name string) string {
+	if strings.HasSuffix(name, ".m3u8") {
+		return "application/vnd.apple.mpegurl"
+	}
+	return "video/mp2t"
+}
+
+func lastLine(output []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	return lines[len(lines)-1]
+}
+
+// hlsPlaylistURL is the API URL players should load for a video's master
+// playlist.
+func hlsPlaylistURL(videoID uuid.UUID) string {
+	return fmt.Sprintf("/api/videos/%s/hls/%s", videoID, hlsMasterPlaylist)
+}
+
+// handlerVideoHLS serves a video's HLS playlists. Playlists reference other
+// playlists by relative path so they resolve back to this handler, while
+// segment URIs are rewritten to short-lived presigned storage URLs. Private
+// videos need the signature from the URL handed out by the video endpoints.
+func (cfg *apiConfig) handlerVideoHLS(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	playlist := path.Clean("/" + r.PathValue("playlist"))[1:]
+	if !strings.HasSuffix(playlist, ".m3u8") {
+		respondWithError(w, http.StatusNotFound, "Playlist not found", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil || video.HLSURL == nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.Visibility == database.VisibilityPrivate && !cfg.validHLSSignature(video.ID, r.URL.Query()) {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	prefix := path.Dir(*video.HLSURL)
+	playlistKey := prefix + "/" + playlist
+	body, _, err := cfg.store.Get(r.Context(), playlistKey)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Playlist not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read playlist", err)
+		return
+	}
+	defer body.Close()
+
+	rewritten, err := cfg.rewriteHLSPlaylist(r.Context(), body, path.Dir(playlistKey), r.URL.RawQuery)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign playlist", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(rewritten))
+}
+
+// rewriteHLSPlaylist signs segment URIs and carries the request's signature
+// query over to nested playlists, since relative URIs drop it.
+func (cfg *apiConfig) rewriteHLSPlaylist(ctx context.Context, body io.Reader, dirKey, rawQuery string) (string, error) {
+	const segmentURLExpiry = 3600 * time.Second
+
+	out := &strings.Builder{}
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			if strings.HasSuffix(line, ".m3u8") {
+				if rawQuery != "" {
+					line += "?" + rawQuery
+				}
+			} else {
+				signed, err := cfg.store.PresignGet(ctx, dirKey+"/"+line, segmentURLExpiry)
+				if err != nil {
+					return "", err
+				}
+				line = signed
+			}
+		}
+		out.WriteString(line)
+		out.WriteString("\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/chai2010/webp"
+	"github.com/google/uuid"
+	"golang.org/x/image/draw"
+)
+
+// thumbnailWidths are the sizes every thumbnail is encoded at. Sources
+// narrower than a size skip it rather than being upscaled.
+var thumbnailWidths = []int{320, 640, 1280}
+
+const (
+	// defaultThumbnailWidth is the variant used as thumbnail_url for clients
+	// that don't use srcsets.
+	defaultThumbnailWidth = 640
+	thumbnailJPEGQuality  = 82
+	thumbnailWebPQuality  = 75
+	// defaultThumbnailAspect is used until the video has been probed.
+	defaultThumbnailAspect = 16.0 / 9.0
+)
+
+var thumbnailEncoders = []struct {
+	mediaType string
+	encode    func(buf *bytes.Buffer, img image.Image) error
+}{
+	{"image/jpeg", func(buf *bytes.Buffer, img image.Image) error {
+		return jpeg.Encode(buf, img, &jpeg.Options{Quality: thumbnailJPEGQuality})
+	}},
+	{"image/webp", func(buf *bytes.Buffer, img image.Image) error {
+		return webp.Encode(buf, img, &webp.Options{Quality: thumbnailWebPQuality})
+	}},
+}
+
+// thumbnailAspect returns the width/height ratio thumbnails of a video are
+// cropped to.
+func thumbnailAspect(meta *database.VideoMetadata) float64 {
+	if meta == nil || meta.Width == 0 || meta.Height == 0 {
+		return defaultThumbnailAspect
+	}
+	width, height := displayDimensions(*meta)
+	return float64(width) / float64(height)
+}
+
+// saveThumbnail turns an uploaded or extracted image into the thumbnail
+// variants: it applies and drops EXIF orientation, centre crops to aspect,
+// and stores every size in every format. Re-encoding also leaves the rest
+// of the source's metadata behind. It returns the variants and the URL to
+// use as the video's thumbnail_url.
+func (cfg *apiConfig) saveThumbnail(ctx context.Context, videoID uuid.UUID, data []byte, aspect float64) (database.Thumbnails, string, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return database.Thumbnails{}, "", err
+	}
+	src = cropToAspect(applyOrientation(src, jpegOrientation(data)), aspect)
+	srcWidth, srcHeight := src.Bounds().Dx(), src.Bounds().Dy()
+
+	widths := []int{}
+	for _, width := range thumbnailWidths {
+		if width <= srcWidth {
+			widths = append(widths, width)
+		}
+	}
+	if len(widths) == 0 {
+		widths = append(widths, srcWidth)
+	}
+
+	thumbnails := database.Thumbnails{
+		Variants: []database.ThumbnailVariant{},
+		Srcsets:  map[string]string{},
+	}
+	defaultURL := ""
+	for _, width := range widths {
+		height := max(1, srcHeight*width/srcWidth)
+		resized := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(resized, resized.Bounds(), src, src.Bounds(), draw.Src, nil)
+
+		for _, encoder := range thumbnailEncoders {
+			buf := &bytes.Buffer{}
+			err = encoder.encode(buf, resized)
+			if err == nil {
+				var url string
+				url, err = cfg.saveAsset(ctx, videoID, buf, encoder.mediaType)
+				thumbnails.Variants = append(thumbnails.Variants, database.ThumbnailVariant{
+					URL:       url,
+					Width:     width,
+					Height:    height,
+					MediaType: encoder.mediaType,
+				})
+			}
+			if err != nil {
+				cfg.removeThumbnails(ctx, nil, &thumbnails)
+				return database.Thumbnails{}, "", fmt.Errorf("couldn't save %d wide %s thumbnail: %w", width, encoder.mediaType, err)
+			}
+			if encoder.mediaType == "image/jpeg" && (defaultURL == "" || width <= defaultThumbnailWidth) {
+				defaultURL = thumbnails.Variants[len(thumbnails.Variants)-1].URL
+			}
+		}
+	}
+
+	srcsets := map[string][]string{}
+	for _, variant := range thumbnails.Variants {
+		srcsets[variant.MediaType] = append(srcsets[variant.MediaType], fmt.Sprintf("%s %dw", variant.URL, variant.Width))
+	}
+	for mediaType, candidates := range srcsets {
+		thumbnails.Srcsets[mediaType] = strings.Join(candidates, ", ")
+	}
+	return thumbnails, defaultURL, nil
+}
+
+// removeThumbnails deletes a thumbnail and all of its variants.
+func (cfg *apiConfig) removeThumbnails(ctx context.Context, thumbnailURL *string, thumbnails *database.Thumbnails) error {
+	for _, url := range thumbnailAssetURLs(thumbnailURL, thumbnails) {
+		err := cfg.removeAsset(ctx, url)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// thumbnailAssetURLs lists a thumbnail and its variants, without duplicates.
+func thumbnailAssetURLs(thumbnailURL *string, thumbnails *database.Thumbnails) []string {
+	urls := []string{}
+	if thumbnailURL != nil {
+		urls = append(urls, *thumbnailURL)
+	}
+	if thumbnails != nil {
+		for _, variant := range thumbnails.Variants {
+			if variant.URL != "" {
+				urls = append(urls, variant.URL)
+			}
+		}
+	}
+	sort.Strings(urls)
+	return slices.Compact(urls)
+}
+
+// cropToAspect cuts the largest centred region with the given width/height
+// ratio out of img.
+func cropToAspect(img image.Image, aspect float64) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	crop := bounds
+	if float64(width)/float64(height) > aspect {
+		cropWidth := max(1, int(float64(height)*aspect))
+		crop.Min.X += (width - cropWidth) / 2
+		crop.Max.X = crop.Min.X + cropWidth
+	} else {
+		cropHeight := max(1, int(float64(width)/aspect))
+		crop.Min.Y += (height - cropHeight) / 2
+		crop.Max.Y = crop.Min.Y + cropHeight
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, crop.Min, draw.Src)
+	return dst
+}
+
+// jpegOrientation reads the EXIF orientation tag of a JPEG, returning 1
+// (upright) if there isn't one.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xDA || length < 2 || i+2+length > len(data) {
+			break
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation finds the orientation tag in the first IFD of a TIFF
+// structure.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// applyOrientation rotates and flips img so it displays upright for the
+// given EXIF orientation.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 {
+		return img
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			var srcX, srcY int
+			switch orientation {
+			case 2:
+				srcX, srcY = width-1-x, y
+			case 3:
+				srcX, srcY = width-1-x, height-1-y
+			case 4:
+				srcX, srcY = x, height-1-y
+			case 5:
+				srcX, srcY = y, x
+			case 6:
+				srcX, srcY = y, height-1-x
+			case 7:
+				srcX, srcY = width-1-y, height-1-x
+			case 8:
+				srcX, srcY = width-1-y, x
+			}
+			dst.Set(x, y, img.At(bounds.Min.X+srcX, bounds.Min.Y+srcY))
+		}
+	}
+	return dst
+}
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -114,3 +115,23 @@ func GetAPIKey(headers http.Header) (string, error) {
 
 	return splitAuth[1], nil
 }
+
+// APIKeyPrefix starts every API key, so leaked keys are easy to recognise.
+const APIKeyPrefix = "tubely_"
+
+// MakeAPIKey returns a new random API key. Only its hash is stored.
+func MakeAPIKey() (string, error) {
+	key, err := MakeRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	return APIKeyPrefix + key, nil
+}
+
+// HashToken returns the hex SHA-256 of a random token such as an API key.
+// Tokens are random enough that a fast hash is safe, and it lets them be
+// looked up by hash.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,143 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ScopeVideosRead  = "videos:read"
+	ScopeVideosWrite = "videos:write"
+)
+
+// APIKeyScopes are the scopes an API key can be given.
+var APIKeyScopes = []string{ScopeVideosRead, ScopeVideosWrite}
+
+// APIKey lets automation act as its user without their password. Only the
+// key's hash is stored; Prefix is kept so users can tell keys apart.
+type APIKey struct {
+	ID         uuid.UUID  `json:"id"`
+	UserID     uuid.UUID  `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+type CreateAPIKeyParams struct {
+	UserID    uuid.UUID
+	Name      string
+	Prefix    string
+	KeyHash   string
+	Scopes    []string
+	ExpiresAt *time.Time
+}
+
+// HasScope reports whether the key was granted scope.
+func (k APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the key is past its expiry time.
+func (k APIKey) Expired() bool {
+	return k.ExpiresAt != nil && !time.Now().Before(*k.ExpiresAt)
+}
+
+const apiKeyColumns = `id, user_id, name, prefix, scopes, created_at, expires_at, last_used_at`
+
+func (c sqlClient) CreateAPIKey(params CreateAPIKeyParams) (APIKey, error) {
+	id := uuid.New()
+	var expiresAt any
+	if params.ExpiresAt != nil {
+		expiresAt = params.ExpiresAt.UTC()
+	}
+	_, err := c.db.Exec(`
+	INSERT INTO api_keys (id, user_id, name, prefix, key_hash, scopes, created_at, expires_at)
+	VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP, ?)
+	`, id, params.UserID.String(), params.Name, params.Prefix, params.KeyHash, strings.Join(params.Scopes, " "), expiresAt)
+	if err != nil {
+		return APIKey{}, err
+	}
+	return c.GetAPIKey(id)
+}
+
+func (c sqlClient) GetAPIKey(id uuid.UUID) (APIKey, error) {
+	return c.getAPIKey(`SELECT `+apiKeyColumns+` FROM api_keys WHERE id = ?`, id)
+}
+
+func (c sqlClient) GetAPIKeyByHash(keyHash string) (APIKey, error) {
+	return c.getAPIKey(`SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = ?`, keyHash)
+}
+
+func (c sqlClient) getAPIKey(query string, args ...any) (APIKey, error) {
+	key, err := scanAPIKey(c.db.QueryRow(query, args...))
+	if err == sql.ErrNoRows {
+		return APIKey{}, nil
+	}
+	return key, err
+}
+
+// GetAPIKeys returns userID's API keys, newest first, including expired
+// ones.
+func (c sqlClient) GetAPIKeys(userID uuid.UUID) ([]APIKey, error) {
+	rows, err := c.db.Query(`
+	SELECT `+apiKeyColumns+`
+	FROM api_keys
+	WHERE user_id = ?
+	ORDER BY created_at DESC, id
+	`, userID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (c sqlClient) TouchAPIKey(id uuid.UUID) error {
+	_, err := c.db.Exec(`UPDATE api_keys SET last_used_at = `+c.db.dialect.now()+` WHERE id = ?`, id)
+	return err
+}
+
+func (c sqlClient) DeleteAPIKey(id uuid.UUID) error {
+	_, err := c.db.Exec(`DELETE FROM api_keys WHERE id = ?`, id)
+	return err
+}
+
+func (c sqlClient) DeleteUserAPIKeys(userID uuid.UUID) error {
+	_, err := c.db.Exec(`DELETE FROM api_keys WHERE user_id = ?`, userID.String())
+	return err
+}
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var key APIKey
+	var userID, scopes string
+	err := row.Scan(&key.ID, &userID, &key.Name, &key.Prefix, &scopes, &key.CreatedAt, &key.ExpiresAt, &key.LastUsedAt)
+	if err != nil {
+		return APIKey{}, err
+	}
+	key.UserID, err = uuid.Parse(userID)
+	if err != nil {
+		return APIKey{}, err
+	}
+	key.Scopes = strings.Fields(scopes)
+	return key, nil
+}
@@ -3,87 +3,245 @@ package database
 import (
 	"database/sql"
 	"fmt"
+	"net/url"
+	"strings"
+	"time"
 
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
-type Client struct {
-	db *sql.DB
+// Client is the data access layer used by the API. sqlClient implements it
+// for both sqlite and Postgres.
+type Client interface {
+	Close() error
+	Reset() error
+
+	Migrate() (int, error)
+	Rollback(steps int) (int, error)
+	MigrationStatuses() ([]MigrationStatus, error)
+
+	GetUsers() ([]User, error)
+	GetUserByEmail(email string) (User, error)
+	CreateUser(params CreateUserParams) (*User, error)
+	GetUser(id uuid.UUID) (*User, error)
+	UpdateUserPassword(id uuid.UUID, password string) error
+	MarkEmailVerified(id uuid.UUID) error
+	DeleteUser(id uuid.UUID) error
+
+	CreateUserToken(tokenHash string, userID uuid.UUID, purpose string, expiresAt time.Time) error
+	GetUserToken(tokenHash, purpose string) (UserToken, error)
+	UseUserToken(tokenHash string) (bool, error)
+
+	CreateUserIdentity(issuer, subject string, userID uuid.UUID) error
+	GetUserIdentity(issuer, subject string) (UserIdentity, error)
+
+	CreateRefreshToken(params CreateRefreshTokenParams) (RefreshToken, error)
+	RotateRefreshToken(tokenHash string, next CreateRefreshTokenParams) (bool, error)
+	RevokeRefreshToken(tokenHash string) error
+	RevokeRefreshTokenFamily(familyID uuid.UUID) error
+	GetRefreshToken(tokenHash string) (RefreshToken, error)
+	RevokeUserRefreshTokens(userID uuid.UUID) error
+
+	CreateSession(params CreateSessionParams) error
+	TouchSession(id uuid.UUID, userAgent, ipAddress string) error
+	GetActiveSessions(userID uuid.UUID) ([]Session, error)
+	GetSession(id uuid.UUID) (Session, error)
+
+	CreateAPIKey(params CreateAPIKeyParams) (APIKey, error)
+	GetAPIKey(id uuid.UUID) (APIKey, error)
+	GetAPIKeyByHash(keyHash string) (APIKey, error)
+	GetAPIKeys(userID uuid.UUID) ([]APIKey, error)
+	TouchAPIKey(id uuid.UUID) error
+	DeleteAPIKey(id uuid.UUID) error
+	DeleteUserAPIKeys(userID uuid.UUID) error
+
+	ListVideos(opts VideoListOptions) ([]Video, string, error)
+	SearchVideos(query string, userID uuid.UUID, limit, offset int) ([]VideoSearchResult, error)
+	GetPublicVideos(limit int) ([]Video, error)
+	CreateVideo(params CreateVideoParams) (Video, error)
+	GetVideo(id uuid.UUID) (Video, error)
+	UpdateVideo(video Video) error
+	UpdateVideoIfUnmodified(video Video, unmodifiedSince time.Time) (bool, error)
+	SetVideoProcessingStatus(id uuid.UUID, status string, processingError *string) error
+	DeleteVideo(id uuid.UUID) error
+	TrashVideo(id uuid.UUID) error
+	RestoreVideo(id uuid.UUID) error
+	GetTrashedVideo(id uuid.UUID) (Video, error)
+	GetTrashedVideos(userID uuid.UUID) ([]Video, error)
+	GetExpiredTrashedVideos(cutoff time.Time) ([]Video, error)
+	GetReferencedFiles() (ReferencedFiles, error)
+
+	UpsertVideoMetadata(videoID uuid.UUID, meta VideoMetadata) error
+	DeleteVideoMetadata(videoID uuid.UUID) error
+
+	UpsertVideoGrant(videoID, userID uuid.UUID, role string) (VideoGrant, error)
+	GetVideoGrant(videoID, userID uuid.UUID) (VideoGrant, error)
+	GetVideoGrants(videoID uuid.UUID) ([]VideoGrant, error)
+	DeleteVideoGrant(videoID, userID uuid.UUID) error
+	DeleteVideoGrants(videoID uuid.UUID) error
+
+	CreateUploadSession(params CreateUploadSessionParams) (UploadSession, error)
+	GetUploadSession(id uuid.UUID) (UploadSession, error)
+	CompleteUploadSession(id uuid.UUID, job CreateProcessingJobParams) (bool, error)
+	GetExpiredUploadSessions(cutoff time.Time) ([]UploadSession, error)
+	DeleteUploadSession(id uuid.UUID) error
+	RecordUploadChunk(chunk UploadChunk) error
+	GetUploadChunks(sessionID uuid.UUID) ([]UploadChunk, error)
+
+	CreateDirectUpload(params CreateDirectUploadParams) (DirectUpload, error)
+	GetDirectUpload(id uuid.UUID) (DirectUpload, error)
+	CompleteDirectUpload(id uuid.UUID, job CreateProcessingJobParams) (bool, error)
+	DeleteDirectUpload(id uuid.UUID) error
+
+	CreateProcessingJob(params CreateProcessingJobParams) (ProcessingJob, error)
+	GetProcessingJob(id uuid.UUID) (ProcessingJob, error)
+	ClaimProcessingJob(workerID string) (ProcessingJob, error)
+	HeartbeatProcessingJob(job ProcessingJob) (bool, error)
+	FinishProcessingJob(job ProcessingJob) (bool, error)
+	FailProcessingJob(job ProcessingJob, jobErr string, retry bool) (bool, error)
+
+	CreateOrganization(name string, creatorID uuid.UUID) (Organization, error)
+	GetOrganization(id uuid.UUID) (Organization, error)
+	GetUserOrganizations(userID uuid.UUID) ([]Organization, error)
+	GetOrgMember(orgID, userID uuid.UUID) (OrgMember, error)
+	GetOrgMembers(orgID uuid.UUID) ([]OrgMember, error)
+	UpsertOrgMember(orgID, userID uuid.UUID, role string) (OrgMember, error)
+	DeleteOrgMember(orgID, userID uuid.UUID) error
+	CountOrgAdmins(orgID uuid.UUID) (int, error)
+
+	CreateOrgInvitation(params CreateOrgInvitationParams, expiresAt time.Time) (OrgInvitation, error)
+	GetOrgInvitation(id uuid.UUID) (OrgInvitation, error)
+	GetPendingOrgInvitations(orgID uuid.UUID) ([]OrgInvitation, error)
+	GetPendingInvitationsForEmail(email string) ([]OrgInvitation, error)
+	AcceptOrgInvitation(invitation OrgInvitation, userID uuid.UUID) (OrgMember, error)
+	DeleteOrgInvitation(id uuid.UUID) error
 }
 
-func NewClient(pathToDB string) (Client, error) {
-	db, err := sql.Open("sqlite3", pathToDB)
+type sqlClient struct {
+	db conn
+}
+
+// NewClient opens the database and applies any pending migrations.
+func NewClient(dbURL string) (Client, error) {
+	c, err := Open(dbURL)
 	if err != nil {
-		return Client{}, err
+		return nil, err
 	}
-	c := Client{db}
-	err = c.autoMigrate()
+	_, err = c.Migrate()
 	if err != nil {
-		return Client{}, err
+		c.Close()
+		return nil, err
 	}
 	return c, nil
+}
 
+// Open opens the database without touching its schema. postgres:// and
+// postgresql:// URLs open Postgres; anything else is a sqlite path, with an
+// optional sqlite:// prefix.
+func Open(dbURL string) (Client, error) {
+	if strings.HasPrefix(dbURL, "postgres://") || strings.HasPrefix(dbURL, "postgresql://") {
+		return openPostgres(dbURL)
+	}
+	return openSQLite(strings.TrimPrefix(dbURL, "sqlite://"))
 }
 
-func (c *Client) autoMigrate() error {
-	userTable := `
-	CREATE TABLE IF NOT EXISTS users (
-		id TEXT PRIMARY KEY,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		password TEXT NOT NULL,
-		email TEXT UNIQUE NOT NULL
-	);
-	`
-	_, err := c.db.Exec(userTable)
+func openSQLite(pathToDB string) (Client, error) {
+	db, err := sql.Open("sqlite3", pathToDB)
 	if err != nil {
-		return err
-	}
-	refreshTokenTable := `
-	CREATE TABLE IF NOT EXISTS refresh_tokens (
-		token TEXT PRIMARY KEY,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		revoked_at TIMESTAMP,
-		user_id TEXT NOT NULL,
-		expires_at TIMESTAMP NOT NULL,
-		FOREIGN KEY(user_id) REFERENCES users(id)
-	);
-	`
-	_, err = c.db.Exec(refreshTokenTable)
+		return nil, err
+	}
+	// sqlite only allows one writer; sharing a single connection between the
+	// HTTP handlers and the processing workers avoids "database is locked".
+	db.SetMaxOpenConns(1)
+	c := sqlClient{conn{DB: db, dialect: sqliteDialect{}}}
+
+	err = checkVideoFTS(c.db)
 	if err != nil {
-		return err
-	}
-
-	videoTable := `
-	CREATE TABLE IF NOT EXISTS videos (
-		id TEXT PRIMARY KEY,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		title TEXT NOT NULL,
-		description TEXT,
-		thumbnail_url TEXT,
-		video_url TEXT TEXT,
-		user_id INTEGER,
-		FOREIGN KEY(user_id) REFERENCES users(id)
-	);
-	`
-	_, err = c.db.Exec(videoTable)
+		db.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func openPostgres(dbURL string) (Client, error) {
+	u, err := url.Parse(dbURL)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	// TIMESTAMP columns have no zone, so keep CURRENT_TIMESTAMP defaults and
+	// the times we pass in both in UTC.
+	query := u.Query()
+	if query.Get("timezone") == "" {
+		query.Set("timezone", "UTC")
+		u.RawQuery = query.Encode()
+	}
+
+	db, err := sql.Open("postgres", u.String())
+	if err != nil {
+		return nil, err
+	}
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return sqlClient{conn{DB: db, dialect: postgresDialect{}}}, nil
 }
 
-func (c Client) Reset() error {
+func (c sqlClient) Close() error {
+	return c.db.Close()
+}
+
+func (c sqlClient) Reset() error {
+	if _, err := c.db.Exec("DELETE FROM organization_invitations"); err != nil {
+		return fmt.Errorf("failed to reset table organization_invitations: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM organization_members"); err != nil {
+		return fmt.Errorf("failed to reset table organization_members: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_grants"); err != nil {
+		return fmt.Errorf("failed to reset table video_grants: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_metadata"); err != nil {
+		return fmt.Errorf("failed to reset table video_metadata: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM processing_jobs"); err != nil {
+		return fmt.Errorf("failed to reset table processing_jobs: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM direct_uploads"); err != nil {
+		return fmt.Errorf("failed to reset table direct_uploads: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM upload_chunks"); err != nil {
+		return fmt.Errorf("failed to reset table upload_chunks: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM upload_sessions"); err != nil {
+		return fmt.Errorf("failed to reset table upload_sessions: %w", err)
+	}
 	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
 	}
-	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
-		return fmt.Errorf("failed to reset table users: %w", err)
+	if _, err := c.db.Exec("DELETE FROM sessions"); err != nil {
+		return fmt.Errorf("failed to reset table sessions: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM api_keys"); err != nil {
+		return fmt.Errorf("failed to reset table api_keys: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM user_identities"); err != nil {
+		return fmt.Errorf("failed to reset table user_identities: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM user_tokens"); err != nil {
+		return fmt.Errorf("failed to reset table user_tokens: %w", err)
 	}
 	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM organizations"); err != nil {
+		return fmt.Errorf("failed to reset table organizations: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
+		return fmt.Errorf("failed to reset table users: %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,194 @@
+package database
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// forEachDatabase runs fn against a freshly migrated in-memory sqlite
+// database, and against Postgres when TEST_POSTGRES_URL is set. The Postgres
+// database should be a scratch one: every migration is rolled back before
+// and after the test.
+func forEachDatabase(t *testing.T, fn func(t *testing.T, c sqlClient)) {
+	t.Helper()
+	forEachEmptyDatabase(t, func(t *testing.T, c sqlClient) {
+		_, err := c.Migrate()
+		if err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+		fn(t, c)
+	})
+}
+
+// forEachEmptyDatabase is forEachDatabase without the migrations.
+func forEachEmptyDatabase(t *testing.T, fn func(t *testing.T, c sqlClient)) {
+	t.Helper()
+	t.Run("sqlite", func(t *testing.T) {
+		client, err := openSQLite(":memory:")
+		if err != nil {
+			t.Fatalf("openSQLite: %v", err)
+		}
+		t.Cleanup(func() { client.Close() })
+		fn(t, client.(sqlClient))
+	})
+	t.Run("postgres", func(t *testing.T) {
+		dbURL := os.Getenv("TEST_POSTGRES_URL")
+		if dbURL == "" {
+			t.Skip("TEST_POSTGRES_URL isn't set")
+		}
+		client, err := openPostgres(dbURL)
+		if err != nil {
+			t.Fatalf("openPostgres: %v", err)
+		}
+		_, err = client.Rollback(len(migrations))
+		if err != nil {
+			t.Fatalf("Rollback before test: %v", err)
+		}
+		t.Cleanup(func() {
+			_, err := client.Rollback(len(migrations))
+			if err != nil {
+				t.Errorf("Rollback after test: %v", err)
+			}
+			client.Close()
+		})
+		fn(t, client.(sqlClient))
+	})
+}
+
+func createTestUser(t *testing.T, c sqlClient) *User {
+	t.Helper()
+	user, err := c.CreateUser(CreateUserParams{
+		Email:    uuid.NewString() + "@example.com",
+		Password: "hash",
+	})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	return user
+}
+
+func createTestVideo(t *testing.T, c sqlClient, userID uuid.UUID, title string) Video {
+	t.Helper()
+	video, err := c.CreateVideo(CreateVideoParams{Title: title, UserID: userID})
+	if err != nil {
+		t.Fatalf("CreateVideo: %v", err)
+	}
+	return video
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	forEachEmptyDatabase(t, func(t *testing.T, c sqlClient) {
+		applied, err := c.Migrate()
+		if err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+		if applied != len(migrations) {
+			t.Errorf("Migrate applied %d migrations, want %d", applied, len(migrations))
+		}
+		applied, err = c.Migrate()
+		if err != nil {
+			t.Fatalf("second Migrate: %v", err)
+		}
+		if applied != 0 {
+			t.Errorf("second Migrate applied %d migrations, want 0", applied)
+		}
+
+		// Exercise the schema before tearing it down.
+		user := createTestUser(t, c)
+		createTestVideo(t, c, user.ID, "before rollback")
+
+		reverted, err := c.Rollback(len(migrations))
+		if err != nil {
+			t.Fatalf("Rollback: %v", err)
+		}
+		if reverted != len(migrations) {
+			t.Errorf("Rollback reverted %d migrations, want %d", reverted, len(migrations))
+		}
+		statuses, err := c.MigrationStatuses()
+		if err != nil {
+			t.Fatalf("MigrationStatuses: %v", err)
+		}
+		for _, status := range statuses {
+			if status.Applied {
+				t.Errorf("migration %d is still applied after rolling everything back", status.Version)
+			}
+		}
+		_, err = c.db.Exec("SELECT id FROM videos")
+		if err == nil {
+			t.Error("videos table still exists after rolling everything back")
+		}
+
+		applied, err = c.Migrate()
+		if err != nil {
+			t.Fatalf("Migrate after Rollback: %v", err)
+		}
+		if applied != len(migrations) {
+			t.Errorf("Migrate after Rollback applied %d migrations, want %d", applied, len(migrations))
+		}
+	})
+}
+
+func TestMigrateRefusesOwnerlessVideos(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, c sqlClient) {
+		_, err := c.Rollback(len(migrations) - 1)
+		if err != nil {
+			t.Fatalf("Rollback to the initial schema: %v", err)
+		}
+		id := uuid.New()
+		_, err = c.db.Exec("INSERT INTO videos (id, title, description, user_id) VALUES (?, ?, '', NULL)", id, "ownerless")
+		if err != nil {
+			t.Fatalf("inserting ownerless video: %v", err)
+		}
+
+		_, err = c.Migrate()
+		if err == nil || !strings.Contains(err.Error(), id.String()) {
+			t.Fatalf("Migrate error = %v, want one naming video %s", err, id)
+		}
+		var count int
+		err = c.db.QueryRow("SELECT COUNT(*) FROM videos").Scan(&count)
+		if err != nil {
+			t.Fatalf("counting videos: %v", err)
+		}
+		if count != 1 {
+			t.Errorf("%d videos left, want the ownerless one kept", count)
+		}
+
+		// Once an operator assigns an owner the migration goes through.
+		// Postgres' initial user_id is an INTEGER, so there the only way
+		// out is deleting the video.
+		if c.db.dialect.name() == "postgres" {
+			_, err = c.db.Exec("DELETE FROM videos WHERE id = ?", id)
+			if err != nil {
+				t.Fatalf("deleting ownerless video: %v", err)
+			}
+			_, err = c.Migrate()
+			if err != nil {
+				t.Fatalf("Migrate after deleting the video: %v", err)
+			}
+			return
+		}
+		ownerID := uuid.New()
+		_, err = c.db.Exec("INSERT INTO users (id, email, password) VALUES (?, ?, ?)", ownerID.String(), "owner@example.com", "hash")
+		if err != nil {
+			t.Fatalf("inserting owner: %v", err)
+		}
+		_, err = c.db.Exec("UPDATE videos SET user_id = ? WHERE id = ?", ownerID.String(), id)
+		if err != nil {
+			t.Fatalf("assigning owner: %v", err)
+		}
+		_, err = c.Migrate()
+		if err != nil {
+			t.Fatalf("Migrate after assigning an owner: %v", err)
+		}
+		video, err := c.GetVideo(id)
+		if err != nil {
+			t.Fatalf("GetVideo: %v", err)
+		}
+		if video.UserID != ownerID {
+			t.Errorf("video owner = %v, want %v", video.UserID, ownerID)
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// dialect covers the SQL that differs between sqlite and Postgres. Queries
+// are written once with sqlite's ? placeholders and rebound per dialect.
+type dialect interface {
+	name() string
+	rebind(query string) string
+	// now is an expression for the current time, precise enough to tell
+	// apart two writes in the same second.
+	now() string
+	// secondsAgo is an expression for the current time minus seconds.
+	secondsAgo(seconds int) string
+	// forUpdate is appended to a SELECT to lock the rows it reads until the
+	// transaction ends.
+	forUpdate() string
+	// timeKey wraps a timestamp expression so it compares by value. sqlite
+	// compares timestamps as text, which breaks between values stored with
+	// and without fractional seconds.
+	timeKey(expr string) string
+	columnExists(tx *tx, table, column string) (bool, error)
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) name() string { return "sqlite" }
+
+func (sqliteDialect) rebind(query string) string { return query }
+
+// CURRENT_TIMESTAMP only has second precision in sqlite.
+func (sqliteDialect) now() string { return "strftime('%Y-%m-%d %H:%M:%f', 'now')" }
+
+// sqlite transactions already hold the database's only connection.
+func (sqliteDialect) forUpdate() string { return "" }
+
+func (sqliteDialect) timeKey(expr string) string {
+	return "strftime('%Y-%m-%d %H:%M:%f', " + expr + ")"
+}
+
+func (sqliteDialect) secondsAgo(seconds int) string {
+	return fmt.Sprintf("datetime('now', '-%d seconds')", seconds)
+}
+
+func (sqliteDialect) columnExists(tx *tx, table, column string) (bool, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) name() string { return "postgres" }
+
+// rebind turns ? placeholders into $1, $2, ... leaving quoted strings alone.
+func (postgresDialect) rebind(query string) string {
+	out := &strings.Builder{}
+	n := 0
+	inQuote := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			inQuote = !inQuote
+		case r == '?' && !inQuote:
+			n++
+			out.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		out.WriteRune(r)
+	}
+	return out.String()
+}
+
+func (postgresDialect) now() string { return "CURRENT_TIMESTAMP" }
+
+func (postgresDialect) forUpdate() string { return " FOR UPDATE" }
+
+func (postgresDialect) timeKey(expr string) string { return expr }
+
+func (postgresDialect) secondsAgo(seconds int) string {
+	return fmt.Sprintf("CURRENT_TIMESTAMP - INTERVAL '%d seconds'", seconds)
+}
+
+func (postgresDialect) columnExists(tx *tx, table, column string) (bool, error) {
+	var count int
+	err := tx.QueryRow(`
+	SELECT COUNT(*) FROM information_schema.columns
+	WHERE table_schema = current_schema() AND table_name = ? AND column_name = ?
+	`, table, column).Scan(&count)
+	return count > 0, err
+}
+
+// conn and tx rebind every query for their dialect, so the query code can
+// use them exactly like *sql.DB and *sql.Tx.
+type conn struct {
+	*sql.DB
+	dialect dialect
+}
+
+func (c conn) Exec(query string, args ...any) (sql.Result, error) {
+	return c.DB.Exec(c.dialect.rebind(query), args...)
+}
+
+func (c conn) Query(query string, args ...any) (*sql.Rows, error) {
+	return c.DB.Query(c.dialect.rebind(query), args...)
+}
+
+func (c conn) QueryRow(query string, args ...any) *sql.Row {
+	return c.DB.QueryRow(c.dialect.rebind(query), args...)
+}
+
+func (c conn) Begin() (*tx, error) {
+	sqlTx, err := c.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &tx{Tx: sqlTx, dialect: c.dialect}, nil
+}
+
+type tx struct {
+	*sql.Tx
+	dialect dialect
+}
+
+func (t *tx) Exec(query string, args ...any) (sql.Result, error) {
+	return t.Tx.Exec(t.dialect.rebind(query), args...)
+}
+
+func (t *tx) Query(query string, args ...any) (*sql.Rows, error) {
+	return t.Tx.Query(t.dialect.rebind(query), args...)
+}
+
+func (t *tx) QueryRow(query string, args ...any) *sql.Row {
+	return t.Tx.QueryRow(t.dialect.rebind(query), args...)
+}
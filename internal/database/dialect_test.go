@@ -0,0 +1,50 @@
+package database
+
+import "testing"
+
+func TestPostgresRebind(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{
+			query: "SELECT * FROM videos WHERE id = ? AND user_id = ?",
+			want:  "SELECT * FROM videos WHERE id = $1 AND user_id = $2",
+		},
+		{
+			query: "SELECT '?' FROM videos WHERE id = ?",
+			want:  "SELECT '?' FROM videos WHERE id = $1",
+		},
+		{
+			query: "SELECT 'it''s ?', ? FROM videos",
+			want:  "SELECT 'it''s ?', $1 FROM videos",
+		},
+		{
+			query: `SELECT id FROM videos WHERE title LIKE ? ESCAPE '\' AND id = ?`,
+			want:  `SELECT id FROM videos WHERE title LIKE $1 ESCAPE '\' AND id = $2`,
+		},
+		{
+			query: "SELECT 1",
+			want:  "SELECT 1",
+		},
+	}
+	for _, tt := range tests {
+		got := postgresDialect{}.rebind(tt.query)
+		if got != tt.want {
+			t.Errorf("rebind(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestRebindLeavesQuotedPlaceholders(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, c sqlClient) {
+		var quoted, bound string
+		err := c.db.QueryRow("SELECT 'why?', CAST(? AS TEXT)", "bound").Scan(&quoted, &bound)
+		if err != nil {
+			t.Fatalf("query: %v", err)
+		}
+		if quoted != "why?" || bound != "bound" {
+			t.Errorf("got %q, %q; want %q, %q", quoted, bound, "why?", "bound")
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type DirectUpload struct {
+	ID          uuid.UUID  `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	CreateDirectUploadParams
+}
+
+type CreateDirectUploadParams struct {
+	VideoID           uuid.UUID `json:"video_id"`
+	UserID            uuid.UUID `json:"user_id"`
+	ObjectKey         string    `json:"key"`
+	MultipartUploadID *string   `json:"multipart_upload_id"`
+	ContentType       string    `json:"content_type"`
+	Size              int64     `json:"size"`
+}
+
+func (c sqlClient) CreateDirectUpload(params CreateDirectUploadParams) (DirectUpload, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO direct_uploads (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		object_key,
+		multipart_upload_id,
+		content_type,
+		size
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(
+		query,
+		id,
+		params.VideoID,
+		params.UserID,
+		params.ObjectKey,
+		params.MultipartUploadID,
+		params.ContentType,
+		params.Size,
+	)
+	if err != nil {
+		return DirectUpload{}, err
+	}
+
+	return c.GetDirectUpload(id)
+}
+
+func (c sqlClient) GetDirectUpload(id uuid.UUID) (DirectUpload, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		updated_at,
+		completed_at,
+		video_id,
+		user_id,
+		object_key,
+		multipart_upload_id,
+		content_type,
+		size
+	FROM direct_uploads
+	WHERE id = ?
+	`
+
+	var upload DirectUpload
+	err := c.db.QueryRow(query, id).Scan(
+		&upload.ID,
+		&upload.CreatedAt,
+		&upload.UpdatedAt,
+		&upload.CompletedAt,
+		&upload.VideoID,
+		&upload.UserID,
+		&upload.ObjectKey,
+		&upload.MultipartUploadID,
+		&upload.ContentType,
+		&upload.Size,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return DirectUpload{}, nil
+		}
+		return DirectUpload{}, err
+	}
+
+	return upload, nil
+}
+
+// CompleteDirectUpload marks the upload complete and queues job to process
+// its object, in one transaction. It reports false, queueing nothing, if
+// the upload was already complete.
+func (c sqlClient) CompleteDirectUpload(id uuid.UUID, job CreateProcessingJobParams) (bool, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+	UPDATE direct_uploads
+	SET
+		completed_at = CURRENT_TIMESTAMP,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND completed_at IS NULL
+	`, id)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if rows == 0 {
+		return false, nil
+	}
+
+	_, err = createProcessingJob(tx, tx.dialect, job)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (c sqlClient) DeleteDirectUpload(id uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM direct_uploads WHERE id = ?", id)
+	return err
+}
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestCompleteDirectUploadOnce(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, c sqlClient) {
+		user := createTestUser(t, c)
+		video := createTestVideo(t, c, user.ID, "video")
+		upload, err := c.CreateDirectUpload(CreateDirectUploadParams{
+			VideoID:     video.ID,
+			UserID:      user.ID,
+			ObjectKey:   "uploads/direct",
+			ContentType: "video/mp4",
+			Size:        1,
+		})
+		if err != nil {
+			t.Fatalf("CreateDirectUpload: %v", err)
+		}
+		job := CreateProcessingJobParams{VideoID: video.ID, SourceKey: upload.ObjectKey, ContentType: upload.ContentType}
+
+		// Two requests racing to complete the upload queue one job.
+		for i, want := range []bool{true, false} {
+			completed, err := c.CompleteDirectUpload(upload.ID, job)
+			if err != nil || completed != want {
+				t.Errorf("CompleteDirectUpload #%d = %v, %v; want %v", i+1, completed, err, want)
+			}
+		}
+		upload, err = c.GetDirectUpload(upload.ID)
+		if err != nil || upload.CompletedAt == nil {
+			t.Errorf("GetDirectUpload = %+v, %v; want it completed", upload, err)
+		}
+		video, err = c.GetVideo(video.ID)
+		if err != nil || video.ProcessingStatus != VideoStatusPending {
+			t.Errorf("GetVideo = %+v, %v; want it pending", video, err)
+		}
+
+		claimed, err := c.ClaimProcessingJob("worker")
+		if err != nil || claimed.SourceKey != upload.ObjectKey {
+			t.Fatalf("ClaimProcessingJob = %+v, %v; want the upload's job", claimed, err)
+		}
+		claimed, err = c.ClaimProcessingJob("worker")
+		if err != nil || claimed.ID != uuid.Nil {
+			t.Errorf("ClaimProcessingJob = %+v, %v; want no second job", claimed, err)
+		}
+
+		// Completed uploads are kept by their job, not the upload.
+		refs, err := c.GetReferencedFiles()
+		if err != nil {
+			t.Fatalf("GetReferencedFiles: %v", err)
+		}
+		if len(refs.UploadKeys) != 1 || refs.UploadKeys[0] != upload.ObjectKey {
+			t.Errorf("UploadKeys = %v, want just %q", refs.UploadKeys, upload.ObjectKey)
+		}
+	})
+}
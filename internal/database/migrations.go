@@ -0,0 +1,1078 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// migration is one numbered schema change. Migrations are applied in order
+// and each runs in its own transaction together with its schema_migrations
+// bookkeeping. New schema changes must be added as new migrations at the
+// end of the list rather than by editing old ones.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *tx) error
+	down    func(tx *tx) error
+}
+
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial_schema",
+		up:      migrateInitialSchema,
+		down: dropTables(
+			"organization_invitations",
+			"organization_members",
+			"organizations",
+			"video_grants",
+			"video_metadata",
+			"processing_jobs",
+			"direct_uploads",
+			"upload_chunks",
+			"upload_sessions",
+			"refresh_tokens",
+			"videos",
+			"users",
+		),
+	},
+	{
+		version: 2,
+		name:    "videos_user_id_text",
+		up: func(tx *tx) error {
+			err := checkNoOwnerlessVideos(tx)
+			if err != nil {
+				return err
+			}
+			return rebuildVideosTable(tx, "TEXT NOT NULL")
+		},
+		down: func(tx *tx) error {
+			return rebuildVideosTable(tx, "INTEGER")
+		},
+	},
+	{
+		version: 3,
+		name:    "video_search",
+		up:      migrateVideoSearch,
+		down: func(tx *tx) error {
+			if tx.dialect.name() == "postgres" {
+				_, err := tx.Exec("DROP INDEX IF EXISTS videos_search_idx")
+				return err
+			}
+			for _, stmt := range []string{
+				"DROP TRIGGER IF EXISTS videos_fts_insert",
+				"DROP TRIGGER IF EXISTS videos_fts_update",
+				"DROP TRIGGER IF EXISTS videos_fts_delete",
+				"DROP TABLE IF EXISTS videos_fts",
+			} {
+				_, err := tx.Exec(stmt)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version: 4,
+		name:    "videos_deleted_at",
+		up: func(tx *tx) error {
+			_, err := ensureColumn(tx, "videos", "deleted_at", "TIMESTAMP")
+			return err
+		},
+		down: func(tx *tx) error {
+			_, err := tx.Exec("ALTER TABLE videos DROP COLUMN deleted_at")
+			return err
+		},
+	},
+	{
+		version: 5,
+		name:    "videos_thumbnails",
+		up: func(tx *tx) error {
+			_, err := ensureColumn(tx, "videos", "thumbnails", "TEXT")
+			return err
+		},
+		down: func(tx *tx) error {
+			_, err := tx.Exec("ALTER TABLE videos DROP COLUMN thumbnails")
+			return err
+		},
+	},
+	{
+		version: 6,
+		name:    "refresh_token_families",
+		up:      migrateRefreshTokenFamilies,
+		down: func(tx *tx) error {
+			_, err := tx.Exec("DROP INDEX IF EXISTS refresh_tokens_family_id")
+			if err != nil {
+				return err
+			}
+			for _, column := range []string{"family_id", "rotated_at"} {
+				_, err = tx.Exec("ALTER TABLE refresh_tokens DROP COLUMN " + column)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version: 7,
+		name:    "sessions",
+		up:      migrateSessions,
+		down: func(tx *tx) error {
+			_, err := tx.Exec("DROP TABLE IF EXISTS sessions")
+			return err
+		},
+	},
+	{
+		version: 8,
+		name:    "api_keys",
+		up: func(tx *tx) error {
+			_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS api_keys (
+				id TEXT PRIMARY KEY,
+				user_id TEXT NOT NULL,
+				name TEXT NOT NULL,
+				prefix TEXT NOT NULL,
+				key_hash TEXT UNIQUE NOT NULL,
+				scopes TEXT NOT NULL,
+				created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				expires_at TIMESTAMP,
+				last_used_at TIMESTAMP,
+				FOREIGN KEY(user_id) REFERENCES users(id)
+			)
+			`)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("CREATE INDEX IF NOT EXISTS api_keys_user_id ON api_keys (user_id)")
+			return err
+		},
+		down: func(tx *tx) error {
+			_, err := tx.Exec("DROP TABLE IF EXISTS api_keys")
+			return err
+		},
+	},
+	{
+		version: 9,
+		name:    "user_identities",
+		up: func(tx *tx) error {
+			_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS user_identities (
+				issuer TEXT NOT NULL,
+				subject TEXT NOT NULL,
+				user_id TEXT NOT NULL,
+				created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (issuer, subject),
+				FOREIGN KEY(user_id) REFERENCES users(id)
+			)
+			`)
+			return err
+		},
+		down: func(tx *tx) error {
+			_, err := tx.Exec("DROP TABLE IF EXISTS user_identities")
+			return err
+		},
+	},
+	{
+		version: 10,
+		name:    "user_tokens",
+		up: func(tx *tx) error {
+			_, err := ensureColumn(tx, "users", "email_verified_at", "TIMESTAMP")
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`
+			CREATE TABLE IF NOT EXISTS user_tokens (
+				token_hash TEXT PRIMARY KEY,
+				user_id TEXT NOT NULL,
+				purpose TEXT NOT NULL,
+				created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				expires_at TIMESTAMP NOT NULL,
+				used_at TIMESTAMP,
+				FOREIGN KEY(user_id) REFERENCES users(id)
+			)
+			`)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("CREATE INDEX IF NOT EXISTS user_tokens_user_id ON user_tokens (user_id, purpose)")
+			return err
+		},
+		down: func(tx *tx) error {
+			_, err := tx.Exec("DROP TABLE IF EXISTS user_tokens")
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("ALTER TABLE users DROP COLUMN email_verified_at")
+			return err
+		},
+	},
+	{
+		version: 11,
+		name:    "direct_uploads_size",
+		up: func(tx *tx) error {
+			_, err := ensureColumn(tx, "direct_uploads", "size", "BIGINT NOT NULL DEFAULT 0")
+			return err
+		},
+		down: func(tx *tx) error {
+			_, err := tx.Exec("ALTER TABLE direct_uploads DROP COLUMN size")
+			return err
+		},
+	},
+	{
+		version: 12,
+		name:    "videos_user_id_postgres",
+		up:      migrateVideosUserIDPostgres,
+		down: func(tx *tx) error {
+			if tx.dialect.name() != "postgres" {
+				return nil
+			}
+			// user_id stays TEXT: the UUIDs in it can't be turned back into
+			// integers, and the up migration accepts either type.
+			for _, stmt := range []string{
+				"ALTER TABLE videos DROP CONSTRAINT IF EXISTS videos_user_id_fkey",
+				"ALTER TABLE videos ALTER COLUMN user_id DROP NOT NULL",
+			} {
+				_, err := tx.Exec(stmt)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version: 13,
+		name:    "byte_counts_bigint",
+		up: func(tx *tx) error {
+			return alterByteCountColumns(tx, "BIGINT")
+		},
+		down: func(tx *tx) error {
+			return alterByteCountColumns(tx, "INTEGER")
+		},
+	},
+	{
+		version: 14,
+		name:    "refresh_token_hashes",
+		up:      hashRefreshTokens,
+		down: func(tx *tx) error {
+			// Hashes can't be turned back into tokens, so after rolling
+			// back every refresh token stops working and users have to
+			// log in again.
+			_, err := tx.Exec("ALTER TABLE refresh_tokens RENAME COLUMN token_hash TO token")
+			return err
+		},
+	},
+	{
+		version: 15,
+		name:    "processing_job_leases",
+		up:      migrateProcessingJobLeases,
+		down: func(tx *tx) error {
+			err := failUnfinishedJobs(tx)
+			if err != nil {
+				return err
+			}
+			_, err = ensureColumn(tx, "processing_jobs", "source_path", "TEXT NOT NULL DEFAULT ''")
+			if err != nil {
+				return err
+			}
+			for _, column := range []string{"source_key", "worker_id", "heartbeat_at"} {
+				_, err = tx.Exec("ALTER TABLE processing_jobs DROP COLUMN " + column)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// MigrationStatus reports whether a migration has been applied.
+type MigrationStatus struct {
+	Version int
+	Name    string
+	Applied bool
+}
+
+func (c sqlClient) ensureMigrationsTable() error {
+	_, err := c.db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`)
+	return err
+}
+
+func (c sqlClient) appliedVersions() (map[int]bool, error) {
+	err := c.ensureMigrationsTable()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := c.db.Query("SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]bool{}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// Migrate applies every pending migration and returns how many ran.
+func (c sqlClient) Migrate() (int, error) {
+	applied, err := c.appliedVersions()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		err := c.runMigration(m, m.up, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.version, m.name)
+		if err != nil {
+			return count, fmt.Errorf("migration %d_%s: %w", m.version, m.name, err)
+		}
+		count++
+	}
+
+	// The search index is checked on every run rather than only by its
+	// migration, since a database migrated by a build without FTS5 gets
+	// no index.
+	if c.db.dialect.name() == "sqlite" {
+		tx, err := c.db.Begin()
+		if err != nil {
+			return count, err
+		}
+		defer tx.Rollback()
+		err = ensureVideoFTS(tx)
+		if err != nil {
+			return count, fmt.Errorf("video search index: %w", err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// Rollback reverts the most recently applied migrations, newest first, and
+// returns how many were reverted.
+func (c sqlClient) Rollback(steps int) (int, error) {
+	applied, err := c.appliedVersions()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+		m := migrations[i]
+		if !applied[m.version] {
+			continue
+		}
+		err := c.runMigration(m, m.down, "DELETE FROM schema_migrations WHERE version = ?", m.version)
+		if err != nil {
+			return count, fmt.Errorf("rollback %d_%s: %w", m.version, m.name, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+func (c sqlClient) MigrationStatuses() ([]MigrationStatus, error) {
+	applied, err := c.appliedVersions()
+	if err != nil {
+		return nil, err
+	}
+	statuses := []MigrationStatus{}
+	for _, m := range migrations {
+		statuses = append(statuses, MigrationStatus{
+			Version: m.version,
+			Name:    m.name,
+			Applied: applied[m.version],
+		})
+	}
+	return statuses, nil
+}
+
+func (c sqlClient) runMigration(m migration, step func(tx *tx) error, bookkeeping string, args ...any) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = step(tx)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(bookkeeping, args...)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func dropTables(tables ...string) func(tx *tx) error {
+	return func(tx *tx) error {
+		for _, table := range tables {
+			_, err := tx.Exec("DROP TABLE IF EXISTS " + table)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// migrateInitialSchema creates the schema that used to be built on every
+// start. Databases created before migrations existed already have some of
+// these tables, possibly without the newer columns, so it only fills in
+// what's missing.
+func migrateInitialSchema(tx *tx) error {
+	userTable := `
+	CREATE TABLE IF NOT EXISTS users (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		password TEXT NOT NULL,
+		email TEXT UNIQUE NOT NULL
+	);
+	`
+	_, err := tx.Exec(userTable)
+	if err != nil {
+		return err
+	}
+	refreshTokenTable := `
+	CREATE TABLE IF NOT EXISTS refresh_tokens (
+		token TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		revoked_at TIMESTAMP,
+		user_id TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = tx.Exec(refreshTokenTable)
+	if err != nil {
+		return err
+	}
+
+	videoTable := `
+	CREATE TABLE IF NOT EXISTS videos (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		title TEXT NOT NULL,
+		description TEXT,
+		thumbnail_url TEXT,
+		sprite_url TEXT,
+		sprite_vtt_url TEXT,
+		video_url TEXT,
+		hls_url TEXT,
+		processing_status TEXT NOT NULL DEFAULT '',
+		processing_error TEXT,
+		visibility TEXT NOT NULL DEFAULT 'private',
+		org_id TEXT,
+		user_id INTEGER,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	// Postgres won't create a foreign key between INTEGER and TEXT
+	// columns. 0012_videos_user_id_postgres changes the type and adds it.
+	if tx.dialect.name() == "postgres" {
+		videoTable = strings.Replace(videoTable, ",\n\t\tFOREIGN KEY(user_id) REFERENCES users(id)", "", 1)
+	}
+	_, err = tx.Exec(videoTable)
+	if err != nil {
+		return err
+	}
+	added, err := ensureColumn(tx, "videos", "processing_status", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	if added {
+		_, err = tx.Exec("UPDATE videos SET processing_status = 'ready' WHERE video_url IS NOT NULL")
+		if err != nil {
+			return err
+		}
+	}
+	_, err = ensureColumn(tx, "videos", "processing_error", "TEXT")
+	if err != nil {
+		return err
+	}
+	_, err = ensureColumn(tx, "videos", "hls_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	_, err = ensureColumn(tx, "videos", "sprite_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	_, err = ensureColumn(tx, "videos", "sprite_vtt_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	_, err = ensureColumn(tx, "videos", "visibility", "TEXT NOT NULL DEFAULT 'private'")
+	if err != nil {
+		return err
+	}
+	_, err = ensureColumn(tx, "videos", "org_id", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	uploadSessionTable := `
+	CREATE TABLE IF NOT EXISTS upload_sessions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		completed_at TIMESTAMP,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		total_size INTEGER NOT NULL,
+		content_type TEXT NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = tx.Exec(uploadSessionTable)
+	if err != nil {
+		return err
+	}
+
+	uploadChunkTable := `
+	CREATE TABLE IF NOT EXISTS upload_chunks (
+		session_id TEXT NOT NULL,
+		chunk_number INTEGER NOT NULL,
+		chunk_offset INTEGER NOT NULL,
+		size INTEGER NOT NULL,
+		PRIMARY KEY(session_id, chunk_number),
+		FOREIGN KEY(session_id) REFERENCES upload_sessions(id)
+	);
+	`
+	_, err = tx.Exec(uploadChunkTable)
+	if err != nil {
+		return err
+	}
+
+	directUploadTable := `
+	CREATE TABLE IF NOT EXISTS direct_uploads (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		completed_at TIMESTAMP,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		object_key TEXT NOT NULL,
+		multipart_upload_id TEXT,
+		content_type TEXT NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = tx.Exec(directUploadTable)
+	if err != nil {
+		return err
+	}
+
+	processingJobTable := `
+	CREATE TABLE IF NOT EXISTS processing_jobs (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		started_at TIMESTAMP,
+		video_id TEXT NOT NULL,
+		source_path TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		error TEXT,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = tx.Exec(processingJobTable)
+	if err != nil {
+		return err
+	}
+
+	videoMetadataTable := `
+	CREATE TABLE IF NOT EXISTS video_metadata (
+		video_id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		duration_seconds REAL NOT NULL,
+		width INTEGER NOT NULL,
+		height INTEGER NOT NULL,
+		video_codec TEXT NOT NULL,
+		audio_codec TEXT NOT NULL,
+		bit_rate INTEGER NOT NULL,
+		frame_rate REAL NOT NULL,
+		audio_channels INTEGER NOT NULL,
+		rotation INTEGER NOT NULL,
+		container TEXT NOT NULL,
+		size_bytes INTEGER NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = tx.Exec(videoMetadataTable)
+	if err != nil {
+		return err
+	}
+
+	videoGrantTable := `
+	CREATE TABLE IF NOT EXISTS video_grants (
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		role TEXT NOT NULL,
+		PRIMARY KEY(video_id, user_id),
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = tx.Exec(videoGrantTable)
+	if err != nil {
+		return err
+	}
+
+	organizationTable := `
+	CREATE TABLE IF NOT EXISTS organizations (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		name TEXT NOT NULL
+	);
+	`
+	_, err = tx.Exec(organizationTable)
+	if err != nil {
+		return err
+	}
+
+	organizationMemberTable := `
+	CREATE TABLE IF NOT EXISTS organization_members (
+		org_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		role TEXT NOT NULL,
+		PRIMARY KEY(org_id, user_id),
+		FOREIGN KEY(org_id) REFERENCES organizations(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = tx.Exec(organizationMemberTable)
+	if err != nil {
+		return err
+	}
+
+	organizationInvitationTable := `
+	CREATE TABLE IF NOT EXISTS organization_invitations (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		accepted_at TIMESTAMP,
+		org_id TEXT NOT NULL,
+		email TEXT NOT NULL,
+		role TEXT NOT NULL,
+		invited_by TEXT NOT NULL,
+		FOREIGN KEY(org_id) REFERENCES organizations(id),
+		FOREIGN KEY(invited_by) REFERENCES users(id)
+	);
+	`
+	_, err = tx.Exec(organizationInvitationTable)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// checkNoOwnerlessVideos fails if any video has no user_id, since the
+// column is about to become NOT NULL. Deciding who owns those videos, or
+// whether to delete them, is left to an operator rather than the migration.
+func checkNoOwnerlessVideos(tx *tx) error {
+	rows, err := tx.Query("SELECT id FROM videos WHERE user_id IS NULL ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		return fmt.Errorf(
+			"%d video(s) have no owner: %s. Set their user_id (UPDATE videos SET user_id = '<user id>' WHERE id IN (...)) or delete them, then migrate again",
+			len(ids), strings.Join(ids, ", "),
+		)
+	}
+	return nil
+}
+
+// rebuildVideosTable recreates the videos table with a new user_id column
+// type, since sqlite can't alter a column in place. Postgres gets its
+// TEXT user_id from 0012_videos_user_id_postgres instead.
+func rebuildVideosTable(tx *tx, userIDType string) error {
+	if tx.dialect.name() == "postgres" {
+		return nil
+	}
+
+	columns := []string{
+		"id",
+		"created_at",
+		"updated_at",
+		"title",
+		"description",
+		"thumbnail_url",
+		"sprite_url",
+		"sprite_vtt_url",
+		"video_url",
+		"hls_url",
+		"processing_status",
+		"processing_error",
+		"visibility",
+		"org_id",
+		"user_id",
+	}
+	videoTable := fmt.Sprintf(`
+	CREATE TABLE videos_new (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		title TEXT NOT NULL,
+		description TEXT,
+		thumbnail_url TEXT,
+		sprite_url TEXT,
+		sprite_vtt_url TEXT,
+		video_url TEXT,
+		hls_url TEXT,
+		processing_status TEXT NOT NULL DEFAULT '',
+		processing_error TEXT,
+		visibility TEXT NOT NULL DEFAULT 'private',
+		org_id TEXT,
+		user_id %s,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`, userIDType)
+	_, err := tx.Exec(videoTable)
+	if err != nil {
+		return err
+	}
+
+	columnList := strings.Join(columns, ", ")
+	_, err = tx.Exec(fmt.Sprintf(
+		"INSERT INTO videos_new (%s) SELECT %s FROM videos",
+		columnList, strings.Replace(columnList, "user_id", "CAST(user_id AS TEXT)", 1),
+	))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DROP TABLE videos")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("ALTER TABLE videos_new RENAME TO videos")
+	return err
+}
+
+// migrateVideosUserIDPostgres is 0002_videos_user_id_text for Postgres,
+// which can change the column type in place. Databases created before this
+// migration existed already have a TEXT user_id with a foreign key, so
+// every step is safe to repeat.
+func migrateVideosUserIDPostgres(tx *tx) error {
+	if tx.dialect.name() != "postgres" {
+		return nil
+	}
+	err := checkNoOwnerlessVideos(tx)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		"ALTER TABLE videos ALTER COLUMN user_id TYPE TEXT USING user_id::TEXT",
+		"ALTER TABLE videos ALTER COLUMN user_id SET NOT NULL",
+		"ALTER TABLE videos DROP CONSTRAINT IF EXISTS videos_user_id_fkey",
+		"ALTER TABLE videos ADD CONSTRAINT videos_user_id_fkey FOREIGN KEY(user_id) REFERENCES users(id)",
+	} {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashRefreshTokens replaces the stored refresh tokens with their SHA-256,
+// matching auth.HashToken, so a leaked database doesn't hand out sessions.
+func hashRefreshTokens(tx *tx) error {
+	_, err := tx.Exec("ALTER TABLE refresh_tokens RENAME COLUMN token TO token_hash")
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT token_hash FROM refresh_tokens")
+	if err != nil {
+		return err
+	}
+	tokens := []string{}
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			rows.Close()
+			return err
+		}
+		tokens = append(tokens, token)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		sum := sha256.Sum256([]byte(token))
+		_, err = tx.Exec("UPDATE refresh_tokens SET token_hash = ? WHERE token_hash = ?", hex.EncodeToString(sum[:]), token)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateProcessingJobLeases moves job sources from local paths to storage
+// keys, so any server can process any job, and adds the lease columns that
+// let a job be reclaimed only once its worker has stopped heartbeating.
+func migrateProcessingJobLeases(tx *tx) error {
+	for _, column := range []struct{ name, def string }{
+		{"source_key", "TEXT NOT NULL DEFAULT ''"},
+		{"worker_id", "TEXT"},
+		{"heartbeat_at", "TIMESTAMP"},
+	} {
+		_, err := ensureColumn(tx, "processing_jobs", column.name, column.def)
+		if err != nil {
+			return err
+		}
+	}
+
+	// A local source path can't be turned into a storage key here, and the
+	// file may not even be on this server.
+	err := failUnfinishedJobs(tx)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("ALTER TABLE processing_jobs DROP COLUMN source_path")
+	return err
+}
+
+// failUnfinishedJobs fails pending and processing jobs, and their videos,
+// whose sources are about to become unreadable.
+func failUnfinishedJobs(tx *tx) error {
+	const jobErr = "processing was interrupted by an upgrade, please upload the video again"
+	_, err := tx.Exec(`
+	UPDATE videos
+	SET processing_status = ?, processing_error = ?, updated_at = `+tx.dialect.now()+`
+	WHERE id IN (SELECT video_id FROM processing_jobs WHERE status IN (?, ?))
+	`, VideoStatusFailed, jobErr, JobStatusPending, JobStatusProcessing)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+	UPDATE processing_jobs
+	SET status = ?, error = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE status IN (?, ?)
+	`, JobStatusFailed, jobErr, JobStatusPending, JobStatusProcessing)
+	return err
+}
+
+// alterByteCountColumns changes the type of the columns holding byte counts
+// and offsets, which outgrow Postgres' 4-byte INTEGER past 2 GiB. sqlite
+// integers are always 64-bit, so there's nothing to do there.
+func alterByteCountColumns(tx *tx, columnType string) error {
+	if tx.dialect.name() != "postgres" {
+		return nil
+	}
+	for _, column := range []struct{ table, name string }{
+		{"upload_sessions", "total_size"},
+		{"upload_chunks", "chunk_offset"},
+		{"upload_chunks", "size"},
+		{"video_metadata", "bit_rate"},
+		{"video_metadata", "size_bytes"},
+	} {
+		_, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s", column.table, column.name, columnType))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateVideoSearch indexes video titles and descriptions. sqlite gets an
+// FTS5 table kept in sync by triggers; Postgres an expression index that
+// SearchVideos' tsvector matches. sqlite built without FTS5 gets no index
+// until Migrate next runs with it, and SearchVideos falls back to LIKE.
+func migrateVideoSearch(tx *tx) error {
+	if tx.dialect.name() == "postgres" {
+		_, err := tx.Exec(`
+		CREATE INDEX IF NOT EXISTS videos_search_idx ON videos
+		USING GIN (to_tsvector('english', title || ' ' || COALESCE(description, '')))
+		`)
+		return err
+	}
+	return ensureVideoFTS(tx)
+}
+
+// ensureVideoFTS creates the sqlite FTS5 index and its triggers if they're
+// missing and sqlite has FTS5, filling a new index from the videos table.
+func ensureVideoFTS(tx *tx) error {
+	fts5, err := sqliteHasFTS5(tx)
+	if err != nil || !fts5 {
+		return err
+	}
+	existing, err := videoFTSExists(tx)
+	if err != nil {
+		return err
+	}
+
+	stmts := []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS videos_fts USING fts5(
+			video_id UNINDEXED,
+			title,
+			description
+		)`,
+		`CREATE TRIGGER IF NOT EXISTS videos_fts_insert AFTER INSERT ON videos BEGIN
+			INSERT INTO videos_fts (video_id, title, description)
+			VALUES (new.id, new.title, COALESCE(new.description, ''));
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS videos_fts_update AFTER UPDATE OF title, description ON videos BEGIN
+			UPDATE videos_fts
+			SET title = new.title, description = COALESCE(new.description, '')
+			WHERE video_id = new.id;
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS videos_fts_delete AFTER DELETE ON videos BEGIN
+			DELETE FROM videos_fts WHERE video_id = old.id;
+		END`,
+	}
+	if !existing {
+		stmts = append(stmts, `INSERT INTO videos_fts (video_id, title, description)
+		SELECT id, title, COALESCE(description, '') FROM videos`)
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateRefreshTokenFamilies adds token families for rotation. Each
+// existing token becomes a family of its own.
+func migrateRefreshTokenFamilies(tx *tx) error {
+	for _, column := range []struct{ name, def string }{
+		{"family_id", "TEXT"},
+		{"rotated_at", "TIMESTAMP"},
+	} {
+		_, err := ensureColumn(tx, "refresh_tokens", column.name, column.def)
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query("SELECT token FROM refresh_tokens WHERE family_id IS NULL")
+	if err != nil {
+		return err
+	}
+	tokens := []string{}
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			rows.Close()
+			return err
+		}
+		tokens = append(tokens, token)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		_, err = tx.Exec("UPDATE refresh_tokens SET family_id = ? WHERE token = ?", uuid.New(), token)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("CREATE INDEX IF NOT EXISTS refresh_tokens_family_id ON refresh_tokens (family_id)")
+	return err
+}
+
+// migrateSessions adds a session for every refresh token family, so logins
+// from before sessions were tracked can still be listed and revoked.
+func migrateSessions(tx *tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		user_agent TEXT NOT NULL DEFAULT '',
+		ip_address TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		last_used_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("CREATE INDEX IF NOT EXISTS sessions_user_id ON sessions (user_id)")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+	INSERT INTO sessions (id, user_id, created_at, last_used_at)
+	SELECT family_id, MIN(user_id), MIN(created_at), MAX(created_at)
+	FROM refresh_tokens
+	WHERE family_id NOT IN (SELECT id FROM sessions)
+	GROUP BY family_id
+	`)
+	return err
+}
+
+// ensureColumn adds a column to an existing table if it isn't there yet,
+// since CREATE TABLE IF NOT EXISTS leaves older databases untouched. It
+// reports whether the column was added.
+func ensureColumn(tx *tx, table, column, definition string) (bool, error) {
+	exists, err := tx.dialect.columnExists(tx, table, column)
+	if err != nil || exists {
+		return false, err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
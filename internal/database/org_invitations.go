@@ -0,0 +1,190 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type OrgInvitation struct {
+	ID         uuid.UUID  `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	AcceptedAt *time.Time `json:"accepted_at"`
+	OrgName    string     `json:"org_name"`
+	CreateOrgInvitationParams
+}
+
+type CreateOrgInvitationParams struct {
+	OrgID     uuid.UUID `json:"org_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	InvitedBy uuid.UUID `json:"invited_by"`
+}
+
+const orgInvitationSelect = `
+	SELECT
+		i.id,
+		i.created_at,
+		i.expires_at,
+		i.accepted_at,
+		o.name,
+		i.org_id,
+		i.email,
+		i.role,
+		i.invited_by
+	FROM organization_invitations i
+	JOIN organizations o ON o.id = i.org_id
+`
+
+func scanOrgInvitation(row rowScanner) (OrgInvitation, error) {
+	var invitation OrgInvitation
+	err := row.Scan(
+		&invitation.ID,
+		&invitation.CreatedAt,
+		&invitation.ExpiresAt,
+		&invitation.AcceptedAt,
+		&invitation.OrgName,
+		&invitation.OrgID,
+		&invitation.Email,
+		&invitation.Role,
+		&invitation.InvitedBy,
+	)
+	return invitation, err
+}
+
+func (c sqlClient) CreateOrgInvitation(params CreateOrgInvitationParams, expiresAt time.Time) (OrgInvitation, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO organization_invitations (
+		id,
+		created_at,
+		updated_at,
+		expires_at,
+		org_id,
+		email,
+		role,
+		invited_by
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, id, expiresAt, params.OrgID, strings.ToLower(params.Email), params.Role, params.InvitedBy)
+	if err != nil {
+		return OrgInvitation{}, err
+	}
+	return c.GetOrgInvitation(id)
+}
+
+func (c sqlClient) GetOrgInvitation(id uuid.UUID) (OrgInvitation, error) {
+	query := orgInvitationSelect + `
+	WHERE i.id = ?
+	`
+	invitation, err := scanOrgInvitation(c.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return OrgInvitation{}, nil
+		}
+		return OrgInvitation{}, err
+	}
+	return invitation, nil
+}
+
+// GetPendingOrgInvitations returns unaccepted, unexpired invitations for an
+// organization.
+func (c sqlClient) GetPendingOrgInvitations(orgID uuid.UUID) ([]OrgInvitation, error) {
+	query := orgInvitationSelect + `
+	WHERE i.org_id = ? AND i.accepted_at IS NULL AND i.expires_at > ?
+	ORDER BY i.created_at
+	`
+	return c.queryOrgInvitations(query, orgID, time.Now().UTC())
+}
+
+// GetPendingInvitationsForEmail returns the unaccepted, unexpired
+// invitations sent to an email address, ignoring case.
+func (c sqlClient) GetPendingInvitationsForEmail(email string) ([]OrgInvitation, error) {
+	query := orgInvitationSelect + `
+	WHERE LOWER(i.email) = LOWER(?) AND i.accepted_at IS NULL AND i.expires_at > ?
+	ORDER BY i.created_at
+	`
+	return c.queryOrgInvitations(query, email, time.Now().UTC())
+}
+
+func (c sqlClient) queryOrgInvitations(query string, args ...any) ([]OrgInvitation, error) {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []OrgInvitation{}
+	for rows.Next() {
+		invitation, err := scanOrgInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, invitation)
+	}
+	return invitations, rows.Err()
+}
+
+// AcceptOrgInvitation marks the invitation accepted and adds the user to
+// the organization with the invited role. Existing members are only ever
+// promoted, so accepting can't demote anyone or remove the last admin.
+func (c sqlClient) AcceptOrgInvitation(invitation OrgInvitation, userID uuid.UUID) (OrgMember, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return OrgMember{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	UPDATE organization_invitations
+	SET accepted_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`, invitation.ID)
+	if err != nil {
+		return OrgMember{}, err
+	}
+
+	var currentRole string
+	err = tx.QueryRow(`
+	SELECT role FROM organization_members
+	WHERE org_id = ? AND user_id = ?
+	`+tx.dialect.forUpdate(), invitation.OrgID, userID).Scan(&currentRole)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return OrgMember{}, err
+	}
+	role := invitation.Role
+	if orgRoleRanks[currentRole] > orgRoleRanks[role] {
+		role = currentRole
+	}
+
+	_, err = tx.Exec(`
+	INSERT INTO organization_members (
+		org_id,
+		user_id,
+		created_at,
+		updated_at,
+		role
+	) VALUES (?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?)
+	ON CONFLICT(org_id, user_id) DO UPDATE SET
+		updated_at = CURRENT_TIMESTAMP,
+		role = excluded.role
+	`, invitation.OrgID, userID, role)
+	if err != nil {
+		return OrgMember{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return OrgMember{}, err
+	}
+
+	return c.GetOrgMember(invitation.OrgID, userID)
+}
+
+func (c sqlClient) DeleteOrgInvitation(id uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM organization_invitations WHERE id = ?", id)
+	return err
+}
@@ -0,0 +1,230 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Organization member roles.
+const (
+	OrgRoleAdmin  = "admin"
+	OrgRoleEditor = "editor"
+	OrgRoleViewer = "viewer"
+)
+
+func ValidOrgRole(role string) bool {
+	switch role {
+	case OrgRoleAdmin, OrgRoleEditor, OrgRoleViewer:
+		return true
+	}
+	return false
+}
+
+var orgRoleRanks = map[string]int{
+	OrgRoleViewer: 1,
+	OrgRoleEditor: 2,
+	OrgRoleAdmin:  3,
+}
+
+type Organization struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Name      string    `json:"name"`
+	// Role is the requesting user's role when listing their organizations.
+	Role string `json:"role,omitempty"`
+}
+
+type OrgMember struct {
+	OrgID     uuid.UUID `json:"org_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CreateOrganization creates an organization with creatorID as its first
+// admin.
+func (c sqlClient) CreateOrganization(name string, creatorID uuid.UUID) (Organization, error) {
+	id := uuid.New()
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return Organization{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	INSERT INTO organizations (
+		id,
+		created_at,
+		updated_at,
+		name
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?)
+	`, id, name)
+	if err != nil {
+		return Organization{}, err
+	}
+	_, err = tx.Exec(`
+	INSERT INTO organization_members (
+		org_id,
+		user_id,
+		created_at,
+		updated_at,
+		role
+	) VALUES (?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?)
+	`, id, creatorID, OrgRoleAdmin)
+	if err != nil {
+		return Organization{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return Organization{}, err
+	}
+
+	return c.GetOrganization(id)
+}
+
+func (c sqlClient) GetOrganization(id uuid.UUID) (Organization, error) {
+	query := `
+	SELECT id, created_at, updated_at, name
+	FROM organizations
+	WHERE id = ?
+	`
+	var org Organization
+	err := c.db.QueryRow(query, id).Scan(&org.ID, &org.CreatedAt, &org.UpdatedAt, &org.Name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Organization{}, nil
+		}
+		return Organization{}, err
+	}
+	return org, nil
+}
+
+// GetUserOrganizations returns the organizations a user belongs to, with
+// their role in each.
+func (c sqlClient) GetUserOrganizations(userID uuid.UUID) ([]Organization, error) {
+	query := `
+	SELECT o.id, o.created_at, o.updated_at, o.name, m.role
+	FROM organizations o
+	JOIN organization_members m ON m.org_id = o.id
+	WHERE m.user_id = ?
+	ORDER BY o.name
+	`
+	rows, err := c.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orgs := []Organization{}
+	for rows.Next() {
+		var org Organization
+		err := rows.Scan(&org.ID, &org.CreatedAt, &org.UpdatedAt, &org.Name, &org.Role)
+		if err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, org)
+	}
+	return orgs, rows.Err()
+}
+
+const orgMemberSelect = `
+	SELECT
+		m.org_id,
+		m.user_id,
+		u.email,
+		m.role,
+		m.created_at,
+		m.updated_at
+	FROM organization_members m
+	JOIN users u ON u.id = m.user_id
+`
+
+func scanOrgMember(row rowScanner) (OrgMember, error) {
+	var member OrgMember
+	err := row.Scan(
+		&member.OrgID,
+		&member.UserID,
+		&member.Email,
+		&member.Role,
+		&member.CreatedAt,
+		&member.UpdatedAt,
+	)
+	return member, err
+}
+
+func (c sqlClient) GetOrgMember(orgID, userID uuid.UUID) (OrgMember, error) {
+	query := orgMemberSelect + `
+	WHERE m.org_id = ? AND m.user_id = ?
+	`
+	member, err := scanOrgMember(c.db.QueryRow(query, orgID, userID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return OrgMember{}, nil
+		}
+		return OrgMember{}, err
+	}
+	return member, nil
+}
+
+func (c sqlClient) GetOrgMembers(orgID uuid.UUID) ([]OrgMember, error) {
+	query := orgMemberSelect + `
+	WHERE m.org_id = ?
+	ORDER BY u.email
+	`
+	rows, err := c.db.Query(query, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []OrgMember{}
+	for rows.Next() {
+		member, err := scanOrgMember(rows)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+func (c sqlClient) UpsertOrgMember(orgID, userID uuid.UUID, role string) (OrgMember, error) {
+	query := `
+	INSERT INTO organization_members (
+		org_id,
+		user_id,
+		created_at,
+		updated_at,
+		role
+	) VALUES (?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?)
+	ON CONFLICT(org_id, user_id) DO UPDATE SET
+		updated_at = CURRENT_TIMESTAMP,
+		role = excluded.role
+	`
+	_, err := c.db.Exec(query, orgID, userID, role)
+	if err != nil {
+		return OrgMember{}, err
+	}
+	return c.GetOrgMember(orgID, userID)
+}
+
+func (c sqlClient) DeleteOrgMember(orgID, userID uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM organization_members WHERE org_id = ? AND user_id = ?", orgID, userID)
+	return err
+}
+
+func (c sqlClient) CountOrgAdmins(orgID uuid.UUID) (int, error) {
+	var count int
+	err := c.db.QueryRow(
+		"SELECT COUNT(*) FROM organization_members WHERE org_id = ? AND role = ?",
+		orgID, OrgRoleAdmin,
+	).Scan(&count)
+	return count, err
+}
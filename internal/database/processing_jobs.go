@@ -0,0 +1,240 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	JobStatusPending    = "pending"
+	JobStatusProcessing = "processing"
+	JobStatusDone       = "done"
+	JobStatusFailed     = "failed"
+)
+
+// ProcessingJobLease is how long a claimed job stays with its worker without
+// a heartbeat. After that the worker is presumed dead and any worker, on any
+// server, can claim the job again.
+const ProcessingJobLease = 2 * time.Minute
+
+type ProcessingJob struct {
+	ID          uuid.UUID  `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	StartedAt   *time.Time `json:"started_at"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	Error       *string    `json:"error"`
+	WorkerID    *string    `json:"worker_id"`
+	HeartbeatAt *time.Time `json:"heartbeat_at"`
+	CreateProcessingJobParams
+}
+
+// CreateProcessingJobParams describe a job. The source is an object in
+// storage rather than a local file, so whichever server claims the job can
+// read it.
+type CreateProcessingJobParams struct {
+	VideoID     uuid.UUID `json:"video_id"`
+	SourceKey   string    `json:"source_key"`
+	ContentType string    `json:"content_type"`
+}
+
+const processingJobColumns = `
+		id,
+		created_at,
+		updated_at,
+		started_at,
+		status,
+		attempts,
+		error,
+		worker_id,
+		heartbeat_at,
+		video_id,
+		source_key,
+		content_type
+`
+
+// CreateProcessingJob queues a job and marks its video as pending.
+func (c sqlClient) CreateProcessingJob(params CreateProcessingJobParams) (ProcessingJob, error) {
+	id, err := createProcessingJob(c.db, c.db.dialect, params)
+	if err != nil {
+		return ProcessingJob{}, err
+	}
+	return c.GetProcessingJob(id)
+}
+
+// createProcessingJob is CreateProcessingJob for use inside a transaction
+// that completes whatever upload the job's source came from.
+func createProcessingJob(db execer, d dialect, params CreateProcessingJobParams) (uuid.UUID, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO processing_jobs (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		source_key,
+		content_type,
+		status
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`
+	_, err := db.Exec(query, id, params.VideoID, params.SourceKey, params.ContentType, JobStatusPending)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	query = `
+	UPDATE videos
+	SET
+		processing_status = ?,
+		processing_error = NULL,
+		updated_at = ` + d.now() + `
+	WHERE id = ?
+	`
+	_, err = db.Exec(query, VideoStatusPending, params.VideoID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return id, nil
+}
+
+func (c sqlClient) GetProcessingJob(id uuid.UUID) (ProcessingJob, error) {
+	query := `SELECT ` + processingJobColumns + ` FROM processing_jobs WHERE id = ?`
+	return scanProcessingJob(c.db.QueryRow(query, id))
+}
+
+// ClaimProcessingJob gives workerID the oldest job that is ready: a pending
+// one, or one whose worker stopped heartbeating for ProcessingJobLease.
+// Retried jobs wait 30 seconds after their last failure. It returns a zero
+// ProcessingJob when no job is ready.
+func (c sqlClient) ClaimProcessingJob(workerID string) (ProcessingJob, error) {
+	ready := `(
+		(status = ? AND (attempts = 0 OR updated_at <= ` + c.db.dialect.secondsAgo(30) + `))
+		OR (status = ? AND heartbeat_at <= ` + c.db.dialect.secondsAgo(int(ProcessingJobLease.Seconds())) + `)
+	)`
+	// The condition is repeated outside the subquery so that of two workers
+	// picking the same job, the second one's update matches nothing.
+	query := `
+	UPDATE processing_jobs
+	SET
+		status = ?,
+		attempts = attempts + 1,
+		worker_id = ?,
+		heartbeat_at = CURRENT_TIMESTAMP,
+		started_at = CURRENT_TIMESTAMP,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = (
+		SELECT id FROM processing_jobs
+		WHERE ` + ready + `
+		ORDER BY created_at ASC
+		LIMIT 1
+	) AND ` + ready + `
+	RETURNING ` + processingJobColumns
+	job, err := scanProcessingJob(c.db.QueryRow(query,
+		JobStatusProcessing, workerID,
+		JobStatusPending, JobStatusProcessing,
+		JobStatusPending, JobStatusProcessing,
+	))
+	if err != nil || job.ID == uuid.Nil {
+		return job, err
+	}
+
+	err = c.SetVideoProcessingStatus(job.VideoID, VideoStatusProcessing, nil)
+	if err != nil {
+		return ProcessingJob{}, err
+	}
+	return job, nil
+}
+
+// HeartbeatProcessingJob renews job's lease. It reports false if the job
+// isn't job.WorkerID's anymore, in which case the worker should stop.
+func (c sqlClient) HeartbeatProcessingJob(job ProcessingJob) (bool, error) {
+	query := `
+	UPDATE processing_jobs
+	SET heartbeat_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND worker_id = ? AND status = ?
+	`
+	return c.updateClaimedJob(query, job.ID, job.WorkerID, JobStatusProcessing)
+}
+
+// FinishProcessingJob marks job done. Like FailProcessingJob, it reports
+// false and changes nothing if the job's lease was lost to another worker.
+func (c sqlClient) FinishProcessingJob(job ProcessingJob) (bool, error) {
+	query := `
+	UPDATE processing_jobs
+	SET
+		status = ?,
+		error = NULL,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND worker_id = ? AND status = ?
+	`
+	return c.updateClaimedJob(query, JobStatusDone, job.ID, job.WorkerID, JobStatusProcessing)
+}
+
+// FailProcessingJob records a failed attempt. Jobs that may be retried go
+// back to pending; otherwise the job and its video are marked failed.
+func (c sqlClient) FailProcessingJob(job ProcessingJob, jobErr string, retry bool) (bool, error) {
+	status := JobStatusFailed
+	if retry {
+		status = JobStatusPending
+	}
+	query := `
+	UPDATE processing_jobs
+	SET
+		status = ?,
+		error = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND worker_id = ? AND status = ?
+	`
+	owned, err := c.updateClaimedJob(query, status, jobErr, job.ID, job.WorkerID, JobStatusProcessing)
+	if err != nil || !owned {
+		return owned, err
+	}
+
+	if retry {
+		return true, c.SetVideoProcessingStatus(job.VideoID, VideoStatusPending, nil)
+	}
+	return true, c.SetVideoProcessingStatus(job.VideoID, VideoStatusFailed, &jobErr)
+}
+
+// updateClaimedJob runs an update conditioned on the job's lease and
+// reports whether it matched.
+func (c sqlClient) updateClaimedJob(query string, args ...any) (bool, error) {
+	result, err := c.db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+func scanProcessingJob(row *sql.Row) (ProcessingJob, error) {
+	var job ProcessingJob
+	err := row.Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.StartedAt,
+		&job.Status,
+		&job.Attempts,
+		&job.Error,
+		&job.WorkerID,
+		&job.HeartbeatAt,
+		&job.VideoID,
+		&job.SourceKey,
+		&job.ContentType,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ProcessingJob{}, nil
+		}
+		return ProcessingJob{}, err
+	}
+	return job, nil
+}
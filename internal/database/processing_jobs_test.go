@@ -0,0 +1,199 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestClaimProcessingJob(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, c sqlClient) {
+		user := createTestUser(t, c)
+		jobIDs := map[uuid.UUID]bool{}
+		for _, title := range []string{"one", "two"} {
+			video := createTestVideo(t, c, user.ID, title)
+			job, err := c.CreateProcessingJob(CreateProcessingJobParams{
+				VideoID:     video.ID,
+				SourceKey:   "uploads/" + title,
+				ContentType: "video/mp4",
+			})
+			if err != nil {
+				t.Fatalf("CreateProcessingJob: %v", err)
+			}
+			jobIDs[job.ID] = true
+		}
+
+		var claimed []ProcessingJob
+		for range jobIDs {
+			job, err := c.ClaimProcessingJob("worker")
+			if err != nil {
+				t.Fatalf("ClaimProcessingJob: %v", err)
+			}
+			if !jobIDs[job.ID] {
+				t.Fatalf("ClaimProcessingJob returned job %v, want one of the pending jobs", job.ID)
+			}
+			delete(jobIDs, job.ID)
+			if job.Status != JobStatusProcessing || job.Attempts != 1 || job.StartedAt == nil || job.WorkerID == nil || *job.WorkerID != "worker" {
+				t.Errorf("claimed job = %+v, want it processing on its first attempt", job)
+			}
+			video, err := c.GetVideo(job.VideoID)
+			if err != nil {
+				t.Fatalf("GetVideo: %v", err)
+			}
+			if video.ProcessingStatus != VideoStatusProcessing {
+				t.Errorf("video status = %q, want %q", video.ProcessingStatus, VideoStatusProcessing)
+			}
+			claimed = append(claimed, job)
+		}
+
+		job, err := c.ClaimProcessingJob("worker")
+		if err != nil {
+			t.Fatalf("ClaimProcessingJob with nothing pending: %v", err)
+		}
+		if job.ID != uuid.Nil {
+			t.Errorf("ClaimProcessingJob claimed job %v twice", job.ID)
+		}
+
+		// A failed job goes back to pending but waits before its retry.
+		owned, err := c.FailProcessingJob(claimed[0], "boom", true)
+		if err != nil || !owned {
+			t.Fatalf("FailProcessingJob = %v, %v; want it to own the job", owned, err)
+		}
+		job, err = c.ClaimProcessingJob("worker")
+		if err != nil {
+			t.Fatalf("ClaimProcessingJob after a failure: %v", err)
+		}
+		if job.ID != uuid.Nil {
+			t.Error("ClaimProcessingJob retried a job without waiting")
+		}
+		retry, err := c.GetProcessingJob(claimed[0].ID)
+		if err != nil {
+			t.Fatalf("GetProcessingJob: %v", err)
+		}
+		if retry.Status != JobStatusPending || retry.Error == nil || *retry.Error != "boom" {
+			t.Errorf("failed job = %+v, want it pending with its error", retry)
+		}
+	})
+}
+
+func TestProcessingJobLease(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, c sqlClient) {
+		user := createTestUser(t, c)
+		video := createTestVideo(t, c, user.ID, "video")
+		created, err := c.CreateProcessingJob(CreateProcessingJobParams{
+			VideoID:     video.ID,
+			SourceKey:   "uploads/video",
+			ContentType: "video/mp4",
+		})
+		if err != nil {
+			t.Fatalf("CreateProcessingJob: %v", err)
+		}
+		refs, err := c.GetReferencedFiles()
+		if err != nil {
+			t.Fatalf("GetReferencedFiles: %v", err)
+		}
+		if len(refs.UploadKeys) != 1 || refs.UploadKeys[0] != "uploads/video" {
+			t.Errorf("referenced upload keys = %v, want the pending job's source", refs.UploadKeys)
+		}
+
+		first, err := c.ClaimProcessingJob("first")
+		if err != nil || first.ID != created.ID {
+			t.Fatalf("ClaimProcessingJob = %+v, %v; want the job", first, err)
+		}
+		// A job with a live lease isn't reclaimed, by another server or
+		// after a restart.
+		job, err := c.ClaimProcessingJob("second")
+		if err != nil || job.ID != uuid.Nil {
+			t.Fatalf("ClaimProcessingJob = %+v, %v; want nothing while the lease is held", job, err)
+		}
+		owned, err := c.HeartbeatProcessingJob(first)
+		if err != nil || !owned {
+			t.Fatalf("HeartbeatProcessingJob = %v, %v; want the lease renewed", owned, err)
+		}
+
+		// The first worker dies and its lease runs out.
+		_, err = c.db.Exec("UPDATE processing_jobs SET heartbeat_at = "+c.db.dialect.secondsAgo(int(ProcessingJobLease.Seconds())+1)+" WHERE id = ?", first.ID)
+		if err != nil {
+			t.Fatalf("expiring lease: %v", err)
+		}
+		second, err := c.ClaimProcessingJob("second")
+		if err != nil || second.ID != created.ID {
+			t.Fatalf("ClaimProcessingJob = %+v, %v; want the abandoned job", second, err)
+		}
+		if second.Attempts != 2 || *second.WorkerID != "second" {
+			t.Errorf("reclaimed job = %+v, want its second attempt by the second worker", second)
+		}
+
+		// Should the first worker come back, it has lost the job.
+		owned, err = c.HeartbeatProcessingJob(first)
+		if err != nil || owned {
+			t.Errorf("HeartbeatProcessingJob = %v, %v; want the lease lost", owned, err)
+		}
+		owned, err = c.FinishProcessingJob(first)
+		if err != nil || owned {
+			t.Errorf("FinishProcessingJob = %v, %v; want the lease lost", owned, err)
+		}
+		owned, err = c.FailProcessingJob(first, "boom", false)
+		if err != nil || owned {
+			t.Errorf("FailProcessingJob = %v, %v; want the lease lost", owned, err)
+		}
+
+		owned, err = c.FinishProcessingJob(second)
+		if err != nil || !owned {
+			t.Fatalf("FinishProcessingJob = %v, %v; want the job finished", owned, err)
+		}
+		job, err = c.GetProcessingJob(created.ID)
+		if err != nil {
+			t.Fatalf("GetProcessingJob: %v", err)
+		}
+		if job.Status != JobStatusDone {
+			t.Errorf("job status = %q, want %q", job.Status, JobStatusDone)
+		}
+		refs, err = c.GetReferencedFiles()
+		if err != nil {
+			t.Fatalf("GetReferencedFiles: %v", err)
+		}
+		if len(refs.UploadKeys) != 0 {
+			t.Errorf("referenced upload keys = %v, want none once the job is done", refs.UploadKeys)
+		}
+	})
+}
+
+func TestMigrateFailsLocalSourceJobs(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, c sqlClient) {
+		user := createTestUser(t, c)
+		video := createTestVideo(t, c, user.ID, "video")
+		// Back to just before processing_job_leases.
+		_, err := c.Rollback(len(migrations) - 14)
+		if err != nil {
+			t.Fatalf("Rollback: %v", err)
+		}
+		jobID := uuid.New()
+		_, err = c.db.Exec(`
+			INSERT INTO processing_jobs (id, video_id, source_path, content_type, status)
+			VALUES (?, ?, ?, ?, ?)
+		`, jobID, video.ID, "/tmp/upload.mp4", "video/mp4", JobStatusProcessing)
+		if err != nil {
+			t.Fatalf("inserting job: %v", err)
+		}
+
+		_, err = c.Migrate()
+		if err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+		job, err := c.GetProcessingJob(jobID)
+		if err != nil {
+			t.Fatalf("GetProcessingJob: %v", err)
+		}
+		if job.Status != JobStatusFailed || job.Error == nil {
+			t.Errorf("job = %+v, want it failed with an error", job)
+		}
+		video, err = c.GetVideo(video.ID)
+		if err != nil {
+			t.Fatalf("GetVideo: %v", err)
+		}
+		if video.ProcessingStatus != VideoStatusFailed || video.ProcessingError == nil {
+			t.Errorf("video status = %q, want %q with an error", video.ProcessingStatus, VideoStatusFailed)
+		}
+	})
+}
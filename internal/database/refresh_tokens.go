@@ -7,57 +7,120 @@ import (
 	"github.com/google/uuid"
 )
 
+// RefreshToken is single use: refreshing rotates it into a new token in the
+// same family. A family is one login, so presenting an already rotated
+// token means it leaked, and the whole family is revoked. Only a hash of
+// the token is stored, the same way as API keys and mailed tokens.
 type RefreshToken struct {
 	CreateRefreshTokenParams
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	RevokedAt *time.Time `json:"revoked_at"`
+	RotatedAt *time.Time `json:"rotated_at"`
 }
 
 type CreateRefreshTokenParams struct {
-	Token     string    `json:"token"`
+	TokenHash string    `json:"-"`
+	FamilyID  uuid.UUID `json:"family_id"`
 	UserID    uuid.UUID `json:"user_id"`
 	ExpiresAt time.Time `json:"expires_at"`
 }
 
-func (c Client) CreateRefreshToken(params CreateRefreshTokenParams) (RefreshToken, error) {
+// Valid reports whether the token can still be exchanged for a new one.
+func (rt RefreshToken) Valid() bool {
+	return rt.TokenHash != "" && rt.RevokedAt == nil && rt.RotatedAt == nil && time.Now().Before(rt.ExpiresAt)
+}
+
+func (c sqlClient) CreateRefreshToken(params CreateRefreshTokenParams) (RefreshToken, error) {
+	err := createRefreshToken(c.db, params)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	return c.GetRefreshToken(params.TokenHash)
+}
+
+func createRefreshToken(db execer, params CreateRefreshTokenParams) error {
 	query := `
 		INSERT INTO refresh_tokens (
-			token,
+			token_hash,
 			created_at,
 			updated_at,
+			family_id,
 			user_id,
 			expires_at
-		) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
+		) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, params.Token, params.UserID.String(), params.ExpiresAt)
+	_, err := db.Exec(query, params.TokenHash, params.FamilyID, params.UserID.String(), params.ExpiresAt.UTC())
+	return err
+}
+
+// RotateRefreshToken marks the token as used and issues next in its family.
+// It reports false without issuing anything if the token was already rotated
+// or revoked, which happens when two refreshes race with the same token.
+func (c sqlClient) RotateRefreshToken(tokenHash string, next CreateRefreshTokenParams) (bool, error) {
+	tx, err := c.db.Begin()
 	if err != nil {
-		return RefreshToken{}, err
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE refresh_tokens
+		SET rotated_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE token_hash = ? AND family_id = ? AND rotated_at IS NULL AND revoked_at IS NULL
+	`, tokenHash, next.FamilyID)
+	if err != nil {
+		return false, err
 	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if rows == 0 {
+		return false, nil
+	}
+
+	err = createRefreshToken(tx, next)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
 
-	return c.GetRefreshToken(params.Token)
+// RevokeRefreshToken revokes the token along with the rest of its family, so
+// logging out also invalidates tokens it was rotated from.
+func (c sqlClient) RevokeRefreshToken(tokenHash string) error {
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE family_id = (SELECT family_id FROM refresh_tokens WHERE token_hash = ?)
+		AND revoked_at IS NULL
+	`
+	_, err := c.db.Exec(query, tokenHash)
+	return err
 }
 
-func (c Client) RevokeRefreshToken(token string) error {
+func (c sqlClient) RevokeRefreshTokenFamily(familyID uuid.UUID) error {
 	query := `
 		UPDATE refresh_tokens
-		SET revoked_at = CURRENT_TIMESTAMP
-		WHERE token = ?
+		SET revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE family_id = ? AND revoked_at IS NULL
 	`
-	_, err := c.db.Exec(query, token)
+	_, err := c.db.Exec(query, familyID)
 	return err
 }
 
-func (c Client) GetRefreshToken(token string) (RefreshToken, error) {
+func (c sqlClient) GetRefreshToken(tokenHash string) (RefreshToken, error) {
 	query := `
-		SELECT token, created_at, updated_at, user_id, expires_at, revoked_at
+		SELECT token_hash, created_at, updated_at, family_id, user_id, expires_at, revoked_at, rotated_at
 		FROM refresh_tokens
-		WHERE token = ?
+		WHERE token_hash = ?
 	`
 	var rt RefreshToken
 	var userID string
-	err := c.db.QueryRow(query, token).
-		Scan(&rt.Token, &rt.CreatedAt, &rt.UpdatedAt, &userID, &rt.ExpiresAt, &rt.RevokedAt)
+	err := c.db.QueryRow(query, tokenHash).
+		Scan(&rt.TokenHash, &rt.CreatedAt, &rt.UpdatedAt, &rt.FamilyID, &userID, &rt.ExpiresAt, &rt.RevokedAt, &rt.RotatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return RefreshToken{}, nil
@@ -72,12 +135,3 @@ func (c Client) GetRefreshToken(token string) (RefreshToken, error) {
 
 	return rt, nil
 }
-
-func (c Client) DeleteRefreshToken(token string) error {
-	query := `
-		DELETE FROM refresh_tokens
-		WHERE token = ?
-	`
-	_, err := c.db.Exec(query, token)
-	return err
-}
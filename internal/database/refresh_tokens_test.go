@@ -0,0 +1,131 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestRotateRefreshToken(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, c sqlClient) {
+		user := createTestUser(t, c)
+		familyID := uuid.New()
+		expiresAt := time.Now().Add(time.Hour)
+		newToken := func(tokenHash string) CreateRefreshTokenParams {
+			return CreateRefreshTokenParams{
+				TokenHash: tokenHash,
+				FamilyID:  familyID,
+				UserID:    user.ID,
+				ExpiresAt: expiresAt,
+			}
+		}
+
+		_, err := c.CreateRefreshToken(newToken("first"))
+		if err != nil {
+			t.Fatalf("CreateRefreshToken: %v", err)
+		}
+
+		rotated, err := c.RotateRefreshToken("first", newToken("second"))
+		if err != nil {
+			t.Fatalf("RotateRefreshToken: %v", err)
+		}
+		if !rotated {
+			t.Fatal("RotateRefreshToken didn't rotate a valid token")
+		}
+		first, err := c.GetRefreshToken("first")
+		if err != nil {
+			t.Fatalf("GetRefreshToken: %v", err)
+		}
+		if first.RotatedAt == nil || first.Valid() {
+			t.Error("rotated token is still valid")
+		}
+		second, err := c.GetRefreshToken("second")
+		if err != nil {
+			t.Fatalf("GetRefreshToken: %v", err)
+		}
+		if !second.Valid() || second.FamilyID != familyID || second.UserID != user.ID {
+			t.Errorf("new token = %+v, want a valid token in the same family", second)
+		}
+
+		// Reusing the old token, as a racing refresh or a thief would.
+		rotated, err = c.RotateRefreshToken("first", newToken("third"))
+		if err != nil {
+			t.Fatalf("RotateRefreshToken with a used token: %v", err)
+		}
+		if rotated {
+			t.Error("RotateRefreshToken rotated an already used token")
+		}
+		third, err := c.GetRefreshToken("third")
+		if err != nil {
+			t.Fatalf("GetRefreshToken: %v", err)
+		}
+		if third.TokenHash != "" {
+			t.Error("a token was issued for a reused token")
+		}
+
+		// The family has to match, so a token can't be moved into another.
+		other := newToken("fourth")
+		other.FamilyID = uuid.New()
+		rotated, err = c.RotateRefreshToken("second", other)
+		if err != nil {
+			t.Fatalf("RotateRefreshToken into another family: %v", err)
+		}
+		if rotated {
+			t.Error("RotateRefreshToken rotated a token into another family")
+		}
+
+		err = c.RevokeRefreshTokenFamily(familyID)
+		if err != nil {
+			t.Fatalf("RevokeRefreshTokenFamily: %v", err)
+		}
+		rotated, err = c.RotateRefreshToken("second", newToken("fifth"))
+		if err != nil {
+			t.Fatalf("RotateRefreshToken with a revoked token: %v", err)
+		}
+		if rotated {
+			t.Error("RotateRefreshToken rotated a revoked token")
+		}
+	})
+}
+
+func TestMigrateHashesRefreshTokens(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, c sqlClient) {
+		user := createTestUser(t, c)
+		// Back to just before refresh_token_hashes.
+		_, err := c.Rollback(len(migrations) - 13)
+		if err != nil {
+			t.Fatalf("Rollback: %v", err)
+		}
+		familyID := uuid.New()
+		_, err = c.db.Exec(`
+			INSERT INTO refresh_tokens (token, created_at, updated_at, family_id, user_id, expires_at)
+			VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+		`, "plaintext", familyID, user.ID.String(), time.Now().Add(time.Hour).UTC())
+		if err != nil {
+			t.Fatalf("inserting plaintext token: %v", err)
+		}
+
+		_, err = c.Migrate()
+		if err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+		stored, err := c.GetRefreshToken("plaintext")
+		if err != nil {
+			t.Fatalf("GetRefreshToken: %v", err)
+		}
+		if stored.TokenHash != "" {
+			t.Error("the plaintext token is still stored")
+		}
+		sum := sha256.Sum256([]byte("plaintext"))
+		hashed, err := c.GetRefreshToken(hex.EncodeToString(sum[:]))
+		if err != nil {
+			t.Fatalf("GetRefreshToken: %v", err)
+		}
+		if !hashed.Valid() || hashed.FamilyID != familyID {
+			t.Errorf("hashed token = %+v, want the migrated token", hashed)
+		}
+	})
+}
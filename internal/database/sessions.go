@@ -0,0 +1,117 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Session is one login. Its ID is the family ID shared by every refresh
+// token rotated from that login, so revoking a session revokes its family.
+type Session struct {
+	ID         uuid.UUID `json:"id"`
+	UserID     uuid.UUID `json:"user_id"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type CreateSessionParams struct {
+	ID        uuid.UUID
+	UserID    uuid.UUID
+	UserAgent string
+	IPAddress string
+}
+
+func (c sqlClient) CreateSession(params CreateSessionParams) error {
+	_, err := c.db.Exec(`
+	INSERT INTO sessions (id, user_id, user_agent, ip_address, created_at, last_used_at)
+	VALUES (?, ?, ?, ?, `+c.db.dialect.now()+`, `+c.db.dialect.now()+`)
+	`, params.ID, params.UserID.String(), params.UserAgent, params.IPAddress)
+	return err
+}
+
+// TouchSession records that a session's refresh token was just used, and
+// from where.
+func (c sqlClient) TouchSession(id uuid.UUID, userAgent, ipAddress string) error {
+	_, err := c.db.Exec(`
+	UPDATE sessions
+	SET last_used_at = `+c.db.dialect.now()+`, user_agent = ?, ip_address = ?
+	WHERE id = ?
+	`, userAgent, ipAddress, id)
+	return err
+}
+
+// GetActiveSessions returns the sessions of userID that still have a
+// usable refresh token, most recently used first. ExpiresAt is when that
+// token expires unless it is refreshed.
+func (c sqlClient) GetActiveSessions(userID uuid.UUID) ([]Session, error) {
+	rows, err := c.db.Query(`
+	SELECT s.id, s.user_id, s.user_agent, s.ip_address, s.created_at, s.last_used_at, rt.expires_at
+	FROM sessions s
+	JOIN refresh_tokens rt ON rt.family_id = s.id
+	WHERE s.user_id = ? AND rt.revoked_at IS NULL AND rt.rotated_at IS NULL
+	ORDER BY s.last_used_at DESC, s.id
+	`, userID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	now := time.Now()
+	for rows.Next() {
+		var session Session
+		var sessionUserID string
+		err := rows.Scan(&session.ID, &sessionUserID, &session.UserAgent, &session.IPAddress, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		// Expiry is checked here rather than in SQL because sqlite compares
+		// the stored timestamps as text.
+		if !now.Before(session.ExpiresAt) {
+			continue
+		}
+		session.UserID, err = uuid.Parse(sessionUserID)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (c sqlClient) GetSession(id uuid.UUID) (Session, error) {
+	var session Session
+	var userID string
+	err := c.db.QueryRow(`
+	SELECT id, user_id, user_agent, ip_address, created_at, last_used_at
+	FROM sessions
+	WHERE id = ?
+	`, id).Scan(&session.ID, &userID, &session.UserAgent, &session.IPAddress, &session.CreatedAt, &session.LastUsedAt)
+	if err == sql.ErrNoRows {
+		return Session{}, nil
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	session.UserID, err = uuid.Parse(userID)
+	if err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+// RevokeUserRefreshTokens revokes every refresh token of userID, ending all
+// of their sessions.
+func (c sqlClient) RevokeUserRefreshTokens(userID uuid.UUID) error {
+	_, err := c.db.Exec(`
+	UPDATE refresh_tokens
+	SET revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+	WHERE user_id = ? AND revoked_at IS NULL
+	`, userID.String())
+	return err
+}
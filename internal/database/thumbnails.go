@@ -0,0 +1,42 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// ThumbnailVariant is one size and format a thumbnail was encoded in.
+type ThumbnailVariant struct {
+	URL       string `json:"url"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	MediaType string `json:"media_type"`
+}
+
+// Thumbnails are every variant generated from a video's thumbnail. They
+// are stored as JSON in the videos table.
+type Thumbnails struct {
+	Variants []ThumbnailVariant `json:"variants"`
+	// Srcsets maps each media type to an img srcset listing its sizes.
+	Srcsets map[string]string `json:"srcsets"`
+}
+
+func (t Thumbnails) Value() (driver.Value, error) {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (t *Thumbnails) Scan(src any) error {
+	switch src := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(src), t)
+	case []byte:
+		return json.Unmarshal(src, t)
+	default:
+		return fmt.Errorf("can't scan %T into Thumbnails", src)
+	}
+}
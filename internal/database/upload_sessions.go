@@ -0,0 +1,234 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type UploadSession struct {
+	ID          uuid.UUID  `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	CreateUploadSessionParams
+}
+
+type CreateUploadSessionParams struct {
+	VideoID     uuid.UUID `json:"video_id"`
+	UserID      uuid.UUID `json:"user_id"`
+	TotalSize   int64     `json:"total_size"`
+	ContentType string    `json:"content_type"`
+}
+
+type UploadChunk struct {
+	SessionID uuid.UUID `json:"session_id"`
+	Number    int       `json:"number"`
+	Offset    int64     `json:"offset"`
+	Size      int64     `json:"size"`
+}
+
+func (c sqlClient) CreateUploadSession(params CreateUploadSessionParams) (UploadSession, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO upload_sessions (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		total_size,
+		content_type
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, id, params.VideoID, params.UserID, params.TotalSize, params.ContentType)
+	if err != nil {
+		return UploadSession{}, err
+	}
+
+	return c.GetUploadSession(id)
+}
+
+func (c sqlClient) GetUploadSession(id uuid.UUID) (UploadSession, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		updated_at,
+		completed_at,
+		video_id,
+		user_id,
+		total_size,
+		content_type
+	FROM upload_sessions
+	WHERE id = ?
+	`
+
+	var session UploadSession
+	err := c.db.QueryRow(query, id).Scan(
+		&session.ID,
+		&session.CreatedAt,
+		&session.UpdatedAt,
+		&session.CompletedAt,
+		&session.VideoID,
+		&session.UserID,
+		&session.TotalSize,
+		&session.ContentType,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UploadSession{}, nil
+		}
+		return UploadSession{}, err
+	}
+
+	return session, nil
+}
+
+// CompleteUploadSession marks the session complete and queues job to
+// process the assembled file, in one transaction. It reports false,
+// queueing nothing, if the session was already complete.
+func (c sqlClient) CompleteUploadSession(id uuid.UUID, job CreateProcessingJobParams) (bool, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+	UPDATE upload_sessions
+	SET
+		completed_at = CURRENT_TIMESTAMP,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND completed_at IS NULL
+	`, id)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if rows == 0 {
+		return false, nil
+	}
+
+	_, err = createProcessingJob(tx, tx.dialect, job)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// GetExpiredUploadSessions lists the incomplete sessions that haven't
+// received a chunk since cutoff.
+func (c sqlClient) GetExpiredUploadSessions(cutoff time.Time) ([]UploadSession, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		updated_at,
+		completed_at,
+		video_id,
+		user_id,
+		total_size,
+		content_type
+	FROM upload_sessions
+	WHERE completed_at IS NULL AND updated_at < ?
+	`
+
+	rows, err := c.db.Query(query, sqlTime(cutoff))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []UploadSession{}
+	for rows.Next() {
+		var session UploadSession
+		if err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.UpdatedAt,
+			&session.CompletedAt,
+			&session.VideoID,
+			&session.UserID,
+			&session.TotalSize,
+			&session.ContentType,
+		); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (c sqlClient) DeleteUploadSession(id uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM upload_chunks WHERE session_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("DELETE FROM upload_sessions WHERE id = ?", id)
+	return err
+}
+
+// RecordUploadChunk stores a received chunk, replacing any earlier chunk
+// with the same number so retried chunks don't double count.
+func (c sqlClient) RecordUploadChunk(chunk UploadChunk) error {
+	query := `
+	INSERT INTO upload_chunks (
+		session_id,
+		chunk_number,
+		chunk_offset,
+		size
+	) VALUES (?, ?, ?, ?)
+	ON CONFLICT(session_id, chunk_number) DO UPDATE SET
+		chunk_offset = excluded.chunk_offset,
+		size = excluded.size
+	`
+	_, err := c.db.Exec(query, chunk.SessionID, chunk.Number, chunk.Offset, chunk.Size)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec("UPDATE upload_sessions SET updated_at = CURRENT_TIMESTAMP WHERE id = ?", chunk.SessionID)
+	return err
+}
+
+func (c sqlClient) GetUploadChunks(sessionID uuid.UUID) ([]UploadChunk, error) {
+	query := `
+	SELECT
+		session_id,
+		chunk_number,
+		chunk_offset,
+		size
+	FROM upload_chunks
+	WHERE session_id = ?
+	ORDER BY chunk_offset ASC
+	`
+
+	rows, err := c.db.Query(query, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chunks := []UploadChunk{}
+	for rows.Next() {
+		var chunk UploadChunk
+		if err := rows.Scan(
+			&chunk.SessionID,
+			&chunk.Number,
+			&chunk.Offset,
+			&chunk.Size,
+		); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks, nil
+}
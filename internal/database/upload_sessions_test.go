@@ -0,0 +1,69 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestCompleteUploadSessionOnce(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, c sqlClient) {
+		user := createTestUser(t, c)
+		video := createTestVideo(t, c, user.ID, "video")
+		session, err := c.CreateUploadSession(CreateUploadSessionParams{VideoID: video.ID, UserID: user.ID, TotalSize: 1, ContentType: "video/mp4"})
+		if err != nil {
+			t.Fatalf("CreateUploadSession: %v", err)
+		}
+
+		// Two requests racing to complete the session queue one job.
+		for i, want := range []bool{true, false} {
+			job := CreateProcessingJobParams{VideoID: video.ID, SourceKey: uuid.NewString(), ContentType: "video/mp4"}
+			completed, err := c.CompleteUploadSession(session.ID, job)
+			if err != nil || completed != want {
+				t.Errorf("CompleteUploadSession #%d = %v, %v; want %v", i+1, completed, err, want)
+			}
+		}
+		_, err = c.ClaimProcessingJob("worker")
+		if err != nil {
+			t.Fatalf("ClaimProcessingJob: %v", err)
+		}
+		job, err := c.ClaimProcessingJob("worker")
+		if err != nil || job.ID != uuid.Nil {
+			t.Errorf("ClaimProcessingJob = %+v, %v; want no second job", job, err)
+		}
+	})
+}
+
+func TestGetExpiredUploadSessions(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, c sqlClient) {
+		user := createTestUser(t, c)
+		video := createTestVideo(t, c, user.ID, "video")
+		params := CreateUploadSessionParams{VideoID: video.ID, UserID: user.ID, TotalSize: 1, ContentType: "video/mp4"}
+		var sessions []UploadSession
+		for range 3 {
+			session, err := c.CreateUploadSession(params)
+			if err != nil {
+				t.Fatalf("CreateUploadSession: %v", err)
+			}
+			sessions = append(sessions, session)
+		}
+		abandoned, completed, active := sessions[0], sessions[1], sessions[2]
+		_, err := c.CompleteUploadSession(completed.ID, CreateProcessingJobParams{VideoID: video.ID, SourceKey: "uploads/x", ContentType: "video/mp4"})
+		if err != nil {
+			t.Fatalf("CompleteUploadSession: %v", err)
+		}
+		_, err = c.db.Exec("UPDATE upload_sessions SET updated_at = ? WHERE id IN (?, ?)", sqlTime(time.Now().Add(-2*time.Hour)), abandoned.ID, completed.ID)
+		if err != nil {
+			t.Fatalf("aging sessions: %v", err)
+		}
+
+		expired, err := c.GetExpiredUploadSessions(time.Now().Add(-time.Hour))
+		if err != nil {
+			t.Fatalf("GetExpiredUploadSessions: %v", err)
+		}
+		if len(expired) != 1 || expired[0].ID != abandoned.ID {
+			t.Errorf("GetExpiredUploadSessions = %+v, want just the abandoned session %v and not %v", expired, abandoned.ID, active.ID)
+		}
+	})
+}
@@ -0,0 +1,46 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UserIdentity links a user to their account at an external identity
+// provider, identified by the provider's issuer URL and subject.
+type UserIdentity struct {
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	UserID    uuid.UUID `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (c sqlClient) CreateUserIdentity(issuer, subject string, userID uuid.UUID) error {
+	_, err := c.db.Exec(`
+	INSERT INTO user_identities (issuer, subject, user_id, created_at)
+	VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+	`, issuer, subject, userID.String())
+	return err
+}
+
+func (c sqlClient) GetUserIdentity(issuer, subject string) (UserIdentity, error) {
+	var identity UserIdentity
+	var userID string
+	err := c.db.QueryRow(`
+	SELECT issuer, subject, user_id, created_at
+	FROM user_identities
+	WHERE issuer = ? AND subject = ?
+	`, issuer, subject).Scan(&identity.Issuer, &identity.Subject, &userID, &identity.CreatedAt)
+	if err == sql.ErrNoRows {
+		return UserIdentity{}, nil
+	}
+	if err != nil {
+		return UserIdentity{}, err
+	}
+	identity.UserID, err = uuid.Parse(userID)
+	if err != nil {
+		return UserIdentity{}, err
+	}
+	return identity, nil
+}
@@ -0,0 +1,94 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	TokenPurposeVerifyEmail   = "verify_email"
+	TokenPurposeResetPassword = "reset_password"
+)
+
+// UserToken is a single-use token mailed to a user to prove they own their
+// email address. Only its hash is stored.
+type UserToken struct {
+	TokenHash string
+	UserID    uuid.UUID
+	Purpose   string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// Valid reports whether the token can still be used.
+func (t UserToken) Valid() bool {
+	return t.TokenHash != "" && t.UsedAt == nil && time.Now().Before(t.ExpiresAt)
+}
+
+// CreateUserToken stores a new token, replacing any unused ones the user
+// has for the same purpose so only the latest email works.
+func (c sqlClient) CreateUserToken(tokenHash string, userID uuid.UUID, purpose string, expiresAt time.Time) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	DELETE FROM user_tokens
+	WHERE user_id = ? AND purpose = ? AND used_at IS NULL
+	`, userID.String(), purpose)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+	INSERT INTO user_tokens (token_hash, user_id, purpose, created_at, expires_at)
+	VALUES (?, ?, ?, CURRENT_TIMESTAMP, ?)
+	`, tokenHash, userID.String(), purpose, expiresAt.UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (c sqlClient) GetUserToken(tokenHash, purpose string) (UserToken, error) {
+	var token UserToken
+	var userID string
+	err := c.db.QueryRow(`
+	SELECT token_hash, user_id, purpose, created_at, expires_at, used_at
+	FROM user_tokens
+	WHERE token_hash = ? AND purpose = ?
+	`, tokenHash, purpose).Scan(&token.TokenHash, &userID, &token.Purpose, &token.CreatedAt, &token.ExpiresAt, &token.UsedAt)
+	if err == sql.ErrNoRows {
+		return UserToken{}, nil
+	}
+	if err != nil {
+		return UserToken{}, err
+	}
+	token.UserID, err = uuid.Parse(userID)
+	if err != nil {
+		return UserToken{}, err
+	}
+	return token, nil
+}
+
+// UseUserToken marks a token as used. It reports false if it already was,
+// so two requests racing with the same token can't both succeed.
+func (c sqlClient) UseUserToken(tokenHash string) (bool, error) {
+	result, err := c.db.Exec(`
+	UPDATE user_tokens
+	SET used_at = CURRENT_TIMESTAMP
+	WHERE token_hash = ? AND used_at IS NULL
+	`, tokenHash)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows == 1, nil
+}
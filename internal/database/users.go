@@ -12,6 +12,8 @@ type User struct {
 	ID        uuid.UUID `json:"id"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+	// EmailVerifiedAt is set once the user proves they own Email.
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
 	CreateUserParams
 }
 
@@ -20,7 +22,7 @@ type CreateUserParams struct {
 	Password string `json:"password"`
 }
 
-func (c Client) GetUsers() ([]User, error) {
+func (c sqlClient) GetUsers() ([]User, error) {
 	query := `
 		SELECT
 			id,
@@ -51,15 +53,19 @@ func (c Client) GetUsers() ([]User, error) {
 	return users, nil
 }
 
-func (c Client) GetUserByEmail(email string) (User, error) {
+// GetUserByEmail matches email case-insensitively. Should several users'
+// emails differ only in case, the exact match wins, then the oldest.
+func (c sqlClient) GetUserByEmail(email string) (User, error) {
 	query := `
-		SELECT id, created_at, updated_at, email, password
+		SELECT id, created_at, updated_at, email, password, email_verified_at
 		FROM users
-		WHERE email = ?
+		WHERE LOWER(email) = LOWER(?)
+		ORDER BY CASE WHEN email = ? THEN 0 ELSE 1 END, created_at
+		LIMIT 1
 	`
 	var user User
 	var id string
-	err := c.db.QueryRow(query, email).Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	err := c.db.QueryRow(query, email, email).Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password, &user.EmailVerifiedAt)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return User{}, nil
@@ -73,32 +79,7 @@ func (c Client) GetUserByEmail(email string) (User, error) {
 	return user, nil
 }
 
-func (c Client) GetUserByRefreshToken(token string) (*User, error) {
-	query := `
-		SELECT u.id, u.email, u.created_at, u.updated_at, u.password
-		FROM users u
-		JOIN refresh_tokens rt ON u.id = rt.user_id
-		WHERE rt.token = ?
-	`
-
-	var user User
-	var id string
-	err := c.db.QueryRow(query, token).Scan(&id, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Password)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
-		}
-		return nil, err
-	}
-	user.ID, err = uuid.Parse(id)
-	if err != nil {
-		return nil, err
-	}
-
-	return &user, nil
-}
-
-func (c Client) CreateUser(params CreateUserParams) (*User, error) {
+func (c sqlClient) CreateUser(params CreateUserParams) (*User, error) {
 	id := uuid.New()
 
 	query := `
@@ -115,15 +96,15 @@ func (c Client) CreateUser(params CreateUserParams) (*User, error) {
 	return c.GetUser(id)
 }
 
-func (c Client) GetUser(id uuid.UUID) (*User, error) {
+func (c sqlClient) GetUser(id uuid.UUID) (*User, error) {
 	query := `
-		SELECT id, created_at, updated_at, email, password
+		SELECT id, created_at, updated_at, email, password, email_verified_at
 		FROM users
 		WHERE id = ?
 	`
 	var user User
 	var idStr string
-	err := c.db.QueryRow(query, id.String()).Scan(&idStr, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	err := c.db.QueryRow(query, id.String()).Scan(&idStr, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password, &user.EmailVerifiedAt)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -137,7 +118,25 @@ func (c Client) GetUser(id uuid.UUID) (*User, error) {
 	return &user, nil
 }
 
-func (c Client) DeleteUser(id uuid.UUID) error {
+func (c sqlClient) UpdateUserPassword(id uuid.UUID, password string) error {
+	_, err := c.db.Exec(`
+		UPDATE users
+		SET password = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, password, id.String())
+	return err
+}
+
+func (c sqlClient) MarkEmailVerified(id uuid.UUID) error {
+	_, err := c.db.Exec(`
+		UPDATE users
+		SET email_verified_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND email_verified_at IS NULL
+	`, id.String())
+	return err
+}
+
+func (c sqlClient) DeleteUser(id uuid.UUID) error {
 	query := `
 		DELETE FROM users
 		WHERE id = ?
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"github.com/google/uuid"
+)
+
+// VideoFiles are the storage keys and asset URLs a video points at.
+type VideoFiles struct {
+	VideoID      uuid.UUID
+	VideoURL     *string
+	HLSURL       *string
+	ThumbnailURL *string
+	Thumbnails   *Thumbnails
+	SpriteURL    *string
+	SpriteVTTURL *string
+}
+
+// ReferencedFiles is everything in storage and the assets directory the
+// database still points at, so garbage collection knows what to keep.
+type ReferencedFiles struct {
+	Videos []VideoFiles
+	// UploadKeys are the objects of direct uploads that haven't been
+	// completed yet, and the sources of unfinished processing jobs.
+	UploadKeys []string
+}
+
+func (c sqlClient) GetReferencedFiles() (ReferencedFiles, error) {
+	refs := ReferencedFiles{
+		Videos:     []VideoFiles{},
+		UploadKeys: []string{},
+	}
+
+	rows, err := c.db.Query(`
+	SELECT id, video_url, hls_url, thumbnail_url, thumbnails, sprite_url, sprite_vtt_url
+	FROM videos
+	`)
+	if err != nil {
+		return ReferencedFiles{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var files VideoFiles
+		err = rows.Scan(&files.VideoID, &files.VideoURL, &files.HLSURL, &files.ThumbnailURL, &files.Thumbnails, &files.SpriteURL, &files.SpriteVTTURL)
+		if err != nil {
+			return ReferencedFiles{}, err
+		}
+		refs.Videos = append(refs.Videos, files)
+	}
+	if err = rows.Err(); err != nil {
+		return ReferencedFiles{}, err
+	}
+
+	rows, err = c.db.Query(`
+	SELECT object_key FROM direct_uploads WHERE completed_at IS NULL
+	UNION
+	SELECT source_key FROM processing_jobs WHERE status IN (?, ?)
+	`, JobStatusPending, JobStatusProcessing)
+	if err != nil {
+		return ReferencedFiles{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			return ReferencedFiles{}, err
+		}
+		refs.UploadKeys = append(refs.UploadKeys, key)
+	}
+	return refs, rows.Err()
+}
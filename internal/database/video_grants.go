@@ -0,0 +1,129 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Video roles, from least to most access. A video's creator is always an
+// owner without needing a grant.
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleOwner  = "owner"
+)
+
+func ValidRole(role string) bool {
+	switch role {
+	case RoleViewer, RoleEditor, RoleOwner:
+		return true
+	}
+	return false
+}
+
+type VideoGrant struct {
+	VideoID   uuid.UUID `json:"video_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+const videoGrantSelect = `
+	SELECT
+		g.video_id,
+		g.user_id,
+		u.email,
+		g.role,
+		g.created_at,
+		g.updated_at
+	FROM video_grants g
+	JOIN users u ON u.id = g.user_id
+`
+
+func scanVideoGrant(row rowScanner) (VideoGrant, error) {
+	var grant VideoGrant
+	err := row.Scan(
+		&grant.VideoID,
+		&grant.UserID,
+		&grant.Email,
+		&grant.Role,
+		&grant.CreatedAt,
+		&grant.UpdatedAt,
+	)
+	return grant, err
+}
+
+func (c sqlClient) UpsertVideoGrant(videoID, userID uuid.UUID, role string) (VideoGrant, error) {
+	query := `
+	INSERT INTO video_grants (
+		video_id,
+		user_id,
+		created_at,
+		updated_at,
+		role
+	) VALUES (?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?)
+	ON CONFLICT(video_id, user_id) DO UPDATE SET
+		updated_at = CURRENT_TIMESTAMP,
+		role = excluded.role
+	`
+	_, err := c.db.Exec(query, videoID, userID, role)
+	if err != nil {
+		return VideoGrant{}, err
+	}
+
+	return c.GetVideoGrant(videoID, userID)
+}
+
+func (c sqlClient) GetVideoGrant(videoID, userID uuid.UUID) (VideoGrant, error) {
+	query := videoGrantSelect + `
+	WHERE g.video_id = ? AND g.user_id = ?
+	`
+
+	grant, err := scanVideoGrant(c.db.QueryRow(query, videoID, userID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return VideoGrant{}, nil
+		}
+		return VideoGrant{}, err
+	}
+	return grant, nil
+}
+
+func (c sqlClient) GetVideoGrants(videoID uuid.UUID) ([]VideoGrant, error) {
+	query := videoGrantSelect + `
+	WHERE g.video_id = ?
+	ORDER BY g.created_at
+	`
+
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grants := []VideoGrant{}
+	for rows.Next() {
+		grant, err := scanVideoGrant(rows)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+
+	return grants, rows.Err()
+}
+
+func (c sqlClient) DeleteVideoGrant(videoID, userID uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM video_grants WHERE video_id = ? AND user_id = ?", videoID, userID)
+	return err
+}
+
+func (c sqlClient) DeleteVideoGrants(videoID uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM video_grants WHERE video_id = ?", videoID)
+	return err
+}
@@ -0,0 +1,195 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Sort orders accepted by ListVideos. A leading "-" sorts descending.
+var videoSortColumns = map[string]string{
+	"created_at": "v.created_at",
+	"updated_at": "v.updated_at",
+	"title":      "v.title",
+}
+
+const DefaultVideoSort = "-created_at"
+
+func ValidVideoSort(sort string) bool {
+	_, ok := videoSortColumns[strings.TrimPrefix(sort, "-")]
+	return ok
+}
+
+// VideoListOptions filters a page of videos. Zero values don't filter.
+type VideoListOptions struct {
+	// UserID lists the user's personal videos: the ones they own or have
+	// been granted, outside any organization.
+	UserID uuid.UUID
+	// OrgID lists an organization's library instead.
+	OrgID *uuid.UUID
+
+	// AspectRatio is the landscape/portrait/other prefix of the video key.
+	AspectRatio   string
+	HasVideo      *bool
+	HasThumbnail  *bool
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	TitleSearch   string
+
+	Sort string
+	// Cursor is where the previous page ended.
+	Cursor *VideoCursor
+	Limit  int
+}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// VideoCursor is the sort key and ID of the last video on a page. Clients
+// get it as an opaque string. Carrying the key rather than looking the
+// video up again keeps paging working when that video is deleted or edited
+// between requests.
+type VideoCursor struct {
+	Sort  string    `json:"s"`
+	Value string    `json:"v"`
+	ID    uuid.UUID `json:"id"`
+}
+
+func (c VideoCursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func ParseVideoCursor(s string) (VideoCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return VideoCursor{}, ErrInvalidCursor
+	}
+	var cursor VideoCursor
+	err = json.Unmarshal(data, &cursor)
+	if err != nil || !ValidVideoSort(cursor.Sort) || cursor.ID == uuid.Nil {
+		return VideoCursor{}, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+// videoSortValue is the cursor value of video for a sort. Timestamps keep
+// microseconds, which is as precise as either database stores them.
+func videoSortValue(video Video, sort string) string {
+	switch strings.TrimPrefix(sort, "-") {
+	case "created_at":
+		return video.CreatedAt.UTC().Format("2006-01-02 15:04:05.000000")
+	case "updated_at":
+		return video.UpdatedAt.UTC().Format("2006-01-02 15:04:05.000000")
+	default:
+		return video.Title
+	}
+}
+
+// ListVideos returns a page of videos and the cursor for the next page,
+// which is empty on the last page. Pages are keyed on the sort column and
+// the video ID, so videos added between requests don't shift the pages.
+func (c sqlClient) ListVideos(opts VideoListOptions) ([]Video, string, error) {
+	sort := opts.Sort
+	if sort == "" {
+		sort = DefaultVideoSort
+	}
+	column, ok := videoSortColumns[strings.TrimPrefix(sort, "-")]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown sort %q", sort)
+	}
+	key, keyParam := column, "?"
+	if column != "v.title" {
+		key, keyParam = c.db.dialect.timeKey(column), c.db.dialect.timeKey("?")
+	}
+	direction, comparison := "ASC", ">"
+	if strings.HasPrefix(sort, "-") {
+		direction, comparison = "DESC", "<"
+	}
+
+	where := []string{"v.deleted_at IS NULL"}
+	args := []any{}
+	if opts.OrgID != nil {
+		where = append(where, "v.org_id = ?")
+		args = append(args, *opts.OrgID)
+	} else {
+		where = append(where, `v.org_id IS NULL AND (
+			v.user_id = ?
+			OR v.id IN (SELECT video_id FROM video_grants WHERE user_id = ?)
+		)`)
+		args = append(args, opts.UserID, opts.UserID)
+	}
+	if opts.AspectRatio != "" {
+		// Older videos store "bucket,key" rather than the bare key.
+		where = append(where, "(v.video_url LIKE ? OR v.video_url LIKE ?)")
+		args = append(args, opts.AspectRatio+"/%", "%,"+opts.AspectRatio+"/%")
+	}
+	if opts.HasVideo != nil {
+		where = append(where, nullCheck("v.video_url", *opts.HasVideo))
+	}
+	if opts.HasThumbnail != nil {
+		where = append(where, nullCheck("v.thumbnail_url", *opts.HasThumbnail))
+	}
+	if opts.CreatedAfter != nil {
+		where = append(where, "v.created_at >= ?")
+		args = append(args, sqlTime(*opts.CreatedAfter))
+	}
+	if opts.CreatedBefore != nil {
+		where = append(where, "v.created_at < ?")
+		args = append(args, sqlTime(*opts.CreatedBefore))
+	}
+	if opts.TitleSearch != "" {
+		where = append(where, `LOWER(v.title) LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(strings.ToLower(opts.TitleSearch))+"%")
+	}
+	if opts.Cursor != nil {
+		if opts.Cursor.Sort != sort {
+			return nil, "", ErrInvalidCursor
+		}
+		where = append(where, fmt.Sprintf("(%s %s %s OR (%s = %s AND v.id %s ?))",
+			key, comparison, keyParam, key, keyParam, comparison))
+		args = append(args, opts.Cursor.Value, opts.Cursor.Value, opts.Cursor.ID)
+	}
+
+	// Fetch one extra row to know whether there's another page.
+	query := videoSelect + `
+	WHERE ` + strings.Join(where, "\n\tAND ") + fmt.Sprintf(`
+	ORDER BY %s %s, v.id %s
+	LIMIT ?
+	`, key, direction, direction)
+	args = append(args, opts.Limit+1)
+
+	videos, err := c.queryVideos(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(videos) <= opts.Limit {
+		return videos, "", nil
+	}
+	videos = videos[:opts.Limit]
+	last := videos[len(videos)-1]
+	next := VideoCursor{Sort: sort, Value: videoSortValue(last, sort), ID: last.ID}
+	return videos, next.String(), nil
+}
+
+func nullCheck(column string, notNull bool) string {
+	if notNull {
+		return column + " IS NOT NULL"
+	}
+	return column + " IS NULL"
+}
+
+// sqlTime formats t the way CURRENT_TIMESTAMP stores it, so comparisons
+// against timestamp columns also work on sqlite, which compares them as
+// text.
+func sqlTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
@@ -0,0 +1,151 @@
+package database
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestListVideosCursorPaging(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, c sqlClient) {
+		user := createTestUser(t, c)
+		other := createTestUser(t, c)
+		titles := []string{"a", "b", "c", "d", "e"}
+		for _, title := range titles {
+			createTestVideo(t, c, user.ID, title)
+		}
+		createTestVideo(t, c, other.ID, "someone else's")
+
+		for _, sort := range []string{"title", "-title", "created_at", "-created_at", "updated_at", "-updated_at"} {
+			seen := map[uuid.UUID]bool{}
+			var listed []string
+			var cursor *VideoCursor
+			for page := 0; ; page++ {
+				if page > len(titles) {
+					t.Fatalf("sort %s: paging didn't stop", sort)
+				}
+				videos, next, err := c.ListVideos(VideoListOptions{
+					UserID: user.ID,
+					Sort:   sort,
+					Cursor: cursor,
+					Limit:  2,
+				})
+				if err != nil {
+					t.Fatalf("sort %s: ListVideos: %v", sort, err)
+				}
+				for _, video := range videos {
+					if seen[video.ID] {
+						t.Errorf("sort %s: video %q listed twice", sort, video.Title)
+					}
+					seen[video.ID] = true
+					listed = append(listed, video.Title)
+				}
+				if next == "" {
+					break
+				}
+				if len(videos) != 2 {
+					t.Errorf("sort %s: got a page of %d videos with a next cursor", sort, len(videos))
+				}
+				nextCursor, err := ParseVideoCursor(next)
+				if err != nil {
+					t.Fatalf("sort %s: cursor %q: %v", sort, next, err)
+				}
+				cursor = &nextCursor
+			}
+
+			if len(listed) != len(titles) {
+				t.Errorf("sort %s: listed %v, want all of %v", sort, listed, titles)
+				continue
+			}
+			switch sort {
+			case "title":
+				for i, title := range titles {
+					if listed[i] != title {
+						t.Errorf("sort title: listed %v, want %v", listed, titles)
+						break
+					}
+				}
+			case "-title":
+				for i, title := range titles {
+					if listed[len(listed)-1-i] != title {
+						t.Errorf("sort -title: listed %v, want %v reversed", listed, titles)
+						break
+					}
+				}
+			}
+		}
+	})
+}
+
+func TestListVideosCursorSurvivesChanges(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, c sqlClient) {
+		user := createTestUser(t, c)
+		for _, title := range []string{"a", "b", "c", "d"} {
+			createTestVideo(t, c, user.ID, title)
+		}
+		firstPage := func() ([]Video, *VideoCursor) {
+			videos, next, err := c.ListVideos(VideoListOptions{UserID: user.ID, Sort: "title", Limit: 2})
+			if err != nil {
+				t.Fatalf("ListVideos: %v", err)
+			}
+			cursor, err := ParseVideoCursor(next)
+			if err != nil {
+				t.Fatalf("ParseVideoCursor: %v", err)
+			}
+			return videos, &cursor
+		}
+		secondPage := func(cursor *VideoCursor) []string {
+			videos, _, err := c.ListVideos(VideoListOptions{UserID: user.ID, Sort: "title", Cursor: cursor, Limit: 2})
+			if err != nil {
+				t.Fatalf("ListVideos: %v", err)
+			}
+			titles := []string{}
+			for _, video := range videos {
+				titles = append(titles, video.Title)
+			}
+			return titles
+		}
+
+		// The last video of the page is edited before the next request.
+		videos, cursor := firstPage()
+		last := videos[len(videos)-1]
+		last.Title = "z"
+		err := c.UpdateVideo(last)
+		if err != nil {
+			t.Fatalf("UpdateVideo: %v", err)
+		}
+		if got := secondPage(cursor); len(got) != 2 || got[0] != "c" || got[1] != "d" {
+			t.Errorf("after an edit the second page is %v, want [c d]", got)
+		}
+
+		// The last video of the page is deleted for good.
+		videos, cursor = firstPage()
+		err = c.DeleteVideo(videos[len(videos)-1].ID)
+		if err != nil {
+			t.Fatalf("DeleteVideo: %v", err)
+		}
+		if got := secondPage(cursor); len(got) != 2 || got[0] != "d" || got[1] != "z" {
+			t.Errorf("after a delete the second page is %v, want [d z]", got)
+		}
+
+		_, _, err = c.ListVideos(VideoListOptions{UserID: user.ID, Sort: "-title", Cursor: cursor, Limit: 2})
+		if !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("ListVideos with another sort's cursor: err = %v, want ErrInvalidCursor", err)
+		}
+	})
+}
+
+func TestParseVideoCursor(t *testing.T) {
+	cursor := VideoCursor{Sort: "-created_at", Value: "2026-01-02 03:04:05.000000", ID: uuid.New()}
+	parsed, err := ParseVideoCursor(cursor.String())
+	if err != nil || parsed != cursor {
+		t.Errorf("ParseVideoCursor(%q) = %+v, %v; want %+v", cursor.String(), parsed, err, cursor)
+	}
+	for _, bad := range []string{"", "not base64!", uuid.NewString(), VideoCursor{Sort: "size", ID: uuid.New()}.String()} {
+		_, err := ParseVideoCursor(bad)
+		if !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("ParseVideoCursor(%q) error = %v, want ErrInvalidCursor", bad, err)
+		}
+	}
+}
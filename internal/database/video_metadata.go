@@ -0,0 +1,75 @@
+package database
+
+import (
+	"github.com/google/uuid"
+)
+
+// VideoMetadata is what ffprobe reported for a video's processed file.
+type VideoMetadata struct {
+	DurationSeconds float64 `json:"duration_seconds"`
+	Width           int     `json:"width"`
+	Height          int     `json:"height"`
+	VideoCodec      string  `json:"video_codec"`
+	AudioCodec      string  `json:"audio_codec"`
+	BitRate         int64   `json:"bit_rate"`
+	FrameRate       float64 `json:"frame_rate"`
+	AudioChannels   int     `json:"audio_channels"`
+	Rotation        int     `json:"rotation"`
+	Container       string  `json:"container"`
+	SizeBytes       int64   `json:"size_bytes"`
+}
+
+func (c sqlClient) UpsertVideoMetadata(videoID uuid.UUID, meta VideoMetadata) error {
+	query := `
+	INSERT INTO video_metadata (
+		video_id,
+		created_at,
+		updated_at,
+		duration_seconds,
+		width,
+		height,
+		video_codec,
+		audio_codec,
+		bit_rate,
+		frame_rate,
+		audio_channels,
+		rotation,
+		container,
+		size_bytes
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(video_id) DO UPDATE SET
+		updated_at = CURRENT_TIMESTAMP,
+		duration_seconds = excluded.duration_seconds,
+		width = excluded.width,
+		height = excluded.height,
+		video_codec = excluded.video_codec,
+		audio_codec = excluded.audio_codec,
+		bit_rate = excluded.bit_rate,
+		frame_rate = excluded.frame_rate,
+		audio_channels = excluded.audio_channels,
+		rotation = excluded.rotation,
+		container = excluded.container,
+		size_bytes = excluded.size_bytes
+	`
+	_, err := c.db.Exec(
+		query,
+		videoID,
+		meta.DurationSeconds,
+		meta.Width,
+		meta.Height,
+		meta.VideoCodec,
+		meta.AudioCodec,
+		meta.BitRate,
+		meta.FrameRate,
+		meta.AudioChannels,
+		meta.Rotation,
+		meta.Container,
+		meta.SizeBytes,
+	)
+	return err
+}
+
+func (c sqlClient) DeleteVideoMetadata(videoID uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM video_metadata WHERE video_id = ?", videoID)
+	return err
+}
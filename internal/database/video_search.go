@@ -0,0 +1,188 @@
+package database
+
+import (
+	"errors"
+	"html"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Snippets are highlighted with private use characters first so the text
+// can be HTML-escaped before they're swapped for <mark> tags.
+const (
+	highlightStart = ""
+	highlightEnd   = ""
+)
+
+type VideoSearchResult struct {
+	Video              Video   `json:"video"`
+	Rank               float64 `json:"rank"`
+	TitleSnippet       string  `json:"title_snippet"`
+	DescriptionSnippet string  `json:"description_snippet"`
+}
+
+// SearchVideos ranks the videos userID can see by how well their title and
+// description match query. Anonymous callers (uuid.Nil) only see public
+// videos; unlisted videos are only found by people with access to them.
+// sqlite databases without the FTS5 index fall back to matching every word
+// with LIKE, newest first and without highlights.
+func (c sqlClient) SearchVideos(query string, userID uuid.UUID, limit, offset int) ([]VideoSearchResult, error) {
+	access := `
+	AND v.deleted_at IS NULL
+	AND (
+		v.visibility = ?
+		OR v.user_id = ?
+		OR v.id IN (SELECT video_id FROM video_grants WHERE user_id = ?)
+		OR v.org_id IN (SELECT org_id FROM organization_members WHERE user_id = ?)
+	)
+	`
+	accessArgs := []any{VisibilityPublic, userID, userID, userID}
+
+	var sqlQuery string
+	var args []any
+	if c.db.dialect.name() == "postgres" {
+		sqlQuery = `
+		SELECT` + videoColumns + `,
+			ts_rank(to_tsvector('english', v.title || ' ' || COALESCE(v.description, '')), q) AS rank,
+			ts_headline('english', v.title, q, 'StartSel=` + highlightStart + `, StopSel=` + highlightEnd + `, HighlightAll=true'),
+			ts_headline('english', COALESCE(v.description, ''), q, 'StartSel=` + highlightStart + `, StopSel=` + highlightEnd + `, MaxFragments=1, MaxWords=20')
+		` + videoFrom + `
+		CROSS JOIN websearch_to_tsquery('english', ?) q
+		WHERE to_tsvector('english', v.title || ' ' || COALESCE(v.description, '')) @@ q
+		` + access + `
+		ORDER BY rank DESC, v.id
+		LIMIT ? OFFSET ?
+		`
+		args = append([]any{query}, accessArgs...)
+	} else {
+		match := ftsQuery(query)
+		if match == "" {
+			return []VideoSearchResult{}, nil
+		}
+		fts, err := c.hasVideoFTS()
+		if err != nil {
+			return nil, err
+		}
+		if !fts {
+			return c.searchVideosLike(query, access, accessArgs, limit, offset)
+		}
+		sqlQuery = `
+		SELECT` + videoColumns + `,
+			-bm25(videos_fts) AS rank,
+			snippet(videos_fts, 1, '` + highlightStart + `', '` + highlightEnd + `', '…', 16),
+			snippet(videos_fts, 2, '` + highlightStart + `', '` + highlightEnd + `', '…', 16)
+		` + videoFrom + `
+		JOIN videos_fts ON videos_fts.video_id = v.id
+		WHERE videos_fts MATCH ?
+		` + access + `
+		ORDER BY rank DESC, v.id
+		LIMIT ? OFFSET ?
+		`
+		args = append([]any{match}, accessArgs...)
+	}
+	args = append(args, limit, offset)
+	return c.queryVideoSearchResults(sqlQuery, args...)
+}
+
+// hasVideoFTS reports whether the FTS5 index exists, which needs sqlite
+// built with -tags sqlite_fts5.
+func (c sqlClient) hasVideoFTS() (bool, error) {
+	return videoFTSExists(c.db)
+}
+
+func videoFTSExists(db queryRower) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'videos_fts'").Scan(&count)
+	return count > 0, err
+}
+
+// sqliteHasFTS5 reports whether sqlite was built with FTS5.
+func sqliteHasFTS5(db queryRower) (bool, error) {
+	var fts5 bool
+	err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5)
+	return fts5, err
+}
+
+// checkVideoFTS fails if the database has the FTS5 index but sqlite was
+// built without FTS5, since the index's triggers would then make every
+// write to videos fail.
+func checkVideoFTS(db queryRower) error {
+	fts, err := videoFTSExists(db)
+	if err != nil || !fts {
+		return err
+	}
+	fts5, err := sqliteHasFTS5(db)
+	if err != nil {
+		return err
+	}
+	if !fts5 {
+		return errors.New("the database has a full-text search index but sqlite was built without FTS5; build with -tags sqlite_fts5")
+	}
+	return nil
+}
+
+func (c sqlClient) searchVideosLike(query, access string, accessArgs []any, limit, offset int) ([]VideoSearchResult, error) {
+	conditions := []string{}
+	args := []any{}
+	for _, word := range strings.Fields(query) {
+		pattern := "%" + escapeLike(word) + "%"
+		conditions = append(conditions, `(v.title LIKE ? ESCAPE '\' OR v.description LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern)
+	}
+	sqlQuery := `
+	SELECT` + videoColumns + `,
+		0.0 AS rank,
+		v.title,
+		COALESCE(v.description, '')
+	` + videoFrom + `
+	WHERE ` + strings.Join(conditions, " AND ") + `
+	` + access + `
+	ORDER BY v.created_at DESC, v.id
+	LIMIT ? OFFSET ?
+	`
+	args = append(args, accessArgs...)
+	args = append(args, limit, offset)
+	return c.queryVideoSearchResults(sqlQuery, args...)
+}
+
+func (c sqlClient) queryVideoSearchResults(sqlQuery string, args ...any) ([]VideoSearchResult, error) {
+	rows, err := c.db.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []VideoSearchResult{}
+	for rows.Next() {
+		var result VideoSearchResult
+		result.Video, err = scanVideo(rows, &result.Rank, &result.TitleSnippet, &result.DescriptionSnippet)
+		if err != nil {
+			return nil, err
+		}
+		result.TitleSnippet = highlightHTML(result.TitleSnippet)
+		result.DescriptionSnippet = highlightHTML(result.DescriptionSnippet)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// ftsQuery turns free text into an FTS5 query matching every word, the
+// last one as a prefix so results update while the user is typing. Words
+// are quoted so FTS5 operators in the input are taken literally.
+func ftsQuery(query string) string {
+	words := strings.Fields(query)
+	for i, word := range words {
+		words[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+	if len(words) == 0 {
+		return ""
+	}
+	words[len(words)-1] += "*"
+	return strings.Join(words, " ")
+}
+
+func highlightHTML(snippet string) string {
+	escaped := html.EscapeString(snippet)
+	return strings.NewReplacer(highlightStart, "<mark>", highlightEnd, "</mark>").Replace(escaped)
+}
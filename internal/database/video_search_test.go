@@ -0,0 +1,88 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateAddsMissingSearchIndex(t *testing.T) {
+	client, err := openSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("openSQLite: %v", err)
+	}
+	defer client.Close()
+	c := client.(sqlClient)
+	fts5, err := sqliteHasFTS5(c.db)
+	if err != nil {
+		t.Fatalf("sqliteHasFTS5: %v", err)
+	}
+	if !fts5 {
+		t.Skip("sqlite was built without FTS5; run with -tags sqlite_fts5")
+	}
+
+	// A database migrated by a build without FTS5 has no index.
+	_, err = c.Migrate()
+	if err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	for _, stmt := range []string{
+		"DROP TRIGGER videos_fts_insert",
+		"DROP TRIGGER videos_fts_update",
+		"DROP TRIGGER videos_fts_delete",
+		"DROP TABLE videos_fts",
+	} {
+		_, err = c.db.Exec(stmt)
+		if err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	user := createTestUser(t, c)
+	createTestVideo(t, c, user.ID, "boats and trains")
+
+	// The next start with FTS5 builds it, including videos saved without it.
+	for range 2 {
+		_, err = c.Migrate()
+		if err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+	}
+	createTestVideo(t, c, user.ID, "more boats")
+	results, err := c.SearchVideos("boats", user.ID, 10, 0)
+	if err != nil {
+		t.Fatalf("SearchVideos: %v", err)
+	}
+	if len(results) != 2 || results[0].TitleSnippet == "" {
+		t.Errorf("SearchVideos = %+v, want both videos ranked with snippets", results)
+	}
+}
+
+func TestOpenChecksFTS5(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tubely.db")
+	client, err := openSQLite(path)
+	if err != nil {
+		t.Fatalf("openSQLite: %v", err)
+	}
+	c := client.(sqlClient)
+	fts5, err := sqliteHasFTS5(c.db)
+	if err != nil {
+		t.Fatalf("sqliteHasFTS5: %v", err)
+	}
+	// Only the name matters to the check, so a plain table stands in for
+	// the index in builds without FTS5.
+	_, err = c.db.Exec("CREATE TABLE videos_fts (video_id TEXT)")
+	if err != nil {
+		t.Fatalf("creating videos_fts: %v", err)
+	}
+	client.Close()
+
+	client, err = Open(path)
+	if fts5 && err != nil {
+		t.Errorf("Open with FTS5: %v", err)
+	}
+	if !fts5 && err == nil {
+		t.Error("Open without FTS5 accepted a database with a search index")
+	}
+	if client != nil {
+		client.Close()
+	}
+}
@@ -0,0 +1,51 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TrashVideo moves a video to the trash. It stays out of every listing
+// until it is restored or purged, but keeps its files.
+func (c sqlClient) TrashVideo(id uuid.UUID) error {
+	_, err := c.db.Exec(`
+	UPDATE videos
+	SET deleted_at = CURRENT_TIMESTAMP, updated_at = `+c.db.dialect.now()+`
+	WHERE id = ? AND deleted_at IS NULL
+	`, id)
+	return err
+}
+
+func (c sqlClient) RestoreVideo(id uuid.UUID) error {
+	_, err := c.db.Exec(`
+	UPDATE videos
+	SET deleted_at = NULL, updated_at = `+c.db.dialect.now()+`
+	WHERE id = ?
+	`, id)
+	return err
+}
+
+// GetTrashedVideos returns the trashed videos userID may restore: the ones
+// they created, were granted ownership of, or that belong to an
+// organization they administer. Most recently deleted come first.
+func (c sqlClient) GetTrashedVideos(userID uuid.UUID) ([]Video, error) {
+	query := videoSelect + `
+	WHERE v.deleted_at IS NOT NULL
+	AND (
+		v.user_id = ?
+		OR v.id IN (SELECT video_id FROM video_grants WHERE user_id = ? AND role = ?)
+		OR v.org_id IN (SELECT org_id FROM organization_members WHERE user_id = ? AND role = ?)
+	)
+	ORDER BY v.deleted_at DESC, v.id
+	`
+	return c.queryVideos(query, userID, userID, RoleOwner, userID, OrgRoleAdmin)
+}
+
+// GetExpiredTrashedVideos returns videos that were trashed before cutoff.
+func (c sqlClient) GetExpiredTrashedVideos(cutoff time.Time) ([]Video, error) {
+	query := videoSelect + `
+	WHERE v.deleted_at IS NOT NULL AND v.deleted_at < ?
+	`
+	return c.queryVideos(query, sqlTime(cutoff))
+}
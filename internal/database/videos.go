@@ -8,38 +8,174 @@ import (
 	"github.com/google/uuid"
 )
 
+const (
+	VideoStatusPending    = "pending"
+	VideoStatusProcessing = "processing"
+	VideoStatusReady      = "ready"
+	VideoStatusFailed     = "failed"
+)
+
+const (
+	// VisibilityPrivate videos are only visible to their owner.
+	VisibilityPrivate = "private"
+	// VisibilityUnlisted videos are visible to anyone with the ID but aren't
+	// listed in the public feed.
+	VisibilityUnlisted = "unlisted"
+	VisibilityPublic   = "public"
+)
+
+func ValidVisibility(visibility string) bool {
+	switch visibility {
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+		return true
+	}
+	return false
+}
+
 type Video struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	ID               uuid.UUID      `json:"id"`
+	CreatedAt        time.Time      `json:"created_at"`
+	UpdatedAt        time.Time      `json:"updated_at"`
+	ThumbnailURL     *string        `json:"thumbnail_url"`
+	Thumbnails       *Thumbnails    `json:"thumbnails"`
+	SpriteURL        *string        `json:"sprite_url"`
+	SpriteVTTURL     *string        `json:"sprite_vtt_url"`
+	VideoURL         *string        `json:"video_url"`
+	HLSURL           *string        `json:"hls_url"`
+	ProcessingStatus string         `json:"processing_status"`
+	ProcessingError  *string        `json:"processing_error"`
+	Metadata         *VideoMetadata `json:"metadata"`
+	// DeletedAt is set while the video is in the trash.
+	DeletedAt *time.Time `json:"deleted_at"`
 	CreateVideoParams
 }
 
 type CreateVideoParams struct {
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	UserID      uuid.UUID `json:"user_id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Visibility  string     `json:"visibility"`
+	OrgID       *uuid.UUID `json:"org_id"`
+	UserID      uuid.UUID  `json:"user_id"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
-	FROM videos
-	WHERE user_id = ?
-	ORDER BY created_at DESC
-	`
+// videoColumns lists every video column plus its probe metadata, in the
+// order scanVideo expects.
+const videoColumns = `
+		v.id,
+		v.created_at,
+		v.updated_at,
+		v.title,
+		v.description,
+		v.thumbnail_url,
+		v.thumbnails,
+		v.sprite_url,
+		v.sprite_vtt_url,
+		v.video_url,
+		v.hls_url,
+		v.processing_status,
+		v.processing_error,
+		v.visibility,
+		v.org_id,
+		v.user_id,
+		v.deleted_at,
+		m.video_id,
+		m.duration_seconds,
+		m.width,
+		m.height,
+		m.video_codec,
+		m.audio_codec,
+		m.bit_rate,
+		m.frame_rate,
+		m.audio_channels,
+		m.rotation,
+		m.container,
+		m.size_bytes`
 
-	rows, err := c.db.Query(query, userID)
+const videoFrom = `
+	FROM videos v
+	LEFT JOIN video_metadata m ON m.video_id = v.id
+`
+
+const videoSelect = `
+	SELECT` + videoColumns + videoFrom
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanVideo scans a row selected with videoColumns. Any extra columns
+// selected after them are scanned into extra.
+func scanVideo(row rowScanner, extra ...any) (Video, error) {
+	var video Video
+	var metaVideoID sql.NullString
+	var meta struct {
+		DurationSeconds sql.NullFloat64
+		Width           sql.NullInt64
+		Height          sql.NullInt64
+		VideoCodec      sql.NullString
+		AudioCodec      sql.NullString
+		BitRate         sql.NullInt64
+		FrameRate       sql.NullFloat64
+		AudioChannels   sql.NullInt64
+		Rotation        sql.NullInt64
+		Container       sql.NullString
+		SizeBytes       sql.NullInt64
+	}
+	err := row.Scan(append([]any{
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.Thumbnails,
+		&video.SpriteURL,
+		&video.SpriteVTTURL,
+		&video.VideoURL,
+		&video.HLSURL,
+		&video.ProcessingStatus,
+		&video.ProcessingError,
+		&video.Visibility,
+		&video.OrgID,
+		&video.UserID,
+		&video.DeletedAt,
+		&metaVideoID,
+		&meta.DurationSeconds,
+		&meta.Width,
+		&meta.Height,
+		&meta.VideoCodec,
+		&meta.AudioCodec,
+		&meta.BitRate,
+		&meta.FrameRate,
+		&meta.AudioChannels,
+		&meta.Rotation,
+		&meta.Container,
+		&meta.SizeBytes,
+	}, extra...)...)
+	if err != nil {
+		return Video{}, err
+	}
+
+	if metaVideoID.Valid {
+		video.Metadata = &VideoMetadata{
+			DurationSeconds: meta.DurationSeconds.Float64,
+			Width:           int(meta.Width.Int64),
+			Height:          int(meta.Height.Int64),
+			VideoCodec:      meta.VideoCodec.String,
+			AudioCodec:      meta.AudioCodec.String,
+			BitRate:         meta.BitRate.Int64,
+			FrameRate:       meta.FrameRate.Float64,
+			AudioChannels:   int(meta.AudioChannels.Int64),
+			Rotation:        int(meta.Rotation.Int64),
+			Container:       meta.Container.String,
+			SizeBytes:       meta.SizeBytes.Int64,
+		}
+	}
+	return video, nil
+}
+
+func (c sqlClient) queryVideos(query string, args ...any) ([]Video, error) {
+	rows, err := c.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -47,27 +183,33 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
 	}
 
-	return videos, nil
+	return videos, rows.Err()
 }
 
-func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
+// GetPublicVideos returns the newest public videos that are ready to play,
+// across all users.
+func (c sqlClient) GetPublicVideos(limit int) ([]Video, error) {
+	query := videoSelect + `
+	WHERE v.visibility = ? AND v.video_url IS NOT NULL AND v.deleted_at IS NULL
+	ORDER BY v.created_at DESC
+	LIMIT ?
+	`
+
+	return c.queryVideos(query, VisibilityPublic, limit)
+}
+
+func (c sqlClient) CreateVideo(params CreateVideoParams) (Video, error) {
 	id := uuid.New()
+	if params.Visibility == "" {
+		params.Visibility = VisibilityPrivate
+	}
 	query := `
 	INSERT INTO videos (
 		id,
@@ -75,10 +217,12 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
+		visibility,
+		org_id,
 		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	_, err := c.db.Exec(query, id, params.Title, params.Description, params.Visibility, params.OrgID, params.UserID)
 	if err != nil {
 		return Video{}, err
 	}
@@ -86,31 +230,22 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 	return c.GetVideo(id)
 }
 
-func (c Client) GetVideo(id uuid.UUID) (Video, error) {
-	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
-	FROM videos
-	WHERE id = ?
+// GetVideo returns a video unless it doesn't exist or is in the trash.
+func (c sqlClient) GetVideo(id uuid.UUID) (Video, error) {
+	return c.getVideo(id, false)
+}
+
+// GetTrashedVideo returns a video only if it is in the trash.
+func (c sqlClient) GetTrashedVideo(id uuid.UUID) (Video, error) {
+	return c.getVideo(id, true)
+}
+
+func (c sqlClient) getVideo(id uuid.UUID, trashed bool) (Video, error) {
+	query := videoSelect + `
+	WHERE v.id = ? AND ` + nullCheck("v.deleted_at", trashed) + `
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -121,35 +256,124 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	return video, nil
 }
 
-func (c Client) UpdateVideo(video Video) error {
+// UpdateVideo saves every field of video and bumps its updated_at.
+func (c sqlClient) UpdateVideo(video Video) error {
+	return updateVideo(c.db, c.db.dialect, video)
+}
+
+// UpdateVideoIfUnmodified saves video only if its updated_at still equals
+// unmodifiedSince, so two editors can't silently overwrite each other. It
+// reports false if the video changed or no longer exists.
+func (c sqlClient) UpdateVideoIfUnmodified(video Video, unmodifiedSince time.Time) (bool, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var updatedAt time.Time
+	err = tx.QueryRow("SELECT updated_at FROM videos WHERE id = ?"+tx.dialect.forUpdate(), video.ID).Scan(&updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !updatedAt.Equal(unmodifiedSince) {
+		return false, nil
+	}
+
+	err = updateVideo(tx, tx.dialect, video)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func updateVideo(db execer, d dialect, video Video) error {
 	query := `
 	UPDATE videos
 	SET
 		title = ?,
 		description = ?,
 		thumbnail_url = ?,
+		thumbnails = ?,
+		sprite_url = ?,
+		sprite_vtt_url = ?,
 		video_url = ?,
-		user_id = ?
+		hls_url = ?,
+		processing_status = ?,
+		processing_error = ?,
+		visibility = ?,
+		org_id = ?,
+		user_id = ?,
+		updated_at = ` + d.now() + `
 	WHERE id = ?
 	`
 
-	_, err := c.db.Exec(
+	_, err := db.Exec(
 		query,
 		video.Title,
 		video.Description,
 		&video.ThumbnailURL,
+		video.Thumbnails,
+		video.SpriteURL,
+		video.SpriteVTTURL,
 		&video.VideoURL,
+		video.HLSURL,
+		video.ProcessingStatus,
+		video.ProcessingError,
+		video.Visibility,
+		video.OrgID,
 		video.UserID,
 		video.ID,
 	)
 	return err
 }
 
-func (c Client) DeleteVideo(id uuid.UUID) error {
+func (c sqlClient) SetVideoProcessingStatus(id uuid.UUID, status string, processingError *string) error {
 	query := `
-	DELETE FROM videos
+	UPDATE videos
+	SET
+		processing_status = ?,
+		processing_error = ?,
+		updated_at = ` + c.db.dialect.now() + `
 	WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id)
+	_, err := c.db.Exec(query, status, processingError, id)
 	return err
 }
+
+// DeleteVideo deletes a video along with every row that references it,
+// since Postgres enforces the foreign keys.
+func (c sqlClient) DeleteVideo(id uuid.UUID) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		"DELETE FROM video_metadata WHERE video_id = ?",
+		"DELETE FROM video_grants WHERE video_id = ?",
+		"DELETE FROM processing_jobs WHERE video_id = ?",
+		"DELETE FROM direct_uploads WHERE video_id = ?",
+		"DELETE FROM upload_chunks WHERE session_id IN (SELECT id FROM upload_sessions WHERE video_id = ?)",
+		"DELETE FROM upload_sessions WHERE video_id = ?",
+		"DELETE FROM videos WHERE id = ?",
+	} {
+		_, err = tx.Exec(query, id)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
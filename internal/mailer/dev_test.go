@@ -0,0 +1,33 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileMailerWritesMessages(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewFileMailer(dir, "noreply@example.com")
+	if err != nil {
+		t.Fatalf("NewFileMailer: %v", err)
+	}
+	err = m.Send(context.Background(), Message{To: "user@example.com", Subject: "Hello", Body: "Hi\n"})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("found %v, %v; want one .eml file", files, err)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !strings.Contains(string(data), "To: user@example.com\r\n") || !strings.HasSuffix(string(data), "\r\n\r\nHi\r\n") {
+		t.Errorf("message = %q, want the headers and body", data)
+	}
+}
@@ -0,0 +1,130 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTPServer accepts one connection and speaks just enough SMTP to take
+// a message without TLS or AUTH. The message data is sent on the returned
+// channel.
+func fakeSMTPServer(t *testing.T) (addr string, data <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(command, "MAIL FROM"), strings.HasPrefix(command, "RCPT TO"):
+				reply("250 OK")
+			case command == "DATA":
+				reply("354 Go ahead")
+				var b strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					b.WriteString(line)
+				}
+				received <- b.String()
+				reply("250 OK")
+			case command == "QUIT":
+				reply("221 Bye")
+				return
+			default:
+				reply("502 Not implemented")
+			}
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	addr, received := fakeSMTPServer(t)
+	host, port, _ := net.SplitHostPort(addr)
+	m := NewSMTPMailer(host, port, "", "", "Tubely <noreply@example.com>")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := m.Send(ctx, Message{To: "user@example.com", Subject: "Hello", Body: "Line one\nLine two\n"})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	data := <-received
+	for _, want := range []string{
+		"From: Tubely <noreply@example.com>\r\n",
+		"To: user@example.com\r\n",
+		"Subject: Hello\r\n",
+		"\r\n\r\nLine one\r\nLine two\r\n",
+	} {
+		if !strings.Contains(data, want) {
+			t.Errorf("message %q doesn't contain %q", data, want)
+		}
+	}
+}
+
+func TestSMTPMailerRejectsHeaderInjection(t *testing.T) {
+	m := NewSMTPMailer("127.0.0.1", "1", "", "", "noreply@example.com")
+	err := m.Send(context.Background(), Message{To: "user@example.com\r\nBcc: someone@example.com", Subject: "Hello"})
+	if err == nil {
+		t.Error("Send accepted a recipient with a line break")
+	}
+}
+
+func TestSMTPMailerGivesUpOnStalledServer(t *testing.T) {
+	// The server accepts the connection but never greets.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	m := NewSMTPMailer(host, port, "", "", "noreply@example.com")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = m.Send(ctx, Message{To: "user@example.com", Subject: "Hello"})
+	if err == nil {
+		t.Fatal("Send succeeded against a server that never answered")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Send took %v to give up, want it bounded by the context", elapsed)
+	}
+}
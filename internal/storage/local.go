@@ -0,0 +1,400 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LocalStore keeps objects as files under a root directory. Presigned URLs
+// point back at the server itself and are checked by ServeHTTP.
+type LocalStore struct {
+	root       string
+	baseURL    string
+	signingKey []byte
+}
+
+func NewLocalStore(root, baseURL, signingKey string) (*LocalStore, error) {
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalStore{
+		root:       filepath.Clean(root),
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		signingKey: []byte(signingKey),
+	}, nil
+}
+
+func (s *LocalStore) diskPath(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" || strings.HasPrefix(cleaned, "/.") || strings.Contains(key, "\\") {
+		return "", fmt.Errorf("invalid object key: %q", key)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(cleaned)), nil
+}
+
+func (s *LocalStore) Put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	dstPath, err := s.diskPath(key)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dstPath, body)
+}
+
+func (s *LocalStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	info, err := s.Head(ctx, key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	diskPath, _ := s.diskPath(key)
+	f, err := os.Open(diskPath)
+	if err != nil {
+		return nil, ObjectInfo{}, translateFSError(err)
+	}
+	return f, info, nil
+}
+
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	diskPath, err := s.diskPath(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(diskPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	// Prune directories left empty, such as a deleted video's HLS prefix.
+	// os.Remove refuses to delete directories that still have files.
+	for dir := filepath.Dir(diskPath); dir != s.root && strings.HasPrefix(dir, s.root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *LocalStore) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	return filepath.WalkDir(s.root, func(diskPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Skip in-progress multipart uploads and atomic write temp files.
+		if strings.HasPrefix(d.Name(), ".") && diskPath != s.root {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return ctx.Err()
+		}
+		rel, err := filepath.Rel(s.root, diskPath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		stat, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(ObjectInfo{
+			Key:          key,
+			Size:         stat.Size(),
+			LastModified: stat.ModTime(),
+		})
+	})
+}
+
+func (s *LocalStore) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	diskPath, err := s.diskPath(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	f, err := os.Open(diskPath)
+	if err != nil {
+		return ObjectInfo{}, translateFSError(err)
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if stat.IsDir() {
+		return ObjectInfo{}, ErrNotFound
+	}
+
+	sniff := make([]byte, 512)
+	n, _ := io.ReadFull(f, sniff)
+
+	return ObjectInfo{
+		Key:          key,
+		Size:         stat.Size(),
+		ContentType:  http.DetectContentType(sniff[:n]),
+		LastModified: stat.ModTime(),
+	}, nil
+}
+
+func (s *LocalStore) PresignGet(ctx context.Context, key string, expires time.Duration) (string, error) {
+	return s.presign(http.MethodGet, key, "", 0, -1, expires)
+}
+
+func (s *LocalStore) PresignPut(ctx context.Context, key, contentType string, size int64, expires time.Duration) (string, error) {
+	return s.presign(http.MethodPut, key, "", 0, size, expires)
+}
+
+func (s *LocalStore) multipartDir(uploadID string) string {
+	return filepath.Join(s.root, ".multipart", uploadID)
+}
+
+func (s *LocalStore) CreateMultipartUpload(ctx context.Context, key, contentType string) (string, error) {
+	if _, err := s.diskPath(key); err != nil {
+		return "", err
+	}
+	idData := make([]byte, 16)
+	_, err := rand.Read(idData)
+	if err != nil {
+		return "", err
+	}
+	uploadID := hex.EncodeToString(idData)
+	err = os.MkdirAll(s.multipartDir(uploadID), 0755)
+	if err != nil {
+		return "", err
+	}
+	return uploadID, nil
+}
+
+func (s *LocalStore) PresignUploadPart(ctx context.Context, key, uploadID string, partNumber int32, size int64, expires time.Duration) (string, error) {
+	return s.presign(http.MethodPut, key, uploadID, partNumber, size, expires)
+}
+
+func (s *LocalStore) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []CompletedPart) error {
+	dstPath, err := s.diskPath(key)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return errors.New("no parts to complete")
+	}
+
+	readers := make([]io.Reader, 0, len(parts))
+	for i, part := range parts {
+		if i > 0 && part.PartNumber <= parts[i-1].PartNumber {
+			return errors.New("parts must be in ascending order")
+		}
+		partPath := filepath.Join(s.multipartDir(uploadID), strconv.Itoa(int(part.PartNumber)))
+		f, err := os.Open(partPath)
+		if err != nil {
+			return fmt.Errorf("missing part %d: %w", part.PartNumber, err)
+		}
+		defer f.Close()
+
+		etag, err := fileETag(f)
+		if err != nil {
+			return err
+		}
+		if etag != strings.Trim(part.ETag, `"`) {
+			return fmt.Errorf("etag mismatch for part %d", part.PartNumber)
+		}
+		readers = append(readers, f)
+	}
+
+	err = writeFileAtomic(dstPath, io.MultiReader(readers...))
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(s.multipartDir(uploadID))
+}
+
+func (s *LocalStore) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	return os.RemoveAll(s.multipartDir(uploadID))
+}
+
+// presign signs a URL for method on key. A size of zero or more binds the
+// exact body length a PUT must send.
+func (s *LocalStore) presign(method, key, uploadID string, partNumber int32, size int64, expires time.Duration) (string, error) {
+	if _, err := s.diskPath(key); err != nil {
+		return "", err
+	}
+	expiresAt := strconv.FormatInt(time.Now().Add(expires).Unix(), 10)
+	query := url.Values{}
+	query.Set("expires", expiresAt)
+	if uploadID != "" {
+		query.Set("upload_id", uploadID)
+		query.Set("part_number", strconv.Itoa(int(partNumber)))
+	}
+	if size >= 0 {
+		query.Set("size", strconv.FormatInt(size, 10))
+	}
+	query.Set("signature", s.sign(method, key, query))
+	return s.baseURL + "/" + key + "?" + query.Encode(), nil
+}
+
+func (s *LocalStore) sign(method, key string, query url.Values) string {
+	mac := hmac.New(sha256.New, s.signingKey)
+	mac.Write([]byte(strings.Join([]string{
+		method,
+		key,
+		query.Get("expires"),
+		query.Get("upload_id"),
+		query.Get("part_number"),
+		query.Get("size"),
+	}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ServeHTTP serves GETs and accepts PUTs for URLs produced by the presign
+// methods. It expects to be mounted with the base URL's path prefix already
+// stripped.
+func (s *LocalStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	query := r.URL.Query()
+
+	signedMethod := r.Method
+	if signedMethod == http.MethodHead {
+		signedMethod = http.MethodGet
+	}
+	expiresUnix, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expiresUnix {
+		http.Error(w, "URL expired", http.StatusForbidden)
+		return
+	}
+	if !hmac.Equal([]byte(query.Get("signature")), []byte(s.sign(signedMethod, key, query))) {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+
+	diskPath, err := s.diskPath(key)
+	if err != nil {
+		http.Error(w, "Invalid key", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.serveObject(w, r, key, diskPath)
+	case http.MethodPut:
+		if uploadID := query.Get("upload_id"); uploadID != "" {
+			if _, err := os.Stat(s.multipartDir(uploadID)); err != nil {
+				http.Error(w, "Unknown upload", http.StatusNotFound)
+				return
+			}
+			diskPath = filepath.Join(s.multipartDir(uploadID), query.Get("part_number"))
+		}
+		size, err := strconv.ParseInt(query.Get("size"), 10, 64)
+		if err != nil || r.ContentLength != size {
+			http.Error(w, "Content-Length doesn't match the signed size", http.StatusBadRequest)
+			return
+		}
+		// The server already stops at Content-Length; MaxBytesReader makes
+		// sure nothing beyond the signed size is written either way.
+		body := http.MaxBytesReader(w, r.Body, size)
+		err = writeFileAtomic(diskPath, body)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "Body is larger than the signed size", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Couldn't store object", http.StatusInternalServerError)
+			return
+		}
+		f, err := os.Open(diskPath)
+		if err != nil {
+			http.Error(w, "Couldn't store object", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		etag, err := fileETag(f)
+		if err != nil {
+			http.Error(w, "Couldn't store object", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("ETag", `"`+etag+`"`)
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *LocalStore) serveObject(w http.ResponseWriter, r *http.Request, key, diskPath string) {
+	f, err := os.Open(diskPath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil || stat.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, path.Base(key), stat.ModTime(), f)
+}
+
+func writeFileAtomic(dstPath string, body io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(dstPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dstPath), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	_, err = io.Copy(tmp, body)
+	if err != nil {
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dstPath)
+}
+
+// fileETag returns the MD5 hex digest of f, matching what S3 reports for
+// single-part uploads, and rewinds f afterwards.
+func fileETag(f *os.File) (string, error) {
+	hash := md5.New()
+	_, err := io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func translateFSError(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+// ObjectStore is the blob storage used for uploaded media. Keys are
+// slash-separated paths such as "landscape/<id>".
+type ObjectStore interface {
+	Put(ctx context.Context, key string, body io.Reader, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	Head(ctx context.Context, key string) (ObjectInfo, error)
+	PresignGet(ctx context.Context, key string, expires time.Duration) (string, error)
+	// List calls fn for every object whose key starts with prefix, stopping
+	// at the first error fn returns.
+	List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+}
+
+type CompletedPart struct {
+	PartNumber int32  `json:"part_number"`
+	ETag       string `json:"etag"`
+}
+
+// DirectUploader is implemented by stores that let clients upload straight
+// to storage through presigned URLs instead of streaming through the API.
+// Presigned PUTs only accept a body of exactly size bytes.
+type DirectUploader interface {
+	PresignPut(ctx context.Context, key, contentType string, size int64, expires time.Duration) (string, error)
+	CreateMultipartUpload(ctx context.Context, key, contentType string) (string, error)
+	PresignUploadPart(ctx context.Context, key, uploadID string, partNumber int32, size int64, expires time.Duration) (string, error)
+	CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []CompletedPart) error
+	AbortMultipartUpload(ctx context.Context, key, uploadID string) error
+}
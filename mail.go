@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
+	"github.com/google/uuid"
+)
+
+const (
+	emailVerificationTTL = 24 * time.Hour
+	passwordResetTTL     = time.Hour
+	mailSendTimeout      = time.Minute
+)
+
+// sendUserToken mails the user a link into the app carrying a new
+// single-use token for purpose. The mail is sent in the background, so how
+// long a request takes doesn't reveal whether the account exists. That
+// means the send outlives the request: it keeps ctx's values but not its
+// cancellation, and is bounded by mailSendTimeout instead.
+func (cfg *apiConfig) sendUserToken(ctx context.Context, user database.User, purpose string) error {
+	token, err := auth.MakeRefreshToken()
+	if err != nil {
+		return err
+	}
+
+	var ttl time.Duration
+	var msg mailer.Message
+	link := cfg.appBaseURL + "/app/#" + url.Values{purpose: {token}}.Encode()
+	switch purpose {
+	case database.TokenPurposeVerifyEmail:
+		ttl = emailVerificationTTL
+		msg = mailer.Message{
+			Subject: "Verify your Tubely email address",
+			Body: fmt.Sprintf("Open this link to verify your email address:\n\n%s\n\n"+
+				"It expires in 24 hours. If you didn't sign up for Tubely, you can ignore this email.\n", link),
+		}
+	case database.TokenPurposeResetPassword:
+		ttl = passwordResetTTL
+		msg = mailer.Message{
+			Subject: "Reset your Tubely password",
+			Body: fmt.Sprintf("Open this link to choose a new password:\n\n%s\n\n"+
+				"It expires in an hour. If you didn't ask to reset your password, you can ignore this email.\n", link),
+		}
+	default:
+		return fmt.Errorf("unknown token purpose %q", purpose)
+	}
+	msg.To = user.Email
+
+	err = cfg.db.CreateUserToken(auth.HashToken(token), user.ID, purpose, time.Now().Add(ttl))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), mailSendTimeout)
+	go func() {
+		defer cancel()
+		err := cfg.mailer.Send(ctx, msg)
+		if err != nil {
+			log.Printf("Couldn't send %s email to user %s: %v", purpose, user.ID, err)
+		}
+	}()
+	return nil
+}
+
+// useUserToken checks a mailed token and marks it used, writing the error
+// response itself when it can't be used.
+func (cfg *apiConfig) useUserToken(w http.ResponseWriter, token, purpose string) (uuid.UUID, bool) {
+	tokenHash := auth.HashToken(token)
+	userToken, err := cfg.db.GetUserToken(tokenHash, purpose)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get token", err)
+		return uuid.Nil, false
+	}
+	if !userToken.Valid() {
+		respondWithError(w, http.StatusBadRequest, "Link is invalid or has expired", nil)
+		return uuid.Nil, false
+	}
+
+	used, err := cfg.db.UseUserToken(tokenHash)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't use token", err)
+		return uuid.Nil, false
+	}
+	if !used {
+		respondWithError(w, http.StatusBadRequest, "Link is invalid or has expired", nil)
+		return uuid.Nil, false
+	}
+	return userToken.UserID, true
+}
@@ -5,27 +5,43 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
 	"github.com/google/uuid"
 
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
 )
 
 type apiConfig struct {
-	db               database.Client
-	jwtSecret        string
-	platform         string
-	filepathRoot     string
-	assetsRoot       string
-	s3Bucket         string
-	s3Region         string
-	s3CfDistribution string
-	port             string
-	s3Client         *s3.Client
+	db                 database.Client
+	jwtSecret          string
+	accessTokenTTL     time.Duration
+	refreshTokenTTL    time.Duration
+	oidc               *oidcConfig
+	mailer             mailer.Mailer
+	appBaseURL         string
+	platform           string
+	filepathRoot       string
+	assetsRoot         string
+	assetsBaseURL      string
+	uploadsRoot        string
+	s3Bucket           string
+	s3Region           string
+	s3CfDistribution   string
+	port               string
+	store              storage.ObjectStore
+	jobsWake           chan struct{}
+	hlsEnabled         bool
+	thumbnailTimestamp float64
+	spritesEnabled     bool
 }
 
 type thumbnail struct {
@@ -38,12 +54,25 @@ var videoThumbnails = map[uuid.UUID]thumbnail{}
 func main() {
 	godotenv.Load(".env")
 
-	pathToDB := os.Getenv("DB_PATH")
-	if pathToDB == "" {
-		log.Fatal("DB_URL must be set")
+	// DB_URL takes a postgres:// URL or a sqlite path; DB_PATH is the older
+	// sqlite-only setting.
+	dbURL := os.Getenv("DB_URL")
+	if dbURL == "" {
+		dbURL = os.Getenv("DB_PATH")
+	}
+	if dbURL == "" {
+		log.Fatal("DB_URL or DB_PATH must be set")
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err := runMigrateCommand(dbURL, os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	db, err := database.NewClient(pathToDB)
+	db, err := database.NewClient(dbURL)
 	if err != nil {
 		log.Fatalf("Couldn't connect to database: %v", err)
 	}
@@ -63,24 +92,70 @@ func main() {
 		log.Fatal("FILEPATH_ROOT environment variable is not set")
 	}
 
+	// Only needed to keep serving assets saved before they moved to storage.
 	assetsRoot := os.Getenv("ASSETS_ROOT")
-	if assetsRoot == "" {
-		log.Fatal("ASSETS_ROOT environment variable is not set")
+
+	uploadsRoot := os.Getenv("UPLOADS_ROOT")
+	if uploadsRoot == "" {
+		uploadsRoot = filepath.Join(os.TempDir(), "tubely-uploads")
 	}
 
-	s3Bucket := os.Getenv("S3_BUCKET")
-	if s3Bucket == "" {
-		log.Fatal("S3_BUCKET environment variable is not set")
+	processingWorkers := 2
+	if workers := os.Getenv("PROCESSING_WORKERS"); workers != "" {
+		processingWorkers, err = strconv.Atoi(workers)
+		if err != nil || processingWorkers < 1 {
+			log.Fatal("PROCESSING_WORKERS must be a positive integer")
+		}
 	}
 
-	s3Region := os.Getenv("S3_REGION")
-	if s3Region == "" {
-		log.Fatal("S3_REGION environment variable is not set")
+	hlsEnabled := os.Getenv("HLS_ENABLED") == "true"
+
+	thumbnailTimestamp := 1.0
+	if timestamp := os.Getenv("THUMBNAIL_TIMESTAMP"); timestamp != "" {
+		thumbnailTimestamp, err = strconv.ParseFloat(timestamp, 64)
+		if err != nil || thumbnailTimestamp < 0 {
+			log.Fatal("THUMBNAIL_TIMESTAMP must be a non-negative number of seconds")
+		}
+	}
+
+	spritesEnabled := os.Getenv("THUMBNAIL_SPRITES") == "true"
+
+	var gcInterval time.Duration
+	if interval := os.Getenv("GC_INTERVAL"); interval != "" {
+		gcInterval, err = time.ParseDuration(interval)
+		if err != nil || gcInterval <= 0 {
+			log.Fatal("GC_INTERVAL must be a positive duration such as 24h")
+		}
+	}
+	trashRetention := defaultTrashRetention
+	if retention := os.Getenv("TRASH_RETENTION"); retention != "" {
+		trashRetention, err = time.ParseDuration(retention)
+		if err != nil || trashRetention < 0 {
+			log.Fatal("TRASH_RETENTION must be a non-negative duration such as 720h")
+		}
 	}
 
-	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
+	gcGracePeriod := defaultGCGracePeriod
+	if grace := os.Getenv("GC_GRACE_PERIOD"); grace != "" {
+		gcGracePeriod, err = time.ParseDuration(grace)
+		if err != nil || gcGracePeriod < 0 {
+			log.Fatal("GC_GRACE_PERIOD must be a non-negative duration such as 24h")
+		}
+	}
+
+	accessTokenTTL := defaultAccessTokenTTL
+	if ttl := os.Getenv("ACCESS_TOKEN_TTL"); ttl != "" {
+		accessTokenTTL, err = time.ParseDuration(ttl)
+		if err != nil || accessTokenTTL <= 0 {
+			log.Fatal("ACCESS_TOKEN_TTL must be a positive duration such as 15m")
+		}
+	}
+	refreshTokenTTL := defaultRefreshTokenTTL
+	if ttl := os.Getenv("REFRESH_TOKEN_TTL"); ttl != "" {
+		refreshTokenTTL, err = time.ParseDuration(ttl)
+		if err != nil || refreshTokenTTL <= 0 {
+			log.Fatal("REFRESH_TOKEN_TTL must be a positive duration such as 1440h")
+		}
 	}
 
 	port := os.Getenv("PORT")
@@ -88,23 +163,151 @@ func main() {
 		log.Fatal("PORT environment variable is not set")
 	}
 
-	s3Config, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
-	if err != nil {
-		log.Fatal(err)
+	storageBackend := os.Getenv("STORAGE_BACKEND")
+	if storageBackend == "" {
+		storageBackend = "s3"
+	}
+
+	var s3Bucket, s3Region, s3CfDistribution, localRoot string
+	var store storage.ObjectStore
+	var localStore *storage.LocalStore
+	// Assets are public, so they're served straight from this URL instead
+	// of through presigned URLs.
+	var assetsBaseURL string
+
+	switch storageBackend {
+	case "s3":
+		s3Bucket = os.Getenv("S3_BUCKET")
+		if s3Bucket == "" {
+			log.Fatal("S3_BUCKET environment variable is not set")
+		}
+
+		s3Region = os.Getenv("S3_REGION")
+		if s3Region == "" {
+			log.Fatal("S3_REGION environment variable is not set")
+		}
+
+		s3CfDistribution = os.Getenv("S3_CF_DISTRO")
+		if s3CfDistribution == "" {
+			log.Fatal("S3_CF_DISTRO environment variable is not set")
+		}
+		assetsBaseURL = s3CfDistribution
+		if !strings.Contains(assetsBaseURL, "://") {
+			assetsBaseURL = "https://" + assetsBaseURL
+		}
+
+		s3Config, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
+		if err != nil {
+			log.Fatal(err)
+		}
+		store = storage.NewS3Store(s3.NewFromConfig(s3Config), s3Bucket)
+
+	case "local":
+		localRoot = os.Getenv("STORAGE_LOCAL_ROOT")
+		if localRoot == "" {
+			log.Fatal("STORAGE_LOCAL_ROOT environment variable is not set")
+		}
+
+		localStore, err = storage.NewLocalStore(localRoot, "http://localhost:"+port+"/storage", jwtSecret)
+		if err != nil {
+			log.Fatalf("Couldn't create local storage directory: %v", err)
+		}
+		store = localStore
+		assetsBaseURL = "http://localhost:" + port + "/storage"
+
+	default:
+		log.Fatalf("Unknown STORAGE_BACKEND %q, expected \"s3\" or \"local\"", storageBackend)
+	}
+
+	if baseURL := os.Getenv("ASSETS_BASE_URL"); baseURL != "" {
+		assetsBaseURL = baseURL
+	}
+	assetsBaseURL = strings.TrimSuffix(assetsBaseURL, "/")
+
+	appBaseURL := os.Getenv("APP_BASE_URL")
+	if appBaseURL == "" {
+		appBaseURL = "http://localhost:" + port
+	}
+	appBaseURL = strings.TrimSuffix(appBaseURL, "/")
+
+	mailFrom := os.Getenv("MAIL_FROM")
+	if mailFrom == "" {
+		mailFrom = "Tubely <noreply@localhost>"
+	}
+	// The log and file mailers leave reset links wherever the server's logs
+	// or files end up, so outside development the choice has to be explicit.
+	mailerKind := os.Getenv("MAILER")
+	if mailerKind == "" {
+		if platform != "dev" {
+			log.Fatal("MAILER must be set to \"smtp\", \"file\" or \"log\" unless PLATFORM is dev")
+		}
+		mailerKind = "log"
+	}
+	var mail mailer.Mailer
+	switch mailerKind {
+	case "log":
+		mail = mailer.NewLogMailer(mailFrom)
+	case "file":
+		mailDir := os.Getenv("MAIL_DIR")
+		if mailDir == "" {
+			mailDir = "./mail"
+		}
+		mail, err = mailer.NewFileMailer(mailDir, mailFrom)
+		if err != nil {
+			log.Fatalf("Couldn't create mail directory: %v", err)
+		}
+	case "smtp":
+		smtpHost := os.Getenv("SMTP_HOST")
+		if smtpHost == "" {
+			log.Fatal("SMTP_HOST must be set when MAILER is smtp")
+		}
+		smtpPort := os.Getenv("SMTP_PORT")
+		if smtpPort == "" {
+			smtpPort = "587"
+		}
+		mail = mailer.NewSMTPMailer(smtpHost, smtpPort, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), mailFrom)
+	default:
+		log.Fatalf("Unknown MAILER %q, expected \"log\", \"file\" or \"smtp\"", mailerKind)
+	}
+
+	var oidc *oidcConfig
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		clientID := os.Getenv("OIDC_CLIENT_ID")
+		if clientID == "" {
+			log.Fatal("OIDC_CLIENT_ID must be set when OIDC_ISSUER is")
+		}
+		redirectURL := os.Getenv("OIDC_REDIRECT_URL")
+		if redirectURL == "" {
+			redirectURL = "http://localhost:" + port + "/api/oidc/callback"
+		}
+		oidc, err = newOIDCConfig(context.Background(), issuer, clientID, os.Getenv("OIDC_CLIENT_SECRET"), redirectURL)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-	s3Client := s3.NewFromConfig(s3Config)
 
 	cfg := apiConfig{
-		db:               db,
-		jwtSecret:        jwtSecret,
-		platform:         platform,
-		filepathRoot:     filepathRoot,
-		assetsRoot:       assetsRoot,
-		s3Bucket:         s3Bucket,
-		s3Region:         s3Region,
-		s3CfDistribution: s3CfDistribution,
-		port:             port,
-		s3Client:         s3Client,
+		db:                 db,
+		jwtSecret:          jwtSecret,
+		accessTokenTTL:     accessTokenTTL,
+		refreshTokenTTL:    refreshTokenTTL,
+		oidc:               oidc,
+		mailer:             mail,
+		appBaseURL:         appBaseURL,
+		platform:           platform,
+		filepathRoot:       filepathRoot,
+		assetsRoot:         assetsRoot,
+		assetsBaseURL:      assetsBaseURL,
+		uploadsRoot:        uploadsRoot,
+		s3Bucket:           s3Bucket,
+		s3Region:           s3Region,
+		s3CfDistribution:   s3CfDistribution,
+		port:               port,
+		store:              store,
+		jobsWake:           make(chan struct{}, 1),
+		hlsEnabled:         hlsEnabled,
+		thumbnailTimestamp: thumbnailTimestamp,
+		spritesEnabled:     spritesEnabled,
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -112,28 +315,47 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	err = os.MkdirAll(uploadsRoot, 0755)
+	if err != nil {
+		log.Fatalf("Couldn't create uploads directory: %v", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		err := runGCCommand(&cfg, os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	err = cfg.startVideoWorkers(context.Background(), processingWorkers)
+	if err != nil {
+		log.Fatalf("Couldn't start processing workers: %v", err)
+	}
+
+	cfg.startTrashPurger(context.Background(), trashRetention)
+	cfg.startUploadSessionPurger(context.Background())
+
+	if gcInterval > 0 {
+		cfg.startGarbageCollector(context.Background(), gcInterval, gcGracePeriod)
+	}
+
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
 	mux.Handle("/app/", appHandler)
 
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
-	mux.Handle("/assets/", nocacheMiddleware(assetsHandler))
-
-	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
-	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
-	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
-
-	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	if assetsRoot != "" {
+		assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
+		mux.Handle("/assets/", nocacheMiddleware(assetsHandler))
+	}
 
-	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
-	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
-	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
-	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
-	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
-	mux.HandleFunc("GET /api/thumbnails/{videoID}", cfg.handlerThumbnailGet)
-	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	if localStore != nil {
+		mux.Handle("/storage/", http.StripPrefix("/storage", localStore))
+		// Assets are public, so they skip the presigned URL check.
+		mux.Handle("/storage/"+assetKeyPrefix, noListingMiddleware(http.StripPrefix("/storage", http.FileServer(http.Dir(localRoot)))))
+	}
 
-	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	cfg.registerRoutes(mux)
 
 	srv := &http.Server{
 		Addr:    ":" + port,
@@ -143,3 +365,65 @@ func main() {
 	log.Printf("Serving on: http://localhost:%s/app/\n", port)
 	log.Fatal(srv.ListenAndServe())
 }
+
+// registerRoutes adds the API and admin endpoints to mux.
+func (cfg *apiConfig) registerRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
+	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
+	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
+	if cfg.oidc != nil {
+		mux.HandleFunc("GET /api/oidc", cfg.handlerOIDCInfo)
+		mux.HandleFunc("GET /api/oidc/login", cfg.handlerOIDCLogin)
+		mux.HandleFunc("GET /api/oidc/callback", cfg.handlerOIDCCallback)
+	}
+	mux.HandleFunc("GET /api/sessions", cfg.requireAuth(jwtOnly, cfg.handlerSessionsList))
+	mux.HandleFunc("DELETE /api/sessions", cfg.requireAuth(jwtOnly, cfg.handlerSessionsDeleteAll))
+	mux.HandleFunc("DELETE /api/sessions/{sessionID}", cfg.requireAuth(jwtOnly, cfg.handlerSessionsDelete))
+	mux.HandleFunc("POST /api/api_keys", cfg.requireAuth(jwtOnly, cfg.handlerAPIKeysCreate))
+	mux.HandleFunc("GET /api/api_keys", cfg.requireAuth(jwtOnly, cfg.handlerAPIKeysList))
+	mux.HandleFunc("DELETE /api/api_keys/{keyID}", cfg.requireAuth(jwtOnly, cfg.handlerAPIKeysDelete))
+
+	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	mux.HandleFunc("POST /api/email_verifications", cfg.requireAuth(jwtOnly, cfg.handlerEmailVerificationRequest))
+	mux.HandleFunc("POST /api/email_verifications/confirm", cfg.handlerEmailVerificationConfirm)
+	mux.HandleFunc("POST /api/password_resets", cfg.handlerPasswordResetRequest)
+	mux.HandleFunc("POST /api/password_resets/confirm", cfg.handlerPasswordResetConfirm)
+
+	mux.HandleFunc("POST /api/videos", cfg.requireAuth(database.ScopeVideosWrite, cfg.handlerVideoMetaCreate))
+	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.requireAuth(database.ScopeVideosWrite, cfg.handlerUploadThumbnail))
+	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.requireAuth(database.ScopeVideosWrite, cfg.handlerUploadVideo))
+	mux.HandleFunc("POST /api/video_upload/{videoID}/sessions", cfg.requireAuth(database.ScopeVideosWrite, cfg.handlerUploadSessionCreate))
+	mux.HandleFunc("GET /api/upload_sessions/{sessionID}", cfg.requireAuth(database.ScopeVideosWrite, cfg.handlerUploadSessionGet))
+	mux.HandleFunc("PUT /api/upload_sessions/{sessionID}/chunks/{chunkNumber}", cfg.requireAuth(database.ScopeVideosWrite, cfg.handlerUploadSessionChunk))
+	mux.HandleFunc("POST /api/upload_sessions/{sessionID}/complete", cfg.requireAuth(database.ScopeVideosWrite, cfg.handlerUploadSessionComplete))
+	mux.HandleFunc("POST /api/video_upload/{videoID}/direct", cfg.requireAuth(database.ScopeVideosWrite, cfg.handlerDirectUploadCreate))
+	mux.HandleFunc("POST /api/direct_uploads/{uploadID}/complete", cfg.requireAuth(database.ScopeVideosWrite, cfg.handlerDirectUploadComplete))
+	mux.HandleFunc("GET /api/videos", cfg.requireAuth(database.ScopeVideosRead, cfg.handlerVideosRetrieve))
+	mux.HandleFunc("GET /api/videos/{videoID}", cfg.optionalAuth(database.ScopeVideosRead, cfg.handlerVideoGet))
+	mux.HandleFunc("PATCH /api/videos/{videoID}", cfg.requireAuth(database.ScopeVideosWrite, cfg.handlerVideoMetaUpdate))
+	mux.HandleFunc("PUT /api/videos/{videoID}/visibility", cfg.requireAuth(database.ScopeVideosWrite, cfg.handlerVideoVisibilityUpdate))
+	mux.HandleFunc("GET /api/videos/{videoID}/grants", cfg.requireAuth(database.ScopeVideosRead, cfg.handlerVideoGrantsList))
+	mux.HandleFunc("PUT /api/videos/{videoID}/grants", cfg.requireAuth(database.ScopeVideosWrite, cfg.handlerVideoGrantsPut))
+	mux.HandleFunc("DELETE /api/videos/{videoID}/grants/{userID}", cfg.requireAuth(database.ScopeVideosWrite, cfg.handlerVideoGrantsDelete))
+	mux.HandleFunc("GET /api/feed", cfg.handlerPublicFeed)
+	mux.HandleFunc("GET /api/search", cfg.optionalAuth(database.ScopeVideosRead, cfg.handlerSearch))
+	mux.HandleFunc("GET /api/videos/{videoID}/hls/{playlist...}", cfg.handlerVideoHLS)
+	mux.HandleFunc("GET /api/thumbnails/{videoID}", cfg.handlerThumbnailGet)
+	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.requireAuth(database.ScopeVideosWrite, cfg.handlerVideoMetaDelete))
+	mux.HandleFunc("POST /api/videos/{videoID}/restore", cfg.requireAuth(database.ScopeVideosWrite, cfg.handlerVideoRestore))
+	mux.HandleFunc("GET /api/trash", cfg.requireAuth(database.ScopeVideosRead, cfg.handlerTrashList))
+	mux.HandleFunc("DELETE /api/trash/{videoID}", cfg.requireAuth(database.ScopeVideosWrite, cfg.handlerTrashDelete))
+
+	mux.HandleFunc("POST /api/orgs", cfg.requireAuth(jwtOnly, cfg.handlerOrgsCreate))
+	mux.HandleFunc("GET /api/orgs", cfg.requireAuth(jwtOnly, cfg.handlerOrgsList))
+	mux.HandleFunc("GET /api/orgs/{orgID}/members", cfg.requireAuth(jwtOnly, cfg.handlerOrgMembersList))
+	mux.HandleFunc("PUT /api/orgs/{orgID}/members/{userID}", cfg.requireAuth(jwtOnly, cfg.handlerOrgMembersUpdate))
+	mux.HandleFunc("DELETE /api/orgs/{orgID}/members/{userID}", cfg.requireAuth(jwtOnly, cfg.handlerOrgMembersDelete))
+	mux.HandleFunc("POST /api/orgs/{orgID}/invitations", cfg.requireAuth(jwtOnly, cfg.handlerOrgInvitationsCreate))
+	mux.HandleFunc("GET /api/orgs/{orgID}/invitations", cfg.requireAuth(jwtOnly, cfg.handlerOrgInvitationsList))
+	mux.HandleFunc("DELETE /api/orgs/{orgID}/invitations/{invitationID}", cfg.requireAuth(jwtOnly, cfg.handlerOrgInvitationsDelete))
+	mux.HandleFunc("GET /api/invitations", cfg.requireAuth(jwtOnly, cfg.handlerInvitationsList))
+	mux.HandleFunc("POST /api/invitations/{invitationID}/accept", cfg.requireAuth(jwtOnly, cfg.handlerInvitationsAccept))
+
+	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// testAPI is the API served from an in-memory sqlite database and a local
+// store in a temporary directory, recording mail instead of sending it.
+type testAPI struct {
+	cfg    *apiConfig
+	server *httptest.Server
+	mail   *testMailer
+}
+
+// newTestAPI starts a test server. Each configure func can adjust the
+// config before the routes are registered.
+func newTestAPI(t *testing.T, configure ...func(cfg *apiConfig)) *testAPI {
+	t.Helper()
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	db, err := database.NewClient(":memory:")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	const jwtSecret = "test-secret"
+	store, err := storage.NewLocalStore(t.TempDir(), server.URL+"/storage", jwtSecret)
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+	mux.Handle("/storage/", http.StripPrefix("/storage", store))
+
+	mail := &testMailer{}
+	cfg := &apiConfig{
+		db:                 db,
+		jwtSecret:          jwtSecret,
+		accessTokenTTL:     defaultAccessTokenTTL,
+		refreshTokenTTL:    defaultRefreshTokenTTL,
+		mailer:             mail,
+		appBaseURL:         server.URL,
+		platform:           "test",
+		assetsBaseURL:      server.URL + "/storage",
+		uploadsRoot:        t.TempDir(),
+		store:              store,
+		jobsWake:           make(chan struct{}, 1),
+		thumbnailTimestamp: 1,
+	}
+	for _, fn := range configure {
+		fn(cfg)
+	}
+	cfg.registerRoutes(mux)
+
+	return &testAPI{cfg: cfg, server: server, mail: mail}
+}
+
+// do sends a request with an optional bearer token and JSON body.
+func (api *testAPI) do(t *testing.T, method, path, token string, body any) *http.Response {
+	t.Helper()
+	authorization := ""
+	if token != "" {
+		authorization = "Bearer " + token
+	}
+	return api.doAuthorized(t, method, path, authorization, body)
+}
+
+// doAuthorized is do with any Authorization header, such as an API key.
+func (api *testAPI) doAuthorized(t *testing.T, method, path, authorization string, body any) *http.Response {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("encoding request body: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, api.server.URL+path, reader)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := api.server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// expect checks the response status and decodes the body into out, if
+// out isn't nil.
+func expect(t *testing.T, resp *http.Response, status int, out any) {
+	t.Helper()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s: status %d, want %d: %s", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, status, data)
+	}
+	if out != nil {
+		err = json.Unmarshal(data, out)
+		if err != nil {
+			t.Fatalf("decoding response %s: %v", data, err)
+		}
+	}
+}
+
+type testTokens struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// signUp creates a user and logs them in.
+func (api *testAPI) signUp(t *testing.T, email, password string) (database.User, testTokens) {
+	t.Helper()
+	var user database.User
+	expect(t, api.do(t, "POST", "/api/users", "", map[string]string{"email": email, "password": password}), http.StatusCreated, &user)
+	var tokens testTokens
+	expect(t, api.do(t, "POST", "/api/login", "", map[string]string{"email": email, "password": password}), http.StatusOK, &tokens)
+	return user, tokens
+}
+
+// testMailer keeps every message it's asked to send.
+type testMailer struct {
+	mu       sync.Mutex
+	messages []mailer.Message
+}
+
+func (m *testMailer) Send(ctx context.Context, msg mailer.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// waitFor returns the first message to to whose subject contains subject,
+// waiting a little since mail is sent in the background.
+func (m *testMailer) waitFor(t *testing.T, to, subject string) mailer.Message {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		m.mu.Lock()
+		for _, msg := range m.messages {
+			if msg.To == to && strings.Contains(msg.Subject, subject) {
+				m.mu.Unlock()
+				return msg
+			}
+		}
+		m.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no %q mail to %s", subject, to)
+	return mailer.Message{}
+}
+
+// mailedToken pulls the token for purpose out of the link in msg.
+func mailedToken(t *testing.T, msg mailer.Message, purpose string) string {
+	t.Helper()
+	_, link, found := strings.Cut(msg.Body, "/app/#")
+	if !found {
+		t.Fatalf("no app link in mail %q", msg.Body)
+	}
+	link, _, _ = strings.Cut(link, "\n")
+	values, err := url.ParseQuery(link)
+	if err != nil || values.Get(purpose) == "" {
+		t.Fatalf("no %s token in link %q", purpose, link)
+	}
+	return values.Get(purpose)
+}
+
+// testMP4 starts like an mp4 file, which is as far as the upload handlers
+// look before asking ffprobe.
+const testMP4 = "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"
+
+// fakeFFprobe puts an ffprobe on the PATH that describes every file as a
+// 1280x720 video.
+func fakeFFprobe(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	script := `#!/bin/sh
+echo '{"streams":[{"index":0,"codec_type":"video","codec_name":"h264","width":1280,"height":720}],"format":{"format_name":"mov,mp4"}}'
+`
+	err := os.WriteFile(filepath.Join(dir, "ffprobe"), []byte(script), 0o755)
+	if err != nil {
+		t.Fatalf("writing ffprobe: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
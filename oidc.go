@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// oidcConfig is the identity provider users can sign in with instead of a
+// password. It is nil when OIDC_ISSUER isn't set.
+type oidcConfig struct {
+	issuer        string
+	oauth2        oauth2.Config
+	verifier      *oidc.IDTokenVerifier
+	secureCookies bool
+}
+
+// newOIDCConfig discovers the provider's endpoints and signing keys from
+// its issuer URL.
+func newOIDCConfig(ctx context.Context, issuer, clientID, clientSecret, redirectURL string) (*oidcConfig, error) {
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't discover OIDC provider %s: %w", issuer, err)
+	}
+	return &oidcConfig{
+		issuer: issuer,
+		oauth2: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  redirectURL,
+			Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+		},
+		verifier:      provider.Verifier(&oidc.Config{ClientID: clientID}),
+		secureCookies: strings.HasPrefix(redirectURL, "https://"),
+	}, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	spriteColumns    = 10
+	spriteRows       = 10
+	spriteTileWidth  = 160
+	spriteTileHeight = 90
+)
+
+// extractThumbnail grabs a single JPEG frame at timestamp seconds. Videos
+// shorter than timestamp fall back to their first frame.
+func extractThumbnail(srcPath string, timestamp float64) (string, error) {
+	outFile, err := os.CreateTemp("", "tubely-thumbnail*.jpg")
+	if err != nil {
+		return "", err
+	}
+	outFile.Close()
+
+	for _, ts := range []float64{timestamp, 0} {
+		ffmpeg := exec.Command("ffmpeg", "-y",
+			"-ss", strconv.FormatFloat(ts, 'f', 3, 64),
+			"-i", srcPath,
+			"-frames:v", "1",
+			"-q:v", "2",
+			outFile.Name(),
+		)
+		output, err := ffmpeg.CombinedOutput()
+		if err != nil {
+			os.Remove(outFile.Name())
+			return "", fmt.Errorf("ffmpeg: %w: %s", err, lastLine(output))
+		}
+		if stat, err := os.Stat(outFile.Name()); err == nil && stat.Size() > 0 {
+			return outFile.Name(), nil
+		}
+		if ts == 0 {
+			break
+		}
+	}
+
+	os.Remove(outFile.Name())
+	return "", fmt.Errorf("no frame found in video")
+}
+
+// generateSpriteSheet tiles evenly spaced frames into a single JPEG for
+// scrubbing previews. It returns the image path, the seconds between frames
+// and how many tiles were filled.
+func generateSpriteSheet(srcPath string, duration float64) (string, float64, int, error) {
+	if duration <= 0 {
+		return "", 0, 0, fmt.Errorf("unknown video duration")
+	}
+	interval := max(duration/(spriteColumns*spriteRows), 1)
+	frames := min(spriteColumns*spriteRows, int(math.Ceil(duration/interval)))
+
+	outDir, err := os.MkdirTemp("", "tubely-sprite")
+	if err != nil {
+		return "", 0, 0, err
+	}
+	outPath := filepath.Join(outDir, "sprite.jpg")
+
+	filter := fmt.Sprintf("fps=1/%s,scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,tile=%dx%d",
+		strconv.FormatFloat(interval, 'f', 3, 64),
+		spriteTileWidth, spriteTileHeight,
+		spriteTileWidth, spriteTileHeight,
+		spriteColumns, spriteRows,
+	)
+	ffmpeg := exec.Command("ffmpeg", "-y",
+		"-i", srcPath,
+		"-vf", filter,
+		"-frames:v", "1",
+		"-q:v", "4",
+		outPath,
+	)
+	output, err := ffmpeg.CombinedOutput()
+	if err != nil {
+		os.RemoveAll(outDir)
+		return "", 0, 0, fmt.Errorf("ffmpeg: %w: %s", err, lastLine(output))
+	}
+	return outPath, interval, frames, nil
+}
+
+// spriteVTT builds a WebVTT thumbnails track mapping each interval of the
+// video to its tile in the sprite sheet at spriteURL.
+func spriteVTT(spriteURL string, interval float64, frames int) string {
+	vtt := &strings.Builder{}
+	vtt.WriteString("WEBVTT\n")
+	for i := 0; i < frames; i++ {
+		x := (i % spriteColumns) * spriteTileWidth
+		y := (i / spriteColumns) * spriteTileHeight
+		fmt.Fprintf(vtt, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			vttTimestamp(float64(i)*interval),
+			vttTimestamp(float64(i+1)*interval),
+			spriteURL, x, y, spriteTileWidth, spriteTileHeight,
+		)
+	}
+	return vtt.String()
+}
+
+func vttTimestamp(seconds float64) string {
+	ms := int(seconds * 1000)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// generatedImages are the images made for a video while it's processed.
+// Fields are nil for images that weren't made.
+type generatedImages struct {
+	thumbnailURL *string
+	thumbnails   *database.Thumbnails
+	spriteURL    *string
+	spriteVTTURL *string
+}
+
+// generateImages makes a thumbnail for videos that don't have one and, when
+// enabled, a scrubbing sprite sheet. Failures are logged rather than failing
+// processing since the video itself is still playable.
+func (cfg *apiConfig) generateImages(ctx context.Context, video database.Video, srcPath string, meta database.VideoMetadata) generatedImages {
+	images := generatedImages{}
+	if video.ThumbnailURL == nil {
+		thumbnailPath, err := extractThumbnail(srcPath, cfg.thumbnailTimestamp)
+		if err != nil {
+			log.Printf("Couldn't extract thumbnail for video %s: %v", video.ID, err)
+		} else {
+			thumbnails, thumbnailURL, err := cfg.saveThumbnailFile(ctx, video.ID, thumbnailPath, thumbnailAspect(&meta))
+			if err != nil {
+				log.Printf("Couldn't save thumbnail for video %s: %v", video.ID, err)
+			} else {
+				images.thumbnailURL = &thumbnailURL
+				images.thumbnails = &thumbnails
+			}
+		}
+	}
+
+	if !cfg.spritesEnabled {
+		return images
+	}
+	spritePath, interval, frames, err := generateSpriteSheet(srcPath, meta.DurationSeconds)
+	if err != nil {
+		log.Printf("Couldn't generate sprite sheet for video %s: %v", video.ID, err)
+		return images
+	}
+	defer os.RemoveAll(filepath.Dir(spritePath))
+
+	spriteURL, err := cfg.saveAssetFile(ctx, &video, spritePath, "image/jpeg")
+	if err != nil {
+		log.Printf("Couldn't save sprite sheet for video %s: %v", video.ID, err)
+		return images
+	}
+	vttURL, err := cfg.saveAsset(ctx, video.ID, strings.NewReader(spriteVTT(spriteURL, interval, frames)), "text/vtt")
+	if err != nil {
+		log.Printf("Couldn't save sprite track for video %s: %v", video.ID, err)
+		cfg.removeAssets(ctx, []string{spriteURL})
+		return images
+	}
+	images.spriteURL = &spriteURL
+	images.spriteVTTURL = &vttURL
+	return images
+}
+
+// applyTo sets the images on video and returns the assets to remove once
+// the video is saved: the sprite sheet it replaces, and the generated
+// thumbnail if the video got another one while it was being made.
+func (images generatedImages) applyTo(video *database.Video) []string {
+	stale := []string{}
+	if images.thumbnailURL != nil {
+		if video.ThumbnailURL == nil {
+			video.ThumbnailURL = images.thumbnailURL
+			video.Thumbnails = images.thumbnails
+		} else {
+			stale = append(stale, thumbnailAssetURLs(images.thumbnailURL, images.thumbnails)...)
+		}
+	}
+	if images.spriteURL != nil {
+		for _, oldURL := range []*string{video.SpriteURL, video.SpriteVTTURL} {
+			if oldURL != nil {
+				stale = append(stale, *oldURL)
+			}
+		}
+		video.SpriteURL = images.spriteURL
+		video.SpriteVTTURL = images.spriteVTTURL
+	}
+	return stale
+}
+
+// urls lists every asset that was made.
+func (images generatedImages) urls() []string {
+	urls := thumbnailAssetURLs(images.thumbnailURL, images.thumbnails)
+	for _, url := range []*string{images.spriteURL, images.spriteVTTURL} {
+		if url != nil {
+			urls = append(urls, *url)
+		}
+	}
+	return urls
+}
+
+// removeAssets deletes assets that are no longer referenced, logging
+// failures since the garbage collector will get to them eventually.
+func (cfg *apiConfig) removeAssets(ctx context.Context, urls []string) {
+	for _, url := range urls {
+		err := cfg.removeAsset(ctx, url)
+		if err != nil {
+			log.Printf("Couldn't remove asset %s: %v", url, err)
+		}
+	}
+}
+
+func (cfg *apiConfig) saveThumbnailFile(ctx context.Context, videoID uuid.UUID, diskPath string, aspect float64) (database.Thumbnails, string, error) {
+	defer os.Remove(diskPath)
+	data, err := os.ReadFile(diskPath)
+	if err != nil {
+		return database.Thumbnails{}, "", err
+	}
+	return cfg.saveThumbnail(ctx, videoID, data, aspect)
+}
+
+func (cfg *apiConfig) saveAssetFile(ctx context.Context, video *database.Video, diskPath, mediaType string) (string, error) {
+	f, err := os.Open(diskPath)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(diskPath)
+	defer f.Close()
+	return cfg.saveAsset(ctx, video.ID, f, mediaType)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	maxThumbnailDimension = 4096
+	maxThumbnailSize      = 32 << 20
+)
+
+// validationError is returned when an upload's content is rejected, carrying
+// the status and message to respond with.
+type validationError struct {
+	status int
+	msg    string
+	err    error
+}
+
+func (e *validationError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("%s: %v", e.msg, e.err)
+	}
+	return e.msg
+}
+
+func (e *validationError) Unwrap() error {
+	return e.err
+}
+
+// respondWithValidationError responds with the status carried by a
+// validationError, or a 500 for anything else.
+func respondWithValidationError(w http.ResponseWriter, fallbackMsg string, err error) {
+	var vErr *validationError
+	if errors.As(err, &vErr) {
+		respondWithError(w, vErr.status, vErr.msg, vErr.err)
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, fallbackMsg, err)
+}
+
+// sniffMP4 checks the ISO base media "ftyp" box that starts every MP4 file.
+func sniffMP4(header []byte) error {
+	if len(header) < 12 || !bytes.Equal(header[4:8], []byte("ftyp")) {
+		return &validationError{
+			status: http.StatusUnsupportedMediaType,
+			msg:    "Video must be an mp4 file",
+		}
+	}
+	return nil
+}
+
+func readHeader(r io.Reader) ([]byte, error) {
+	header := make([]byte, 512)
+	n, err := io.ReadFull(r, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return header[:n], nil
+}
+
+// validateVideoFile sniffs the file at path and confirms with ffprobe that
+// it has a decodable video stream, returning the probe results.
+func validateVideoFile(path string) (database.VideoMetadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return database.VideoMetadata{}, err
+	}
+	header, err := readHeader(f)
+	f.Close()
+	if err != nil {
+		return database.VideoMetadata{}, err
+	}
+
+	err = sniffMP4(header)
+	if err != nil {
+		return database.VideoMetadata{}, err
+	}
+	return probeVideoContent(path)
+}
+
+// probeVideoContent runs ffprobe on a file or URL, reporting failures as
+// unprocessable content rather than server errors.
+func probeVideoContent(path string) (database.VideoMetadata, error) {
+	meta, err := probeVideo(path)
+	if err != nil {
+		return database.VideoMetadata{}, &validationError{
+			status: http.StatusUnprocessableEntity,
+			msg:    "Video has no decodable video stream",
+			err:    err,
+		}
+	}
+	return meta, nil
+}
+
+// validateThumbnail sniffs and fully decodes an uploaded image, returning
+// its real media type.
+func validateThumbnail(data []byte) (string, error) {
+	mediaType := http.DetectContentType(data)
+	if mediaType != "image/jpeg" && mediaType != "image/png" {
+		return "", &validationError{
+			status: http.StatusUnsupportedMediaType,
+			msg:    "Thumbnail must be a jpeg or png image",
+		}
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", &validationError{
+			status: http.StatusUnprocessableEntity,
+			msg:    "Thumbnail image couldn't be decoded",
+			err:    err,
+		}
+	}
+	if config.Width > maxThumbnailDimension || config.Height > maxThumbnailDimension {
+		return "", &validationError{
+			status: http.StatusUnprocessableEntity,
+			msg:    fmt.Sprintf("Thumbnail must be at most %dx%d pixels", maxThumbnailDimension, maxThumbnailDimension),
+		}
+	}
+
+	_, _, err = image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", &validationError{
+			status: http.StatusUnprocessableEntity,
+			msg:    "Thumbnail image couldn't be decoded",
+			err:    err,
+		}
+	}
+	return mediaType, nil
+}
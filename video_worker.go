@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	maxProcessingAttempts  = 3
+	processingPollInterval = 5 * time.Second
+	// Heartbeats keep a job's lease with plenty of room to spare.
+	processingHeartbeatInterval = database.ProcessingJobLease / 4
+)
+
+// stageUpload copies the upload at srcPath into storage, where any server's
+// worker can read it, and returns its key.
+func (cfg *apiConfig) stageUpload(ctx context.Context, srcPath, mediaType string) (string, error) {
+	key, err := makeObjectKey("uploads")
+	if err != nil {
+		return "", err
+	}
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	err = cfg.store.Put(ctx, key, src, mediaType)
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// enqueueVideoProcessing records a processing job for the upload stored at
+// sourceKey and wakes an idle worker. The worker owns the object from here
+// on and deletes it when the job is over.
+func (cfg *apiConfig) enqueueVideoProcessing(videoID uuid.UUID, sourceKey, mediaType string) error {
+	_, err := cfg.db.CreateProcessingJob(database.CreateProcessingJobParams{
+		VideoID:     videoID,
+		SourceKey:   sourceKey,
+		ContentType: mediaType,
+	})
+	if err != nil {
+		return err
+	}
+	cfg.wakeVideoWorkers()
+	return nil
+}
+
+// wakeVideoWorkers tells an idle worker there's a new job, without waiting
+// for its next poll.
+func (cfg *apiConfig) wakeVideoWorkers() {
+	select {
+	case cfg.jobsWake <- struct{}{}:
+	default:
+	}
+}
+
+// startVideoWorkers starts n workers that drain the processing queue. Jobs
+// interrupted by a previous shutdown, here or on another server sharing the
+// database, are picked up again once their lease runs out.
+func (cfg *apiConfig) startVideoWorkers(ctx context.Context, n int) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		go cfg.runVideoWorker(ctx, hostname+"/"+uuid.NewString())
+	}
+	return nil
+}
+
+func (cfg *apiConfig) runVideoWorker(ctx context.Context, workerID string) {
+	ticker := time.NewTicker(processingPollInterval)
+	defer ticker.Stop()
+
+	for {
+		job, err := cfg.db.ClaimProcessingJob(workerID)
+		if err != nil {
+			log.Printf("Error claiming processing job: %v", err)
+		}
+		if err == nil && job.ID != uuid.Nil {
+			cfg.processVideoJob(ctx, job)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-cfg.jobsWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (cfg *apiConfig) processVideoJob(ctx context.Context, job database.ProcessingJob) {
+	log.Printf("Processing video %s (job %s, attempt %d)", job.VideoID, job.ID, job.Attempts)
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go cfg.heartbeatVideoJob(jobCtx, cancel, job)
+
+	// Attempts only go past the limit when workers died mid-job, for
+	// instance killed for running out of memory on this video.
+	if job.Attempts > maxProcessingAttempts {
+		cfg.failVideoJob(ctx, job, errors.New("processing was interrupted too many times"), false)
+		return
+	}
+
+	err := cfg.processStoredVideo(jobCtx, job)
+	if err != nil {
+		log.Printf("Processing job %s failed: %v", job.ID, err)
+		retry := job.Attempts < maxProcessingAttempts && !errors.Is(err, storage.ErrNotFound)
+		cfg.failVideoJob(ctx, job, err, retry)
+		return
+	}
+
+	owned, err := cfg.db.FinishProcessingJob(job)
+	if err != nil {
+		log.Printf("Error finishing job %s: %v", job.ID, err)
+		return
+	}
+	if owned {
+		cfg.deleteJobSource(ctx, job)
+	}
+}
+
+// failVideoJob records a failed attempt. The source is deleted once no
+// attempt is left, unless another worker has taken the job over.
+func (cfg *apiConfig) failVideoJob(ctx context.Context, job database.ProcessingJob, jobErr error, retry bool) {
+	owned, err := cfg.db.FailProcessingJob(job, jobErr.Error(), retry)
+	if err != nil {
+		log.Printf("Error recording failed job %s: %v", job.ID, err)
+		return
+	}
+	if owned && !retry {
+		cfg.deleteJobSource(ctx, job)
+	}
+}
+
+// deleteJobSource deletes a finished job's source. Should that fail, the
+// object is left for garbage collection.
+func (cfg *apiConfig) deleteJobSource(ctx context.Context, job database.ProcessingJob) {
+	err := cfg.store.Delete(ctx, job.SourceKey)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Printf("Couldn't delete source of job %s: %v", job.ID, err)
+	}
+}
+
+// heartbeatVideoJob renews job's lease until ctx is done. If another worker
+// has taken the job over it cancels the job instead.
+func (cfg *apiConfig) heartbeatVideoJob(ctx context.Context, cancel context.CancelFunc, job database.ProcessingJob) {
+	ticker := time.NewTicker(processingHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		owned, err := cfg.db.HeartbeatProcessingJob(job)
+		if err != nil {
+			log.Printf("Error renewing lease on job %s: %v", job.ID, err)
+			continue
+		}
+		if !owned {
+			log.Printf("Job %s was taken over by another worker, stopping", job.ID)
+			cancel()
+			return
+		}
+	}
+}
+
+// processStoredVideo copies job's source out of storage into a scratch file
+// and runs it through storeUploadedVideo.
+func (cfg *apiConfig) processStoredVideo(ctx context.Context, job database.ProcessingJob) error {
+	src, _, err := cfg.store.Get(ctx, job.SourceKey)
+	if err != nil {
+		return fmt.Errorf("couldn't get source video: %w", err)
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(cfg.uploadsRoot, "tubely-source*.mp4")
+	if err != nil {
+		return fmt.Errorf("couldn't create scratch file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	_, err = io.Copy(tmp, src)
+	if err != nil {
+		return fmt.Errorf("couldn't download source video: %w", err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("couldn't download source video: %w", err)
+	}
+
+	_, err = cfg.storeUploadedVideo(ctx, job.VideoID, tmp.Name(), job.ContentType)
+	return err
+}
+
+// storeUploadedVideo runs a complete upload at srcPath through the faststart
+// and aspect ratio pipeline, puts the result in storage and records its key
+// on the video. When HLS is enabled the ladder is packaged alongside it, and
+// a thumbnail is extracted if the video doesn't have one yet.
+func (cfg *apiConfig) storeUploadedVideo(ctx context.Context, videoID uuid.UUID, srcPath, mediaType string) (database.Video, error) {
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("couldn't get video: %w", err)
+	}
+	if video.ID == uuid.Nil {
+		return database.Video{}, errors.New("video was deleted before processing")
+	}
+
+	processedFilepath, err := processVideoForFasterStart(srcPath)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("couldn't process video: %w", err)
+	}
+
+	dst, err := os.Open(processedFilepath)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("couldn't open processed video: %w", err)
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	meta, err := probeVideo(dst.Name())
+	if err != nil {
+		return database.Video{}, fmt.Errorf("couldn't probe video: %w", err)
+	}
+
+	var keyPrefix string
+	switch aspectRatioFromMetadata(meta) {
+	case "16:9":
+		keyPrefix = "landscape"
+
+	case "9:16":
+		keyPrefix = "portrait"
+
+	default:
+		keyPrefix = "other"
+	}
+
+	bucketKey, err := makeObjectKey(keyPrefix)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("couldn't generate bucket key: %w", err)
+	}
+
+	var hlsKey *string
+	if cfg.hlsEnabled {
+		masterKey, err := cfg.packageHLS(ctx, dst.Name(), bucketKey, meta)
+		if err != nil {
+			return database.Video{}, fmt.Errorf("couldn't package HLS: %w", err)
+		}
+		hlsKey = &masterKey
+	}
+
+	log.Printf("Uploading video to storage: %s", bucketKey)
+	err = cfg.store.Put(ctx, bucketKey, dst, mediaType)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("couldn't upload video: %w", err)
+	}
+
+	// Images are made before the reload below so that a thumbnail uploaded
+	// while ffmpeg runs wins over the generated one.
+	images := cfg.generateImages(ctx, video, dst.Name(), meta)
+
+	// Reload the video so edits made while processing aren't overwritten.
+	video, err = cfg.db.GetVideo(videoID)
+	if err != nil {
+		cfg.removeAssets(ctx, images.urls())
+		return database.Video{}, fmt.Errorf("couldn't get video: %w", err)
+	}
+	// The stored video files are left for garbage collection.
+	if video.ID == uuid.Nil {
+		cfg.removeAssets(ctx, images.urls())
+		return database.Video{}, errors.New("video was deleted while processing")
+	}
+	staleAssets := images.applyTo(&video)
+	replaced := database.VideoFiles{VideoURL: video.VideoURL, HLSURL: video.HLSURL}
+	video.VideoURL = &bucketKey
+	video.HLSURL = hlsKey
+	video.ProcessingStatus = database.VideoStatusReady
+	video.ProcessingError = nil
+
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		cfg.removeAssets(ctx, images.urls())
+		return video, fmt.Errorf("couldn't update video: %w", err)
+	}
+	cfg.removeAssets(ctx, staleAssets)
+	err = cfg.deleteVideoFiles(ctx, replaced)
+	if err != nil {
+		log.Printf("Couldn't delete the replaced files of video %s: %v", video.ID, err)
+	}
+
+	err = cfg.db.UpsertVideoMetadata(video.ID, meta)
+	if err != nil {
+		return video, fmt.Errorf("couldn't save video metadata: %w", err)
+	}
+	video.Metadata = &meta
+	return video, nil
+}
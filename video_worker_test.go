@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// queueTestJob stores source, if it isn't empty, and queues a job for it on
+// a new video.
+func queueTestJob(t *testing.T, api *testAPI, source string) (database.Video, string) {
+	t.Helper()
+	ctx := context.Background()
+	user, err := api.cfg.db.CreateUser(database.CreateUserParams{Email: uuid.NewString() + "@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	video, err := api.cfg.db.CreateVideo(database.CreateVideoParams{Title: "video", UserID: user.ID})
+	if err != nil {
+		t.Fatalf("CreateVideo: %v", err)
+	}
+	key, err := makeObjectKey("uploads")
+	if err != nil {
+		t.Fatalf("makeObjectKey: %v", err)
+	}
+	if source != "" {
+		err = api.cfg.store.Put(ctx, key, strings.NewReader(source), "video/mp4")
+		if err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	err = api.cfg.enqueueVideoProcessing(video.ID, key, "video/mp4")
+	if err != nil {
+		t.Fatalf("enqueueVideoProcessing: %v", err)
+	}
+	return video, key
+}
+
+func claimTestJob(t *testing.T, api *testAPI) database.ProcessingJob {
+	t.Helper()
+	job, err := api.cfg.db.ClaimProcessingJob("test-worker")
+	if err != nil || job.ID == uuid.Nil {
+		t.Fatalf("ClaimProcessingJob = %+v, %v; want a job", job, err)
+	}
+	return job
+}
+
+func checkTestJob(t *testing.T, api *testAPI, job database.ProcessingJob, status string, sourceKept bool) {
+	t.Helper()
+	job, err := api.cfg.db.GetProcessingJob(job.ID)
+	if err != nil {
+		t.Fatalf("GetProcessingJob: %v", err)
+	}
+	if job.Status != status || job.Error == nil {
+		t.Errorf("job = %+v, want it %s with an error", job, status)
+	}
+	_, err = api.cfg.store.Head(context.Background(), job.SourceKey)
+	if kept := !errors.Is(err, storage.ErrNotFound); kept != sourceKept {
+		t.Errorf("source kept = %v, want %v", kept, sourceKept)
+	}
+}
+
+func TestProcessVideoJobFailures(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+
+	// A failed attempt is retried later, so the source stays.
+	queueTestJob(t, api, "not a video")
+	job := claimTestJob(t, api)
+	api.cfg.processVideoJob(ctx, job)
+	checkTestJob(t, api, job, database.JobStatusPending, true)
+
+	// Without its source a job can't ever succeed.
+	video, _ := queueTestJob(t, api, "")
+	job = claimTestJob(t, api)
+	api.cfg.processVideoJob(ctx, job)
+	checkTestJob(t, api, job, database.JobStatusFailed, false)
+	video, err := api.cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatalf("GetVideo: %v", err)
+	}
+	if video.ProcessingStatus != database.VideoStatusFailed {
+		t.Errorf("video status = %q, want %q", video.ProcessingStatus, database.VideoStatusFailed)
+	}
+
+	// Workers that kept dying on a job leave it with attempts to spare.
+	queueTestJob(t, api, "not a video")
+	job = claimTestJob(t, api)
+	job.Attempts = maxProcessingAttempts + 1
+	api.cfg.processVideoJob(ctx, job)
+	checkTestJob(t, api, job, database.JobStatusFailed, false)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultFeedLimit = 50
+	maxFeedLimit     = 100
+	hlsURLExpiry     = 3600 * time.Second
+)
+
+// canViewVideo reports whether userID, which is uuid.Nil for anonymous
+// callers, may see the video. Unlisted videos are viewable by anyone who
+// knows the ID; private ones need at least a viewer grant.
+func (cfg *apiConfig) canViewVideo(video database.Video, userID uuid.UUID) (bool, error) {
+	if video.Visibility == database.VisibilityPublic || video.Visibility == database.VisibilityUnlisted {
+		return true, nil
+	}
+	return cfg.hasVideoRole(video, userID, database.RoleViewer)
+}
+
+// signedHLSPlaylistURL returns the master playlist URL with an expiring
+// signature, since players fetch playlists without the caller's JWT.
+func (cfg *apiConfig) signedHLSPlaylistURL(videoID uuid.UUID) string {
+	expires := strconv.FormatInt(time.Now().Add(hlsURLExpiry).Unix(), 10)
+	query := url.Values{}
+	query.Set("expires", expires)
+	query.Set("signature", cfg.hlsSignature(videoID, expires))
+	return hlsPlaylistURL(videoID) + "?" + query.Encode()
+}
+
+func (cfg *apiConfig) hlsSignature(videoID uuid.UUID, expires string) string {
+	mac := hmac.New(sha256.New, []byte(cfg.jwtSecret))
+	fmt.Fprintf(mac, "hls\n%s\n%s", videoID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (cfg *apiConfig) validHLSSignature(videoID uuid.UUID, query url.Values) bool {
+	expires := query.Get("expires")
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return false
+	}
+	return hmac.Equal([]byte(query.Get("signature")), []byte(cfg.hlsSignature(videoID, expires)))
+}
+
+func (cfg *apiConfig) handlerVideoVisibilityUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Visibility string `json:"visibility"`
+	}
+
+	video, _, ok := cfg.getVideoForRole(w, r, database.RoleOwner)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if !database.ValidVisibility(params.Visibility) {
+		respondWithError(w, http.StatusBadRequest, "visibility must be private, unlisted or public", nil)
+		return
+	}
+
+	video.Visibility = params.Visibility
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error updating video", err)
+		return
+	}
+
+	video, _ = cfg.dbVideoToSignedVideo(video)
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+// handlerPublicFeed lists the newest public videos across all users.
+func (cfg *apiConfig) handlerPublicFeed(w http.ResponseWriter, r *http.Request) {
+	limit := defaultFeedLimit
+	if limitString := r.URL.Query().Get("limit"); limitString != "" {
+		var err error
+		limit, err = strconv.Atoi(limitString)
+		if err != nil || limit < 1 || limit > maxFeedLimit {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxFeedLimit), err)
+			return
+		}
+	}
+
+	videos, err := cfg.db.GetPublicVideos(limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	for i := range videos {
+		videos[i], err = cfg.dbVideoToSignedVideo(videos[i])
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error generating signed video URL", err)
+			return
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, videos)
+}